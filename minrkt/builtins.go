@@ -0,0 +1,449 @@
+package minrkt
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// Value is a MiniRacket value as seen by Go code: float64, bool, string,
+// *Exn or any value a builtin chooses to return
+type Value = interface{}
+
+// inexact is a number Racket would keep as a flonum: one written with a
+// decimal point, +inf.0, -inf.0 or +nan.0, or computed from such a
+// number. Exact numbers are float64. Go code outside this package sees
+// every number as a float64, also inside lists and hash tables: see
+// hostValue.
+type inexact float64
+
+// BuiltinFunc implements a builtin procedure. The arguments have already
+// been evaluated and checked against the builtin's arity.
+type BuiltinFunc func(args []Value) (Value, error)
+
+// Variadic is the arity of a builtin that accepts any number of arguments
+const Variadic = -1
+
+// AtLeast returns the arity of a builtin that needs at least n arguments
+func AtLeast(n int) int {
+	return -n - 1
+}
+
+// Builtin is a procedure implemented in Go
+type Builtin struct {
+	Name  string
+	Arity int // exact number of arguments, or AtLeast(n)
+	Fn    BuiltinFunc
+	// typ is the signature the TypeChecker checks calls against, nil for
+	// builtins defined with DefineBuiltin
+	typ *typ
+}
+
+// HostError wraps an error returned by a builtin defined through
+// DefineBuiltin. Scripts see it as an exn:fail.
+type HostError struct {
+	Name string
+	Err  error
+}
+
+func (e *HostError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Name, e.Err)
+}
+
+func (e *HostError) Unwrap() error {
+	return e.Err
+}
+
+func (b *Builtin) accepts(n int) bool {
+	if b.Arity >= 0 {
+		return n == b.Arity
+	}
+	return n >= -b.Arity-1
+}
+
+func (b *Builtin) arityString() string {
+	if b.Arity >= 0 {
+		return fmt.Sprint(b.Arity)
+	}
+	return fmt.Sprintf("at least %d", -b.Arity-1)
+}
+
+func (b *Builtin) call(args []Value) (Value, error) {
+	if !b.accepts(len(args)) {
+		return nil, arityError(b.Name, b.arityString(), len(args))
+	}
+	if b.typ == nil {
+		args = hostArgs(args)
+	}
+	result, err := b.Fn(args)
+	if err != nil {
+		if _, ok := exnValue(err); !ok && !isLimitError(err) {
+			err = &HostError{b.Name, err}
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// hostArgs returns args as a builtin defined by the host sees them
+func hostArgs(args []Value) []Value {
+	return hostValue(args).([]Value)
+}
+
+// hostValue returns val as Go code outside this package sees it: with
+// every inexact number in it, however deeply nested, turned into a
+// float64. Lists and hash tables that hold one are copied rather than
+// changed, since the script may still hold them.
+func hostValue(val Value) Value {
+	if !hasInexact(val) {
+		return val
+	}
+	switch v := val.(type) {
+	case inexact:
+		return float64(v)
+	case []Value:
+		lst := make([]Value, len(v))
+		for i, elem := range v {
+			lst[i] = hostValue(elem)
+		}
+		return lst
+	case map[string]Value:
+		table := make(map[string]Value, len(v))
+		for key, elem := range v {
+			table[key] = hostValue(elem)
+		}
+		return table
+	}
+	return val
+}
+
+// hasInexact reports whether val is or holds an inexact number
+func hasInexact(val Value) bool {
+	switch v := val.(type) {
+	case inexact:
+		return true
+	case []Value:
+		for _, elem := range v {
+			if hasInexact(elem) {
+				return true
+			}
+		}
+	case map[string]Value:
+		for _, elem := range v {
+			if hasInexact(elem) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DefineBuiltin makes fn callable from scripts run in env as name. It
+// takes precedence over a standard builtin of the same name, including
+// the arithmetic and comparison operators.
+func (env *Environment) DefineBuiltin(name string, arity int, fn BuiltinFunc) {
+	env.defineBuiltin(&Builtin{name, arity, fn, nil})
+}
+
+// defineTyped is DefineBuiltin for builtins with a known signature
+func (env *Environment) defineTyped(name string, t *typ, fn BuiltinFunc) {
+	env.defineBuiltin(&Builtin{name, t.arity(), fn, t})
+}
+
+func (env *Environment) defineBuiltin(builtin *Builtin) {
+	g := env.globals()
+	defer g.lock()()
+	g.own()
+	g.builtins[builtin.Name] = builtin
+}
+
+// lookupBuiltin finds the builtin env uses for name
+func (env *Environment) lookupBuiltin(name string) (*Builtin, bool) {
+	var builtin *Builtin
+	found := false
+	cache := env.cached()
+	if cache != nil {
+		builtin, found = cache.builtins[name]
+	}
+	if !found {
+		g := env.globals()
+		unlock := g.rlock()
+		builtin = g.builtins[name]
+		unlock()
+		if cache != nil {
+			cache.builtins[name] = builtin
+		}
+	}
+	if builtin != nil {
+		return builtin, true
+	}
+	builtin, ok := standardBuiltins[name]
+	return builtin, ok
+}
+
+// BuiltinNames lists the builtins visible in env in sorted order
+func (env *Environment) BuiltinNames() []string {
+	g := env.globals()
+	defer g.rlock()()
+	var names []string
+	for name := range standardBuiltins {
+		if _, ok := g.builtins[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	for name := range g.builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// builtins every environment starts with. They are the same builtins
+// DefineBuiltin makes, but kept in one table all environments share
+// rather than copied into each one; an environment's own builtins are
+// looked up first, so DefineBuiltin still overrides any of them.
+var standardBuiltins = map[string]*Builtin{}
+
+// defineStandard defines a standard builtin with signature t, which also
+// gives its arity
+func defineStandard(name string, t *typ, fn BuiltinFunc) {
+	standardBuiltins[name] = &Builtin{name, t.arity(), fn, t}
+}
+
+func init() {
+	defineStandard("+", restType(tNumber, tNumber), func(args []Value) (Value, error) {
+		var sum float64
+		for _, arg := range args {
+			subSum, err := numberArg("+", arg)
+			if err != nil {
+				return nil, err
+			}
+			sum = sum + subSum
+		}
+		return numberValue(sum, allExact(args)), nil
+	})
+	defineStandard("-", restType(tNumber, tNumber, tNumber), func(args []Value) (Value, error) {
+		var diff float64
+		subtrahends := args
+		if len(args) > 1 {
+			first, err := numberArg("-", args[0])
+			if err != nil {
+				return nil, err
+			}
+			diff = first
+			subtrahends = args[1:]
+		}
+		for _, arg := range subtrahends {
+			subDiff, err := numberArg("-", arg)
+			if err != nil {
+				return nil, err
+			}
+			diff = diff - subDiff
+		}
+		return numberValue(diff, allExact(args)), nil
+	})
+	defineStandard("*", restType(tNumber, tNumber), func(args []Value) (Value, error) {
+		product := 1.0
+		for _, arg := range args {
+			subProduct, err := numberArg("*", arg)
+			if err != nil {
+				return nil, err
+			}
+			product = product * subProduct
+		}
+		return numberValue(product, allExact(args)), nil
+	})
+	defineStandard("/", restType(tNumber, tNumber, tNumber), func(args []Value) (Value, error) {
+		quotient := 1.0 // (/ x) is the reciprocal of x
+		divisors := args
+		if len(args) > 1 {
+			first, err := numberArg("/", args[0])
+			if err != nil {
+				return nil, err
+			}
+			quotient = first
+			divisors = args[1:]
+		}
+		for _, arg := range divisors {
+			subQuotient, err := divisorArg(arg)
+			if err != nil {
+				return nil, err
+			}
+			quotient = quotient / subQuotient
+		}
+		return numberValue(quotient, allExact(args)), nil
+	})
+	defineStandard("=", funcType(tBoolean, tAny, tAny), func(args []Value) (Value, error) {
+		num1, ok1 := toFloat(args[0])
+		num2, ok2 := toFloat(args[1])
+		if ok1 && ok2 {
+			return num1 == num2, nil
+		}
+		if ok1 {
+			return nil, contractViolation("=", "number?", args[1])
+		}
+		if ok2 || fmt.Sprintf("%T", args[0]) != fmt.Sprintf("%T", args[1]) {
+			return nil, contractViolation("=", "number?", args[0])
+		}
+		return valuesEqual(args[0], args[1]), nil
+	})
+	defineComparison(">=", func(a, b float64) bool { return a >= b })
+	defineComparison("<=", func(a, b float64) bool { return a <= b })
+	defineComparison(">", func(a, b float64) bool { return a > b })
+	defineComparison("<", func(a, b float64) bool { return a < b })
+	defineExtremum("max", math.Max)
+	defineExtremum("min", math.Min)
+	defineStandard("even?", funcType(tBoolean, tNumber), func(args []Value) (Value, error) {
+		n, err := integerArg("even?", args[0])
+		if err != nil {
+			return nil, err
+		}
+		return math.Mod(n, 2) == 0, nil
+	})
+	defineStandard("odd?", funcType(tBoolean, tNumber), func(args []Value) (Value, error) {
+		n, err := integerArg("odd?", args[0])
+		if err != nil {
+			return nil, err
+		}
+		return math.Mod(n, 2) != 0, nil
+	})
+	defineStandard("void", restType(tVoid, tAny), func(args []Value) (Value, error) {
+		return nil, nil
+	})
+	defineStandard("not", funcType(tBoolean, tAny), func(args []Value) (Value, error) {
+		b, ok := args[0].(bool)
+		if !ok {
+			return nil, &EvalError{"'not' operand must be boolean"}
+		}
+		return !b, nil
+	})
+}
+
+// valuesEqual compares values of the same type, including lists and hash
+// tables, which Go's == cannot
+func valuesEqual(a, b Value) bool {
+	if a == nil || reflect.TypeOf(a).Comparable() {
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func defineComparison(op string, cmp func(a, b float64) bool) {
+	defineStandard(op, funcType(tBoolean, tNumber, tNumber), func(args []Value) (Value, error) {
+		num1, ok1 := toFloat(args[0])
+		num2, ok2 := toFloat(args[1])
+		if !ok1 {
+			return nil, contractViolation(op, "number?", args[0])
+		}
+		if !ok2 {
+			return nil, contractViolation(op, "number?", args[1])
+		}
+		return cmp(num1, num2), nil
+	})
+}
+
+// defineExtremum defines max or min, which pick from any number of
+// arguments with pick
+func defineExtremum(op string, pick func(a, b float64) float64) {
+	defineStandard(op, restType(tNumber, tNumber, tNumber), func(args []Value) (Value, error) {
+		best, err := numberArg(op, args[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, arg := range args[1:] {
+			num, err := numberArg(op, arg)
+			if err != nil {
+				return nil, err
+			}
+			best = pick(best, num)
+		}
+		return numberValue(best, allExact(args)), nil
+	})
+}
+
+// integerArg is numberArg for the builtins that take integers
+func integerArg(op string, val Value) (float64, error) {
+	num, ok := toFloat(val)
+	if !ok || num != math.Trunc(num) {
+		return 0, contractViolation(op, "integer?", val)
+	}
+	return num, nil
+}
+
+// divisorArg is numberArg for the divisors of /. Only an exact zero is an
+// error; dividing by an inexact one gives an infinity or +nan.0.
+func divisorArg(val Value) (float64, error) {
+	num, err := numberArg("/", val)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := val.(inexact); !ok && num == 0 {
+		return 0, newExnError(EXN_DIVIDE_BY_ZERO, "/: division by zero")
+	}
+	return num, nil
+}
+
+// checkOperand returns the error the standard arithmetic builtin op
+// raises for arg, which is a divisor if op is / and divisor is set. The
+// evaluators check each operand as it is evaluated, so that they stop at
+// the first bad one without evaluating the rest.
+func checkOperand(op string, arg Value, divisor bool) error {
+	switch op {
+	case "+", "-", "*":
+		_, err := numberArg(op, arg)
+		return err
+	case "/":
+		if divisor {
+			_, err := divisorArg(arg)
+			return err
+		}
+		_, err := numberArg(op, arg)
+		return err
+	}
+	return nil
+}
+
+func numberArg(op string, val Value) (float64, error) {
+	num, ok := toFloat(val)
+	if !ok {
+		return 0, contractViolation(op, "number?", val)
+	}
+	return num, nil
+}
+
+// contractViolation is the error op raises when given val where it
+// expects a value satisfying the predicate named expected
+func contractViolation(op, expected string, val Value) error {
+	return &EvalError{fmt.Sprintf("%s: contract violation; expected: %s; given: %s", op, expected, showValue(val))}
+}
+
+// toFloat returns the value of a number, exact or not
+func toFloat(val Value) (float64, bool) {
+	switch num := val.(type) {
+	case float64:
+		return num, true
+	case inexact:
+		return float64(num), true
+	}
+	return 0, false
+}
+
+// allExact reports whether none of args is an inexact number, which
+// would make the result of arithmetic on them inexact too
+func allExact(args []Value) bool {
+	for _, arg := range args {
+		if _, ok := arg.(inexact); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// numberValue is num as an exact or inexact number
+func numberValue(num float64, exact bool) Value {
+	if exact {
+		return num
+	}
+	return inexact(num)
+}
@@ -0,0 +1,166 @@
+package minrkt
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+var errNegative = errors.New("negative argument")
+
+func newBuiltinTestEnv() *Environment {
+	env := newTestEnv()
+	env.DefineBuiltin("sqrt", 1, func(args []Value) (Value, error) {
+		x, ok := args[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("expected number, given %v", args[0])
+		}
+		if x < 0 {
+			return nil, errNegative
+		}
+		return math.Sqrt(x), nil
+	})
+	env.DefineBuiltin("count", Variadic, func(args []Value) (Value, error) {
+		return float64(len(args)), nil
+	})
+	env.DefineBuiltin("max", AtLeast(1), func(args []Value) (Value, error) {
+		best := math.Inf(-1)
+		for _, arg := range args {
+			best = math.Max(best, arg.(float64))
+		}
+		return best, nil
+	})
+	return env
+}
+
+func TestDefineBuiltin(t *testing.T) {
+	var tests = []struct {
+		a    string
+		want interface{}
+	}{
+		{"(sqrt 16)", 4.0},
+		{"(+ 1 (sqrt (* 3 3)))", 4.0},
+		{"(count)", 0.0},
+		{"(count 1 #t \"s\")", 3.0},
+		{"(max 3 9 2)", 9.0},
+		{"(with-handlers ([exn:fail:contract:arity? exn-message]) (max))", "max: arity mismatch; expected at least 1, given 0"},
+		{"(with-handlers ([exn:fail:contract:arity? exn-message]) (sqrt 1 2))", "sqrt: arity mismatch; expected 1, given 2"},
+		{"(with-handlers ([exn:fail? exn-message]) (sqrt (- 4)))", "sqrt: negative argument"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			got, err := evalLines(newBuiltinTestEnv(), tt.a)
+			if err != nil || got != tt.want {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuiltinHostError(t *testing.T) {
+	_, err := evalLines(newBuiltinTestEnv(), "(sqrt (- 4))")
+	var hostErr *HostError
+	if !errors.As(err, &hostErr) || hostErr.Name != "sqrt" || !errors.Is(err, errNegative) {
+		t.Errorf("got %T %v, want *HostError wrapping %v", err, err, errNegative)
+	}
+}
+
+func TestDefineBuiltinOverrides(t *testing.T) {
+	env := newBuiltinTestEnv()
+	env.DefineBuiltin("+", Variadic, func(args []Value) (Value, error) {
+		return "plus", nil
+	})
+	if got, err := evalLines(env, "(+ 1 2)"); got != "plus" || err != nil {
+		t.Errorf("got %v %v, want plus", got, err)
+	}
+	// an override is given every operand, whatever its type
+	if got, err := evalLines(env, "(+ 1 #t \"s\")"); got != "plus" || err != nil {
+		t.Errorf("got %v %v, want plus", got, err)
+	}
+	if got, err := execLines(env, "(+ 1 #t \"s\")"); got != "plus" || err != nil {
+		t.Errorf("got %v %v from Execute, want plus", got, err)
+	}
+	if got, err := evalLines(newTestEnv(), "(+ 1 2)"); got != 3.0 || err != nil {
+		t.Errorf("override leaked into another environment: got %v %v", got, err)
+	}
+	// a host builtin sees inexact numbers as float64 too
+	env.DefineBuiltin("half", 1, func(args []Value) (Value, error) {
+		return args[0].(float64) / 2, nil
+	})
+	if got, err := evalLines(env, "(half 3.0)"); got != 1.5 || err != nil {
+		t.Errorf("got %v %v, want 1.5", got, err)
+	}
+	// also inside lists and hash tables, without changing the script's
+	env.DefineBuiltin("types", 1, func(args []Value) (Value, error) {
+		lst := args[0].([]Value)
+		table := lst[1].([]Value)[0].(map[string]Value)
+		lst[0] = "changed"
+		return fmt.Sprintf("%T %T", lst[2], table["a"]), nil
+	})
+	got, err := evalLines(env, "(define lst (list 1 (list (hash \"a\" 2.0)) 0.5))", "(types lst)")
+	if got != "float64 float64" || err != nil {
+		t.Errorf("got %v %v, want float64 float64", got, err)
+	}
+	if got, err := evalLines(env, "(first lst)"); got != 1.0 || err != nil {
+		t.Errorf("host builtin changed the script's list: got %v %v", got, err)
+	}
+	// a user definition shadows a builtin of the same name
+	if got, err := evalLines(env, "(define (sqrt x) x)", "(sqrt 9)"); got != 9.0 || err != nil {
+		t.Errorf("got %v %v, want 9", got, err)
+	}
+}
+
+func TestMissingOperatorBuiltin(t *testing.T) {
+	for _, op := range []string{"+", "not"} {
+		builtin := standardBuiltins[op]
+		delete(standardBuiltins, op)
+		_, err := evalLines(newTestEnv(), "("+op+" #t)")
+		standardBuiltins[op] = builtin
+		var undefinedErr *UndefinedError
+		if !errors.As(err, &undefinedErr) || err.Error() != op+" undefined" {
+			t.Errorf("got %v, want %s undefined", err, op)
+		}
+	}
+}
+
+func TestBuiltinNames(t *testing.T) {
+	names := newBuiltinTestEnv().BuiltinNames()
+	found := make(map[string]bool)
+	for i, name := range names {
+		found[name] = true
+		if i > 0 && names[i-1] >= name {
+			t.Errorf("names not sorted and unique at %d: %v", i, names)
+		}
+	}
+	for _, name := range []string{"+", "/", "not", "raise", "exn:fail?", "sqrt", "count", "max"} {
+		if !found[name] {
+			t.Errorf("%s missing from %v", name, names)
+		}
+	}
+}
+
+func TestComparisonContractViolations(t *testing.T) {
+	var tests = []struct {
+		a    string
+		want string
+	}{
+		{"(= 1 #t)", "=: contract violation; expected: number?; given: #t"},
+		{`(= "a" 1)`, `=: contract violation; expected: number?; given: "a"`},
+		{`(= "a" #t)`, `=: contract violation; expected: number?; given: "a"`},
+		{"(< 1 #f)", "<: contract violation; expected: number?; given: #f"},
+		{`(>= "a" 1)`, `>=: contract violation; expected: number?; given: "a"`},
+		{"(> (list 1) 2.5)", ">: contract violation; expected: number?; given: '(1)"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			_, err := evalLines(newTestEnv(), tt.a)
+			var evalErr *EvalError
+			if !errors.As(err, &evalErr) || evalErr.Error() != tt.want {
+				t.Errorf("got %T %v, want EvalError %s", err, err, tt.want)
+			}
+		})
+	}
+}
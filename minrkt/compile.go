@@ -0,0 +1,278 @@
+package minrkt
+
+import "fmt"
+
+type opcode uint8
+
+const (
+	opConst        opcode = iota // push consts[a]
+	opLocal                      // push the a-th parameter of the current call
+	opGlobal                     // push the global variable names[a]
+	opDefine                     // pop a value into the global names[a], push void
+	opDefineFunc                 // define funcs[a], push void
+	opCall                       // call the procedure names[a] with b arguments
+	opOperator                   // call the builtin operator names[a] with b arguments
+	opBool                       // fail unless the top value is a boolean; consts[a] names it
+	opJumpIfFalse                // pop a boolean, jump to a when it is false
+	opShortCircuit               // jump to a keeping the top value if it equals b == 1, else pop it
+	opJump                       // jump to a
+	opFail                       // fail with the message consts[a]
+	opPushHandler                // install handlers[a], whose body ends at b
+	opPopHandler                 // remove the innermost handler
+	opBind                       // pop a value into local slot a
+	opOperand                    // check the top value as an operand of the operator names[a], a divisor if b == 1
+	opModule                     // run the require or module form modules[a], push void
+	opReturn                     // return the top value from the current call
+)
+
+type instr struct {
+	op   opcode
+	a, b int
+}
+
+// Code is the bytecode for one top-level form or function body, produced
+// by Compile and run by Execute. Parameters are resolved to slots at
+// compile time; globals and procedures are still looked up by name when
+// they run, so they may be defined after the code that uses them.
+type Code struct {
+	instrs []instr
+	// forms holds, for each instruction, the innermost expression that
+	// adds itself to the breadcrumb of an error raised there, and
+	// parents links each of those to the next one out
+	forms    []Exp
+	parents  map[Exp]Exp
+	consts   []Value
+	names    []string
+	funcs    []*expDefineFunc
+	handlers []*expWithHandlers
+	// require and module forms, which the tree-walking evaluator runs
+	modules []Exp
+}
+
+type compiler struct {
+	code    *Code
+	params  []string
+	form    Exp
+	nameIdx map[string]int
+}
+
+// Compile translates root into bytecode for Execute. syntax and
+// syntax-case forms are not supported; Evaluator runs them instead.
+func Compile(root Exp) (*Code, error) {
+	return compileBody(root, nil)
+}
+
+// compileBody compiles a function body, or a top-level form when params
+// is nil
+func compileBody(root Exp, params []string) (*Code, error) {
+	c := &compiler{
+		code:    &Code{parents: make(map[Exp]Exp)},
+		params:  append([]string(nil), params...),
+		nameIdx: make(map[string]int),
+	}
+	if err := c.compile(root); err != nil {
+		return nil, err
+	}
+	c.emit(opReturn, 0, 0)
+	return c.code, nil
+}
+
+func (c *compiler) emit(op opcode, a, b int) int {
+	c.code.instrs = append(c.code.instrs, instr{op, a, b})
+	c.code.forms = append(c.code.forms, c.form)
+	return len(c.code.instrs) - 1
+}
+
+// patch points the jump at pc to the next instruction
+func (c *compiler) patch(pc int) {
+	c.code.instrs[pc].a = len(c.code.instrs)
+}
+
+func (c *compiler) constant(val Value) int {
+	c.code.consts = append(c.code.consts, val)
+	return len(c.code.consts) - 1
+}
+
+func (c *compiler) name(name string) int {
+	if i, ok := c.nameIdx[name]; ok {
+		return i
+	}
+	c.code.names = append(c.code.names, name)
+	c.nameIdx[name] = len(c.code.names) - 1
+	return len(c.code.names) - 1
+}
+
+// slot is the parameter a variable refers to, or -1 for a global. A
+// later parameter shadows an earlier one of the same name.
+func (c *compiler) slot(name string) int {
+	for i := len(c.params) - 1; i >= 0; i-- {
+		if c.params[i] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// enter makes e the form errors raised by its instructions are reported
+// in, returning a function that restores the enclosing one
+func (c *compiler) enter(e Exp) func() {
+	outer := c.form
+	c.code.parents[e] = outer
+	c.form = e
+	return func() { c.form = outer }
+}
+
+func (c *compiler) compileAll(exps []Exp) error {
+	for _, exp := range exps {
+		if err := c.compile(exp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *compiler) compile(exp Exp) error {
+	switch e := exp.(type) {
+	case *expNumConst:
+		c.emit(opConst, c.constant(e.val), 0)
+	case *expInexactConst:
+		c.emit(opConst, c.constant(inexact(e.val)), 0)
+	case *expBoolConst:
+		c.emit(opConst, c.constant(e.val), 0)
+	case *expStrConst:
+		c.emit(opConst, c.constant(e.val), 0)
+	case *expVar:
+		if slot := c.slot(e.name); slot >= 0 {
+			c.emit(opLocal, slot, 0)
+		} else {
+			c.emit(opGlobal, c.name(e.name), 0)
+		}
+	case *expLocal:
+		c.emit(opLocal, c.slot(e.name), 0)
+	case *expFrame:
+		return c.compile(e.body)
+	case *expFunc:
+		defer c.enter(e)()
+		if err := c.compileAll(e.arguments); err != nil {
+			return err
+		}
+		c.emit(opCall, c.name(e.name), len(e.arguments))
+	case *expDefineVar:
+		leave := c.enter(e)
+		err := c.compile(e.val)
+		leave()
+		if err != nil {
+			return err
+		}
+		c.emit(opDefine, c.name(e.name), 0)
+	case *expTypeAnn, *expProvide:
+		c.emit(opConst, c.constant(nil), 0)
+	case *expRequire, *expModule:
+		c.code.modules = append(c.code.modules, e)
+		c.emit(opModule, len(c.code.modules)-1, 0)
+	case *expDefineFunc:
+		c.code.funcs = append(c.code.funcs, e)
+		c.emit(opDefineFunc, len(c.code.funcs)-1, 0)
+	case *expOperator:
+		defer c.enter(e)()
+		return c.compileOperator(e)
+	case *expLet:
+		defer c.enter(e)()
+		if err := c.compileAll(e.vals); err != nil {
+			return err
+		}
+		// the bindings take the slots after the enclosing ones
+		base := len(c.params)
+		c.params = append(c.params, e.names...)
+		for i := len(e.names) - 1; i >= 0; i-- {
+			c.emit(opBind, base+i, 0)
+		}
+		err := c.compile(e.body)
+		c.params = c.params[:base]
+		return err
+	case *expWithHandlers:
+		c.code.handlers = append(c.code.handlers, e)
+		push := c.emit(opPushHandler, len(c.code.handlers)-1, 0)
+		if err := c.compile(e.body); err != nil {
+			return err
+		}
+		c.emit(opPopHandler, 0, 0)
+		c.code.instrs[push].b = len(c.code.instrs)
+	case *expSyntax, *expSyntaxCase:
+		// their templates and patterns bind variables the VM's slots
+		// know nothing about
+		return fmt.Errorf("compile: syntax and syntax-case are not supported; use Evaluator")
+	default:
+		return fmt.Errorf("compile: unsupported expression %T", exp)
+	}
+	return nil
+}
+
+// compileOperator mirrors expOperator.eval, including its operand count
+// checks, which fail at run time
+func (c *compiler) compileOperator(e *expOperator) error {
+	op := operatorNames[e.opType]
+	fail := func(msg string) error {
+		c.emit(opFail, c.constant(msg), 0)
+		return nil
+	}
+	switch e.opType {
+	case TOK_AND, TOK_OR:
+		if len(e.operands) != 2 {
+			return fail(fmt.Sprintf("'%s' requires 2 operands", op))
+		}
+		if err := c.compile(e.operands[0]); err != nil {
+			return err
+		}
+		c.emit(opBool, c.constant("first '"+op+"' operand"), 0)
+		keep := 0
+		if e.opType == TOK_OR {
+			keep = 1
+		}
+		jump := c.emit(opShortCircuit, 0, keep)
+		if err := c.compile(e.operands[1]); err != nil {
+			return err
+		}
+		c.emit(opBool, c.constant("second '"+op+"' operand"), 0)
+		c.patch(jump)
+	case TOK_IF:
+		if len(e.operands) != 3 {
+			return fail("'if' requires 3 operands")
+		}
+		if err := c.compile(e.operands[0]); err != nil {
+			return err
+		}
+		c.emit(opBool, c.constant("'if' test"), 0)
+		toElse := c.emit(opJumpIfFalse, 0, 0)
+		if err := c.compile(e.operands[1]); err != nil {
+			return err
+		}
+		toEnd := c.emit(opJump, 0, 0)
+		c.patch(toElse)
+		if err := c.compile(e.operands[2]); err != nil {
+			return err
+		}
+		c.patch(toEnd)
+	case TOK_NOT:
+		if len(e.operands) != 1 {
+			return fail("'not' requires 1 operand")
+		}
+		fallthrough
+	default:
+		for i, operand := range e.operands {
+			if err := c.compile(operand); err != nil {
+				return err
+			}
+			switch e.opType {
+			case TOK_ADD, TOK_SUB, TOK_MUL, TOK_DIV:
+				divisor := 0
+				if i > 0 || len(e.operands) == 1 {
+					divisor = 1
+				}
+				c.emit(opOperand, c.name(op), divisor)
+			}
+		}
+		c.emit(opOperator, c.name(op), len(e.operands))
+	}
+	return nil
+}
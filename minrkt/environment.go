@@ -0,0 +1,411 @@
+package minrkt
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+//go:embed lib/prelude.rkt
+var standardPrelude string
+
+type envConfig struct {
+	out      io.Writer
+	sandbox  bool
+	preludes []string
+	dir      string
+}
+
+// EnvOption configures an Environment built by NewEnvironment
+type EnvOption func(*envConfig)
+
+// WithOutput sends the output of display and friends to w instead of
+// os.Stdout
+func WithOutput(w io.Writer) EnvOption {
+	return func(c *envConfig) {
+		c.out = w
+	}
+}
+
+// WithStandardPrelude loads lib/prelude.rkt (add1, abs, square, ...)
+func WithStandardPrelude() EnvOption {
+	return WithPrelude(standardPrelude)
+}
+
+// WithPrelude evaluates MiniRacket source in the new environment. Preludes
+// run in the order they are given.
+func WithPrelude(src string) EnvOption {
+	return func(c *envConfig) {
+		c.preludes = append(c.preludes, src)
+	}
+}
+
+// WithDirectory resolves relative require paths against dir instead of
+// the working directory
+func WithDirectory(dir string) EnvOption {
+	return func(c *envConfig) {
+		c.dir = dir
+	}
+}
+
+// NewEnvironment returns an Environment with all of its state
+// initialised and the standard builtins, including I/O, installed
+func NewEnvironment(opts ...EnvOption) (*Environment, error) {
+	return newEnvironment(envConfig{out: os.Stdout}, opts)
+}
+
+// NewSandboxEnvironment is NewEnvironment without the I/O builtins or
+// require, for running untrusted scripts
+func NewSandboxEnvironment(opts ...EnvOption) (*Environment, error) {
+	return newEnvironment(envConfig{out: io.Discard, sandbox: true}, opts)
+}
+
+func newEnvironment(config envConfig, opts []EnvOption) (*Environment, error) {
+	for _, opt := range opts {
+		opt(&config)
+	}
+	env := &Environment{
+		variables: make(map[string]interface{}),
+		functions: make(map[string]FuncParamExpr),
+		CallStack: make([]map[string]interface{}, 0),
+		builtins:  make(map[string]*Builtin),
+		sources:   make(map[Exp]map[Exp]Pos),
+		types:     make(map[Exp]*typ),
+		mu:        new(sync.RWMutex),
+		dir:       config.dir,
+	}
+	if !config.sandbox {
+		defineIOBuiltins(env, config.out)
+		env.modules = newModuleCache(config)
+	}
+	types := NewTypeCheckerFor(env)
+	for _, src := range config.preludes {
+		prog, err := ParseSource(src)
+		if err != nil {
+			return nil, fmt.Errorf("prelude: %w", err)
+		}
+		// a prelude need not type check; its functions are then untyped
+		typed := types.Check(prog) == nil
+		if _, err := EvaluateProgram(prog, env); err != nil {
+			return nil, fmt.Errorf("prelude: %w", err)
+		}
+		for _, form := range prog.Forms {
+			def, ok := form.(*expDefineFunc)
+			if !typed || !ok {
+				continue
+			}
+			if fn, ok := env.lookupFunction(def.name); ok {
+				env.types[fn.expression] = types.funcs[def.name]
+			}
+		}
+	}
+	return env, nil
+}
+
+// defineIOBuiltins installs the builtins that write to out
+func defineIOBuiltins(env *Environment, out io.Writer) {
+	env.defineTyped("display", funcType(tVoid, tAny), func(args []Value) (Value, error) {
+		_, err := io.WriteString(out, displayValue(args[0]))
+		return nil, err
+	})
+	env.defineTyped("displayln", funcType(tVoid, tAny), func(args []Value) (Value, error) {
+		_, err := io.WriteString(out, displayValue(args[0])+"\n")
+		return nil, err
+	})
+	env.defineTyped("write", funcType(tVoid, tAny), func(args []Value) (Value, error) {
+		_, err := io.WriteString(out, writeValue(args[0]))
+		return nil, err
+	})
+	env.defineTyped("newline", funcType(tVoid), func(args []Value) (Value, error) {
+		_, err := io.WriteString(out, "\n")
+		return nil, err
+	})
+	env.defineTyped("printf", restType(tVoid, tAny, tString), func(args []Value) (Value, error) {
+		format, ok := args[0].(string)
+		if !ok {
+			return nil, &EvalError{"printf: contract violation; expected: string?; given: " + showValue(args[0])}
+		}
+		text, err := racketFormat("printf", format, args[1:])
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(out, text)
+		return nil, err
+	})
+}
+
+// displayValue renders a value the way display prints it: like
+// writeValue but with strings unquoted
+func displayValue(v Value) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case []Value:
+		var elems []string
+		for _, elem := range val {
+			elems = append(elems, displayValue(elem))
+		}
+		return "(" + strings.Join(elems, " ") + ")"
+	}
+	return writeValue(v)
+}
+
+// racketFormat expands the ~a, ~s, ~v, ~n and ~~ directives of format
+func racketFormat(op string, format string, args []Value) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '~' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'n', '%':
+			b.WriteByte('\n')
+			continue
+		case '~':
+			b.WriteByte('~')
+			continue
+		}
+		if len(args) == 0 {
+			return "", &EvalError{op + ": format string requires more arguments"}
+		}
+		switch format[i] {
+		case 'a':
+			b.WriteString(displayValue(args[0]))
+		case 's', 'v':
+			b.WriteString(writeValue(args[0]))
+		default:
+			return "", &EvalError{fmt.Sprintf("%s: unknown format directive ~%c", op, format[i])}
+		}
+		args = args[1:]
+	}
+	if len(args) != 0 {
+		return "", &EvalError{op + ": format string requires fewer arguments"}
+	}
+	return b.String(), nil
+}
+
+// Snapshot is the state of an Environment's definitions at one point in
+// time. It never changes, so any number of environments can be forked or
+// restored from it.
+type Snapshot struct {
+	variables map[string]interface{}
+	functions map[string]FuncParamExpr
+	builtins  map[string]*Builtin
+	sources   map[Exp]map[Exp]Pos
+}
+
+// Snapshot captures env's global variables, functions and builtins. The
+// maps are shared with env until one of them next changes.
+func (env *Environment) Snapshot() *Snapshot {
+	g := env.globals()
+	defer g.lock()()
+	g.cow = true
+	return &Snapshot{g.variables, g.functions, g.builtins, g.sources}
+}
+
+// Fork returns a new Environment that starts with env's definitions.
+// Definitions made in either one afterwards are not seen by the other,
+// but both share the modules they require.
+func (env *Environment) Fork() *Environment {
+	g := env.globals()
+	fork := &Environment{mu: new(sync.RWMutex), types: g.types, modules: g.modules, dir: g.dir, loading: g.loading}
+	fork.Restore(env.Snapshot())
+	return fork
+}
+
+// Restore discards the definitions made in env since snap was taken,
+// which may be from another Environment
+func (env *Environment) Restore(snap *Snapshot) {
+	g := env.globals()
+	defer g.lock()()
+	g.variables, g.functions = snap.variables, snap.functions
+	g.builtins, g.sources = snap.builtins, snap.sources
+	g.cow = true
+	g.gen.Add(1)
+}
+
+// globals is the Environment holding env's definitions
+func (env *Environment) globals() *Environment {
+	if env.root != nil {
+		return env.root
+	}
+	return env
+}
+
+// lock and rlock acquire env's lock and return the matching unlock, for
+// use as defer env.lock()()
+func (env *Environment) lock() func() {
+	if env.mu == nil {
+		return func() {}
+	}
+	env.mu.Lock()
+	return env.mu.Unlock
+}
+
+func (env *Environment) rlock() func() {
+	if env.mu == nil {
+		return func() {}
+	}
+	env.mu.RLock()
+	return env.mu.RUnlock
+}
+
+// own makes env's maps safe to write to, copying them if they are shared
+// with a Snapshot, and empties the caches of the sessions reading them.
+// The caller holds env's lock.
+func (env *Environment) own() {
+	env.gen.Add(1)
+	if !env.cow {
+		if env.variables == nil {
+			env.variables = make(map[string]interface{})
+		}
+		if env.functions == nil {
+			env.functions = make(map[string]FuncParamExpr)
+		}
+		if env.builtins == nil {
+			env.builtins = make(map[string]*Builtin)
+		}
+		if env.sources == nil {
+			env.sources = make(map[Exp]map[Exp]Pos)
+		}
+		return
+	}
+	variables := make(map[string]interface{}, len(env.variables))
+	for name, val := range env.variables {
+		variables[name] = val
+	}
+	functions := make(map[string]FuncParamExpr, len(env.functions))
+	for name, fn := range env.functions {
+		functions[name] = fn
+	}
+	builtins := make(map[string]*Builtin, len(env.builtins))
+	for name, builtin := range env.builtins {
+		builtins[name] = builtin
+	}
+	sources := make(map[Exp]map[Exp]Pos, len(env.sources))
+	for body, positions := range env.sources {
+		sources[body] = positions
+	}
+	env.variables, env.functions = variables, functions
+	env.builtins, env.sources = builtins, sources
+	env.cow = false
+}
+
+// sessionCache holds what a session has looked up in its root's
+// definitions, found or not, so that the next lookup of the same name
+// needs no lock. It is only valid while the root's gen is gen.
+type sessionCache struct {
+	gen       uint64
+	variables map[string]cachedVariable
+	functions map[string]cachedFunction
+	builtins  map[string]*Builtin
+	sources   map[Exp]map[Exp]Pos
+}
+
+type cachedVariable struct {
+	val interface{}
+	ok  bool
+}
+
+type cachedFunction struct {
+	fn FuncParamExpr
+	ok bool
+}
+
+// cached returns env's sessionCache, emptied first if the root has
+// changed since it was filled. It is nil outside of a session or when the
+// root has no lock to avoid.
+func (env *Environment) cached() *sessionCache {
+	g := env.root
+	if g == nil || g.mu == nil {
+		return nil
+	}
+	if gen := g.gen.Load(); env.cache == nil || env.cache.gen != gen {
+		env.cache = &sessionCache{
+			gen:       gen,
+			variables: make(map[string]cachedVariable),
+			functions: make(map[string]cachedFunction),
+			builtins:  make(map[string]*Builtin),
+			sources:   make(map[Exp]map[Exp]Pos),
+		}
+	}
+	return env.cache
+}
+
+func (env *Environment) lookupVariable(name string) (interface{}, bool) {
+	cache := env.cached()
+	if cache != nil {
+		if c, ok := cache.variables[name]; ok {
+			return c.val, c.ok
+		}
+	}
+	g := env.globals()
+	unlock := g.rlock()
+	val, ok := g.variables[name]
+	unlock()
+	if cache != nil {
+		cache.variables[name] = cachedVariable{val, ok}
+	}
+	return val, ok
+}
+
+func (env *Environment) lookupFunction(name string) (FuncParamExpr, bool) {
+	cache := env.cached()
+	if cache != nil {
+		if c, ok := cache.functions[name]; ok {
+			return c.fn, c.ok
+		}
+	}
+	g := env.globals()
+	unlock := g.rlock()
+	fn, ok := g.functions[name]
+	unlock()
+	if cache != nil {
+		cache.functions[name] = cachedFunction{fn, ok}
+	}
+	return fn, ok
+}
+
+func (env *Environment) setVariable(name string, val interface{}) {
+	g := env.globals()
+	defer g.lock()()
+	g.own()
+	g.variables[name] = val
+}
+
+func (env *Environment) setFunction(name string, fn FuncParamExpr) {
+	g := env.globals()
+	defer g.lock()()
+	g.own()
+	if old, ok := g.functions[name]; ok {
+		delete(g.sources, old.expression)
+	}
+	g.functions[name] = fn
+	if env.positions != nil {
+		g.sources[fn.expression] = env.positions
+	}
+}
+
+// sourceOf returns the positions of the program that defined the
+// function with the given body
+func (env *Environment) sourceOf(body Exp) map[Exp]Pos {
+	cache := env.cached()
+	if cache != nil {
+		if positions, ok := cache.sources[body]; ok {
+			return positions
+		}
+	}
+	g := env.globals()
+	unlock := g.rlock()
+	positions := g.sources[body]
+	unlock()
+	if cache != nil {
+		cache.sources[body] = positions
+	}
+	return positions
+}
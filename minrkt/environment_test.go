@@ -0,0 +1,349 @@
+package minrkt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStandardPrelude(t *testing.T) {
+	var tests = []struct {
+		a    string
+		want interface{}
+	}{
+		{"(add1 4)", 5.0},
+		{"(sub1 4)", 3.0},
+		{"(zero? 0)", "#t"},
+		{"(positive? (- 2))", "#f"},
+		{"(negative? (- 2))", "#t"},
+		{"(even? 10)", "#t"},
+		{"(odd? (- 7))", "#t"},
+		{"(abs (- 3))", 3.0},
+		{"(even? 30000)", "#t"},
+		{"(odd? 30001)", "#t"},
+		{"(with-handlers ([exn:fail:contract? exn-message]) (even? 1.5))", "even?: contract violation; expected: integer?; given: 1.5"},
+		{"(max 2 9)", 9.0},
+		{"(min 2 9)", 2.0},
+		{"(max 1 2 3)", 3.0},
+		{"(min 4 (- 1) 2)", -1.0},
+		{"(max 7)", 7.0},
+		{"(with-handlers ([exn:fail:contract? exn-message]) (min 1 #t))", "min: contract violation; expected: number?; given: #t"},
+		{"(square 5)", 25.0},
+		{"(second (list 1 2 3))", 2.0},
+		{"(third (list 1 2 3))", 3.0},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			env, err := NewEnvironment(WithStandardPrelude(), WithOutput(&bytes.Buffer{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := evalLines(env, tt.a)
+			if err != nil || got != tt.want {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvironmentOutput(t *testing.T) {
+	var tests = []struct {
+		a    string
+		want string
+	}{
+		{`(display "hi")`, "hi"},
+		{`(displayln (list 1 "a"))`, "(1 a)\n"},
+		{`(write "hi")`, `"hi"`},
+		{`(newline)`, "\n"},
+		{`(printf "~a and ~s~n" "x" "y")`, "x and \"y\"\n"},
+		{`(printf "100~~")`, "100~"},
+		{`(display (list 3.0 (* 2 1.5) 0.5 (/ 1 2)))`, "(3.0 3.0 0.5 0.5)"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			var out bytes.Buffer
+			env, err := NewEnvironment(WithOutput(&out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := evalLines(env, tt.a); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvironmentPrintfErrors(t *testing.T) {
+	env, err := NewEnvironment(WithOutput(&bytes.Buffer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{`(printf "~a")`, `(printf "x" 1)`, `(printf "~q" 1)`, `(printf 1)`} {
+		if _, err := evalLines(env, line); err == nil {
+			t.Errorf("%s: expected an error", line)
+		}
+	}
+}
+
+func TestSandboxEnvironment(t *testing.T) {
+	env, err := NewSandboxEnvironment(WithStandardPrelude())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := evalLines(env, "(add1 1)"); got != 2.0 || err != nil {
+		t.Errorf("got %v %v, want 2", got, err)
+	}
+	for _, name := range []string{"display", "displayln", "write", "newline", "printf"} {
+		if _, err := evalLines(env, fmt.Sprintf(`(%s "x")`, name)); err == nil || err.Error() != name+" undefined" {
+			t.Errorf("%s: got %v, want %s undefined", name, err, name)
+		}
+	}
+}
+
+func TestWithPrelude(t *testing.T) {
+	env, err := NewSandboxEnvironment(WithPrelude("(define x 2)"), WithPrelude("(define (twice n) (* n x))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := evalLines(env, "(twice 4)"); got != 8.0 || err != nil {
+		t.Errorf("got %v %v, want 8", got, err)
+	}
+	if _, err := NewSandboxEnvironment(WithPrelude("{")); err == nil {
+		t.Errorf("expected a parse error from a bad prelude")
+	}
+	if _, err := NewSandboxEnvironment(WithPrelude("(nope 1)")); err == nil {
+		t.Errorf("expected an error from a failing prelude")
+	}
+}
+
+func TestZeroEnvironmentDefine(t *testing.T) {
+	got, err := evalLines(&Environment{}, "(define x 3)", "(define (f y) (+ x y))", "(f 4)")
+	if err != nil || got != 7.0 {
+		t.Errorf("got %v %v, want 7", got, err)
+	}
+}
+
+func TestConcurrentEvaluation(t *testing.T) {
+	env, err := NewSandboxEnvironment(WithStandardPrelude(),
+		WithPrelude("(define (fact n) (if (< n 1) 1 (* n (fact (sub1 n)))))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		a    string
+		want interface{}
+	}{
+		{"(fact 5)", 120.0},
+		{"(fact 10)", 3628800.0},
+		{"(abs (- (fact 3)))", 6.0},
+		{"(even? (fact 4))", "#t"},
+		{"(with-handlers ([exn:fail? exn-message]) (fact #t))", "<: contract violation; expected: number?; given: #t"},
+	}
+	for i := 0; i < 8; i++ {
+		for _, tt := range tests {
+			tt := tt
+			testname := fmt.Sprintf("%d %s", i, tt.a)
+			t.Run(testname, func(t *testing.T) {
+				t.Parallel()
+				got, err := evalLines(env, tt.a)
+				if err != nil || got != tt.want {
+					t.Errorf("got %v %v, want %v", got, err, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestConcurrentDefinitions(t *testing.T) {
+	env, err := NewSandboxEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("f%d", i)
+			env.DefineBuiltin(fmt.Sprintf("b%d", i), 0, func(args []Value) (Value, error) {
+				return float64(i), nil
+			})
+			src := fmt.Sprintf("(define x%d %d) (define (%s n) (+ n x%d)) (%s (b%d))", i, i, name, i, name, i)
+			prog, err := ParseSource(src)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			session := env.session(nil, []EvalOptions{{Fuel: 1000}})
+			results, err := EvaluateProgram(prog, session)
+			if err != nil || len(results) != 3 || results[2] != float64(2*i) {
+				t.Errorf("%s: got %v %v, want %d", name, results, err, 2*i)
+			}
+			if len(session.CallStack) != 0 || len(session.frames) != 0 {
+				t.Errorf("%s: call stack not unwound: %v %v", name, session.CallStack, session.frames)
+			}
+			env.BuiltinNames()
+		}(i)
+	}
+	wg.Wait()
+	if len(env.variables) != 16 || len(env.functions) != 16 {
+		t.Errorf("got %d variables and %d functions, want 16 of each", len(env.variables), len(env.functions))
+	}
+}
+
+func TestSessionSeesLaterDefinitions(t *testing.T) {
+	env, err := NewSandboxEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := env.session(nil, nil)
+	if _, err := evalLines(session, "x"); err == nil {
+		t.Fatal("x defined before it was")
+	}
+	if _, err := evalLines(env, "(define x 1)", "(define (f) x)"); err != nil {
+		t.Fatal(err)
+	}
+	env.DefineBuiltin("two", 0, func(args []Value) (Value, error) {
+		return 2.0, nil
+	})
+	if got, err := evalLines(session, "(+ (f) (two))"); got != 3.0 || err != nil {
+		t.Errorf("got %v %v, want 3", got, err)
+	}
+	env.Restore(&Snapshot{})
+	if _, err := evalLines(session, "x"); err == nil {
+		t.Error("x still defined after Restore")
+	}
+}
+
+// BenchmarkDefineGlobals defines n globals, each read by the next; the
+// time per global should not grow with n
+func BenchmarkDefineGlobals(b *testing.B) {
+	for _, n := range []int{1000, 2000, 4000, 8000} {
+		var src strings.Builder
+		src.WriteString("(define x0 0)\n")
+		for i := 1; i < n; i++ {
+			fmt.Fprintf(&src, "(define x%d (+ x%d 1))\n", i, i-1)
+		}
+		prog, err := ParseSource(src.String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				env, err := NewSandboxEnvironment()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := EvaluateProgram(prog, env); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*n), "ns/global")
+		})
+	}
+}
+
+func TestFork(t *testing.T) {
+	base, err := NewSandboxEnvironment(WithPrelude("(define x 1) (define (f n) (+ n x))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant1, tenant2 := base.Fork(), base.Fork()
+	if _, err := evalLines(tenant1, "(define x 10)", "(define (g) 1)"); err != nil {
+		t.Fatal(err)
+	}
+	tenant2.DefineBuiltin("h", 0, func(args []Value) (Value, error) { return 2.0, nil })
+	var tests = []struct {
+		name string
+		env  *Environment
+		a    string
+		want interface{}
+	}{
+		{"tenant1", tenant1, "(f 1)", 11.0},
+		{"tenant1", tenant1, "(g)", 1.0},
+		{"tenant2", tenant2, "(f 1)", 2.0},
+		{"tenant2", tenant2, "(h)", 2.0},
+		{"base", base, "(f 1)", 2.0},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s %s", tt.name, tt.a)
+		t.Run(testname, func(t *testing.T) {
+			got, err := evalLines(tt.env, tt.a)
+			if err != nil || got != tt.want {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+	for _, line := range []string{"(g)", "(h)"} {
+		if _, err := evalLines(base, line); err == nil {
+			t.Errorf("%s: a fork's definition leaked into its parent", line)
+		}
+	}
+	if _, err := evalLines(tenant1, "(h)"); err == nil {
+		t.Errorf("(h): a definition leaked between forks")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	env, err := NewSandboxEnvironment(WithPrelude("(define x 1)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := env.Snapshot()
+	if _, err := evalLines(env, "(define x 2)", "(define y 3)", "(define (f) x)"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := evalLines(env, "(+ x y)"); got != 5.0 || err != nil {
+		t.Errorf("before Restore: got %v %v, want 5", got, err)
+	}
+	env.Restore(snap)
+	if got, err := evalLines(env, "x"); got != 1.0 || err != nil {
+		t.Errorf("after Restore: got %v %v, want 1", got, err)
+	}
+	for _, line := range []string{"y", "(f)"} {
+		if _, err := evalLines(env, line); err == nil {
+			t.Errorf("%s: still defined after Restore", line)
+		}
+	}
+	// the snapshot is unaffected by definitions made after restoring it
+	if _, err := evalLines(env, "(define x 4)"); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewSandboxEnvironment()
+	other.Restore(snap)
+	if got, err := evalLines(other, "x"); got != 1.0 || err != nil {
+		t.Errorf("restored into another environment: got %v %v, want 1", got, err)
+	}
+}
+
+func TestConcurrentForks(t *testing.T) {
+	base, err := NewSandboxEnvironment(WithStandardPrelude())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fork := base.Fork()
+			got, err := evalLines(fork, fmt.Sprintf("(define n %d)", i), "(define (add1 m) (+ m n))", "(add1 1)")
+			if err != nil || got != float64(i+1) {
+				t.Errorf("fork %d: got %v %v, want %d", i, got, err, i+1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got, err := evalLines(base, "(add1 1)"); got != 2.0 || err != nil {
+		t.Errorf("base: got %v %v, want 2", got, err)
+	}
+}
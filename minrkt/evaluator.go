@@ -1,13 +1,289 @@
 package minrkt
 
-func Evaluator(root Exp, env *Environment) (interface{}, error) {
-	var result interface{}
-	var err error
-	result, err = root.Eval(env)
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxDepth is the call depth allowed when EvalOptions.MaxDepth is 0.
+// It keeps runaway recursion well clear of the Go stack limit.
+const DefaultMaxDepth = 10000
+
+// EvalOptions bounds the resources one evaluation may use
+type EvalOptions struct {
+	MaxDepth int           // maximum nested function calls, 0 for DefaultMaxDepth
+	Fuel     int64         // maximum Exp.Eval steps, 0 for no limit
+	Timeout  time.Duration // maximum wall-clock time, 0 for no limit
+}
+
+// DepthLimitError is returned when a call would nest deeper than MaxDepth
+type DepthLimitError struct {
+	MaxDepth int
+}
+
+func (e *DepthLimitError) Error() string {
+	return fmt.Sprintf("recursion depth limit of %d exceeded", e.MaxDepth)
+}
+
+// FuelExhaustedError is returned when evaluation takes more than Fuel steps
+type FuelExhaustedError struct {
+	Fuel int64
+}
+
+func (e *FuelExhaustedError) Error() string {
+	return fmt.Sprintf("evaluation fuel of %d steps exhausted", e.Fuel)
+}
+
+// TimeoutError is returned when evaluation runs longer than Timeout
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("evaluation timed out after %v", e.Timeout)
+}
+
+// CanceledError is returned when the context of EvaluateContext is done
+// before evaluation finishes. It wraps ctx.Err().
+type CanceledError struct {
+	Err error
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("evaluation canceled: %v", e.Err)
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// isLimitError reports whether err stopped an evaluation because of its
+// EvalOptions or context. Scripts can never catch these.
+func isLimitError(err error) bool {
+	var depthErr *DepthLimitError
+	var fuelErr *FuelExhaustedError
+	var timeoutErr *TimeoutError
+	var cancelErr *CanceledError
+	return errors.As(err, &depthErr) || errors.As(err, &fuelErr) ||
+		errors.As(err, &timeoutErr) || errors.As(err, &cancelErr)
+}
+
+// how many steps pass between checks of the wall clock
+const clockInterval = 1024
+
+type evalLimits struct {
+	opts     EvalOptions
+	steps    int64
+	deadline time.Time
+	ctx      context.Context
+	// the limits of the evaluation this one was started inside of, which
+	// still apply to it, and that evaluation's call depth at the time
+	outer      *evalLimits
+	outerDepth int
+}
+
+// step charges one Exp.Eval against the fuel and time budget of the
+// evaluation and of those it is nested in
+func (env *Environment) step() error {
+	if env == nil {
+		return nil
+	}
+	for l := env.limits; l != nil; l = l.outer {
+		l.steps++
+		if l.opts.Fuel > 0 && l.steps > l.opts.Fuel {
+			return &FuelExhaustedError{l.opts.Fuel}
+		}
+		if l.opts.Timeout > 0 && l.steps%clockInterval == 0 && time.Now().After(l.deadline) {
+			return &TimeoutError{l.opts.Timeout}
+		}
+	}
+	return nil
+}
+
+// enterCall checks that one more call fits within the depth limit
+func (env *Environment) enterCall() error {
+	return env.limits.enter(len(env.CallStack))
+}
+
+// enter checks that one more call, made depth calls deep into the
+// evaluation l limits, fits within l and the limits it is nested in
+func (l *evalLimits) enter(depth int) error {
+	for outer := l; outer != nil; depth, outer = depth+outer.outerDepth, outer.outer {
+		if maxDepth := outer.opts.MaxDepth; depth >= maxDepth {
+			return &DepthLimitError{maxDepth}
+		}
+		if outer.opts.Timeout > 0 && time.Now().After(outer.deadline) {
+			return &TimeoutError{outer.opts.Timeout}
+		}
+	}
+	return l.checkContext()
+}
+
+// checkContext reports whether the context of the evaluation, or of one
+// it is nested in, is done. Function calls are the only back-edges in
+// MiniRacket, so checking at every call bounds the work done after
+// cancellation.
+func (l *evalLimits) checkContext() error {
+	for ; l != nil; l = l.outer {
+		if l.ctx == nil {
+			continue
+		}
+		select {
+		case <-l.ctx.Done():
+			return &CanceledError{l.ctx.Err()}
+		default:
+		}
+	}
+	return nil
+}
+
+// session returns the Environment an evaluation runs in: env itself when
+// it is already a session and no new limits were given, otherwise a new
+// session sharing env's definitions with its own call stack and limits.
+// A session started inside another stays within the other's limits too.
+func (env *Environment) session(ctx context.Context, opts []EvalOptions) *Environment {
+	if env.limits != nil && len(opts) == 0 && ctx == nil {
+		return env
+	}
+	l := evalLimits{ctx: ctx, outer: env.limits, outerDepth: len(env.CallStack)}
+	if len(opts) > 0 {
+		l.opts = opts[0]
+	}
+	if l.opts.MaxDepth <= 0 {
+		l.opts.MaxDepth = DefaultMaxDepth
+	}
+	if l.opts.Timeout > 0 {
+		l.deadline = time.Now().Add(l.opts.Timeout)
+	}
+	return &Environment{
+		CallStack: make([]map[string]interface{}, 0),
+		limits:    &l,
+		positions: env.positions,
+		root:      env.globals(),
+	}
+}
+
+// Evaluator evaluates root in env. At most one EvalOptions may be given;
+// without one the evaluation only has the default depth limit.
+func Evaluator(root Exp, env *Environment, opts ...EvalOptions) (interface{}, error) {
+	return evaluate(root, env.session(nil, opts))
+}
+
+// EvaluateContext is Evaluator for evaluations that should stop when ctx
+// is canceled or its deadline passes
+func EvaluateContext(ctx context.Context, root Exp, env *Environment, opts ...EvalOptions) (interface{}, error) {
+	env = env.session(ctx, opts)
+	if err := env.limits.checkContext(); err != nil {
+		return nil, err
+	}
+	return evaluate(root, env)
+}
+
+func evaluate(root Exp, env *Environment) (interface{}, error) {
+	result, err := root.Eval(env)
+	return topLevelValue(result), err
+}
+
+// topLevelValue is how Evaluator returns the value of a whole form:
+// booleans and the non-finite numbers become the strings Racket prints,
+// and every other number, at any depth, a float64 whether it is exact or
+// not
+func topLevelValue(result interface{}) interface{} {
 	if result == true {
 		result = "#t"
 	} else if result == false {
 		result = "#f"
+	} else if num, ok := toFloat(result); ok && (math.IsInf(num, 0) || math.IsNaN(num)) {
+		result = FormatValue(result)
+	}
+	return hostValue(result)
+}
+
+// FormatValue renders a value the way the Racket REPL prints it, except
+// that strings are printed without quotes
+func FormatValue(v interface{}) string {
+	if str, ok := v.(string); ok {
+		return str
+	}
+	return showValue(v)
+}
+
+// showValue renders a value inside an error message or context listing
+func showValue(v interface{}) string {
+	switch v.(type) {
+	case []Value, map[string]Value, Symbol:
+		return "'" + writeValue(v)
+	}
+	return writeValue(v)
+}
+
+// writeValue renders a value as it appears inside a quoted list
+func writeValue(v interface{}) string {
+	switch val := v.(type) {
+	case bool:
+		if val {
+			return "#t"
+		}
+		return "#f"
+	case float64:
+		if math.IsInf(val, 1) {
+			return "+inf.0"
+		} else if math.IsInf(val, -1) {
+			return "-inf.0"
+		} else if math.IsNaN(val) {
+			return "+nan.0"
+		}
+	case inexact:
+		// Racket prints an inexact integer as 3.0
+		str := writeValue(float64(val))
+		if !strings.ContainsAny(str, ".e") {
+			str += ".0"
+		}
+		return str
+	case string:
+		return strconv.Quote(val)
+	case []Value:
+		var elems []string
+		for _, elem := range val {
+			elems = append(elems, writeValue(elem))
+		}
+		return "(" + strings.Join(elems, " ") + ")"
+	case map[string]Value:
+		var keys []string
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var pairs []string
+		for _, key := range keys {
+			pairs = append(pairs, "("+strconv.Quote(key)+" . "+writeValue(val[key])+")")
+		}
+		return "#hash(" + strings.Join(pairs, " ") + ")"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// EvaluateProgram evaluates the forms of prog in order, stopping at the
+// first error, and returns the result of each form it evaluated. The
+// limits in opts apply to the program as a whole.
+func EvaluateProgram(prog *Program, env *Environment, opts ...EvalOptions) ([]interface{}, error) {
+	env = env.session(nil, opts)
+	outer := env.positions
+	env.positions = prog.Positions
+	defer func() { env.positions = outer }()
+	var results []interface{}
+	for _, form := range prog.Forms {
+		result, err := Evaluator(form, env)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
 	}
-	return result, err
+	return results, nil
 }
@@ -1,8 +1,13 @@
 package minrkt
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestEvaluator(t *testing.T) {
@@ -126,3 +131,447 @@ func TestEvaluator(t *testing.T) {
 		})
 	}
 }
+
+func TestEvaluatorInexactResults(t *testing.T) {
+	var tests = []struct {
+		a     string
+		want  interface{}
+		wantS string
+	}{
+		{"3.0", 3.0, "3"},
+		{"(list 3.0)", []Value{3.0}, "'(3)"},
+		{"(list 1 (list 1.5 (hash \"a\" 2.0)))", []Value{1.0, []Value{1.5, map[string]Value{"a": 2.0}}}, `'(1 (1.5 #hash(("a" . 2))))`},
+		{"(list +inf.0)", []Value{math.Inf(1)}, "'(+inf.0)"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			got, err := evalLines(newTestEnv(), tt.a)
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v %v, want %#v", got, err, tt.want)
+			}
+			if s := FormatValue(got); s != tt.wantS {
+				t.Errorf("printed %q, want %q", s, tt.wantS)
+			}
+		})
+	}
+}
+
+func TestEvaluatorNumericEdgeCases(t *testing.T) {
+	var tests = []struct {
+		a       string
+		want    interface{}
+		wantErr string
+	}{
+		{"(/ 5)", 0.2, ""},
+		{"(/ 0.5)", 2.0, ""},
+		{"(/ 10 4)", 2.5, ""},
+		{"(/ 5 0)", nil, "/: division by zero"},
+		{"(/ 0)", nil, "/: division by zero"},
+		{"(/ 5 (- 2 2))", nil, "/: division by zero"},
+		{"(/ +inf.0 0)", nil, "/: division by zero"},
+		{"(/ 5.0 0)", nil, "/: division by zero"},
+		{"(/ 5 0.0)", "+inf.0", ""},
+		{"(/ (- 5) 0.0)", "-inf.0", ""},
+		{"(/ 0.0)", "+inf.0", ""},
+		{"(/ 0.0 0.0)", "+nan.0", ""},
+		{"(/ 5 (- 1.5 1.5))", "+inf.0", ""},
+		{"(/ 5 (max 0 0.0))", "+inf.0", ""},
+		{"(= 1 1.0)", "#t", ""},
+		{"(* 05 2)", 10.0, ""},
+		{"(+ 007 0.50)", 7.5, ""},
+		{"(+ 1 2.5)", 3.5, ""},
+		{"(/)", nil, "/: arity mismatch; expected at least 1, given 0"},
+		{"(/ 1 +inf.0)", 0.0, ""},
+		{"+inf.0", "+inf.0", ""},
+		{"-inf.0", "-inf.0", ""},
+		{"+nan.0", "+nan.0", ""},
+		{"(* 2 +inf.0)", "+inf.0", ""},
+		{"(- +inf.0)", "-inf.0", ""},
+		{"(+ +inf.0 -inf.0)", "+nan.0", ""},
+		{"(= +nan.0 +nan.0)", "#f", ""},
+		{"(< 1 +inf.0)", "#t", ""},
+		{"(with-handlers ([exn:fail:contract:divide-by-zero? exn-message]) (/ 1 0))", "/: division by zero", ""},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			got, err := evalLines(newTestEnv(), tt.a)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("got %v %v, want error %s", got, err, tt.wantErr)
+				}
+			} else if err != nil || got != tt.want {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluatorStopsAtFirstError(t *testing.T) {
+	var tests = []struct {
+		a       string
+		wantErr string
+	}{
+		{"(+ (nope 1) (/ 1 0))", "nope undefined"},
+		{"(+ 1 #t (nope 1))", "+: contract violation; expected: number?; given: #t"},
+		{"(* (/ 1 0) #f)", "/: division by zero"},
+		{"(- 5 (nope) #t)", "nope undefined"},
+		{"(= x (/ 1 0))", "x undefined"},
+		{"(< (/ 1 0) y)", "/: division by zero"},
+		{"(> 1 y)", "y undefined"},
+		{"(or #f (nope))", "nope undefined"},
+		{"(if (nope) 1 2)", "nope undefined"},
+		{"(define z (nope))", "nope undefined"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			_, err := evalLines(newTestEnv(), tt.a)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEvaluatorShortCircuit(t *testing.T) {
+	var tests = []struct {
+		a    string
+		want interface{}
+	}{
+		{"(and #f (/ 1 0))", "#f"},
+		{"(or #t (nope))", "#t"},
+		{"(if #t 1 (nope))", 1.0},
+		{"(if #f (nope) 2)", 2.0},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			got, err := evalLines(newTestEnv(), tt.a)
+			if err != nil || got != tt.want {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluatorErrorBreadcrumb(t *testing.T) {
+	env := newTestEnv()
+	_, err := evalLines(env, "(define (f x) (+ x #t))", "(* 2 (f 1))")
+	var formErr *FormError
+	if !errors.As(err, &formErr) {
+		t.Fatalf("got %T %v, want *FormError", err, err)
+	}
+	wantForms := []string{"(+ x #t)", "(f 1)", "(* 2 (f 1))"}
+	if !reflect.DeepEqual(formErr.Forms(), wantForms) {
+		t.Errorf("got forms %v, want %v", formErr.Forms(), wantForms)
+	}
+	var evalErr *EvalError
+	if !errors.As(err, &evalErr) {
+		t.Errorf("cause %v is not an *EvalError", err)
+	}
+	want := "+: contract violation; expected: number?; given: #t\n  in: (+ x #t)\n  in: (f 1)\n  in: (* 2 (f 1))\n  context...:\n   (f 1)"
+	if got := fmt.Sprintf("%+v", err); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := fmt.Sprintf("%v", err); got != evalErr.Error() {
+		t.Errorf("got %q, want %q", got, evalErr.Error())
+	}
+}
+
+// hostExp is an Exp defined outside of the parser, without a String method
+type hostExp struct{}
+
+func (hostExp) Eval(env *Environment) (interface{}, error) {
+	return nil, errors.New("host failure")
+}
+
+func TestFormErrorWrapping(t *testing.T) {
+	inner := inForm(errors.New("boom"), &expVar{"x"})
+	outer := inForm(withContext(inner, []Frame{{Name: "f"}}), hostExp{})
+	if got := inner.(*FormError).Forms(); !reflect.DeepEqual(got, []string{"x"}) {
+		t.Errorf("wrapping changed the inner error's forms to %v", got)
+	}
+	if got := inner.(*FormError).Context(); got != nil {
+		t.Errorf("wrapping changed the inner error's context to %v", got)
+	}
+	if got, want := outer.(*FormError).Forms(), []string{"x", "#<minrkt.hostExp>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got forms %v, want %v", got, want)
+	}
+	if got := outer.(*FormError).Context(); len(got) != 1 {
+		t.Errorf("got context %v, want one frame", got)
+	}
+}
+
+func TestEvaluateProgramContext(t *testing.T) {
+	prog, err := ParseSource(`(define (inner x) (+ x #t))
+(define (outer y)
+  (inner y))
+(define (safe z) (with-handlers ([exn:fail? exn-message]) (outer z)))
+(safe 1)
+(outer 5)`)
+	if err != nil {
+		t.Fatalf("ParseSource(): %v", err)
+	}
+	session := newTestEnv().session(nil, nil)
+	results, err := EvaluateProgram(prog, session)
+	if len(results) != 4 || results[3] != "+: contract violation; expected: number?; given: #t" {
+		t.Errorf("got results %v", results)
+	}
+	var formErr *FormError
+	if !errors.As(err, &formErr) {
+		t.Fatalf("got %T %v, want *FormError", err, err)
+	}
+	wantContext := []Frame{
+		{"inner", Pos{3, 3}, []interface{}{5.0}},
+		{"outer", Pos{6, 1}, []interface{}{5.0}},
+	}
+	if !reflect.DeepEqual(formErr.Context(), wantContext) {
+		t.Errorf("got context %v, want %v", formErr.Context(), wantContext)
+	}
+	if len(session.CallStack) != 0 || len(session.frames) != 0 {
+		t.Errorf("call stack not unwound: %v %v", session.CallStack, session.frames)
+	}
+	want := "+: contract violation; expected: number?; given: #t\n" +
+		"  in: (+ x #t)\n  in: (inner y)\n  in: (outer 5)\n" +
+		"  context...:\n   (inner 5) at 3:3\n   (outer 5) at 6:1"
+	if got := fmt.Sprintf("%+v", err); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestContextAcrossPrograms(t *testing.T) {
+	env := newTestEnv()
+	defs := "(define (inner x) (+ x #t))\n(define (outer y)\n  (inner y))"
+	for _, src := range []string{defs, defs} {
+		prog, err := ParseSource(src)
+		if err != nil {
+			t.Fatalf("ParseSource(): %v", err)
+		}
+		if _, err := EvaluateProgram(prog, env); err != nil {
+			t.Fatalf("EvaluateProgram(): %v", err)
+		}
+	}
+	// only the positions of the current definitions are kept
+	if len(env.sources) != len(env.functions) {
+		t.Errorf("got positions for %d bodies, want %d", len(env.sources), len(env.functions))
+	}
+	prog, err := ParseSource("\n(outer 5)")
+	if err != nil {
+		t.Fatalf("ParseSource(): %v", err)
+	}
+	_, err = EvaluateProgram(prog, env)
+	var formErr *FormError
+	if !errors.As(err, &formErr) {
+		t.Fatalf("got %T %v, want *FormError", err, err)
+	}
+	wantContext := []Frame{
+		{"inner", Pos{3, 3}, []interface{}{5.0}},
+		{"outer", Pos{2, 1}, []interface{}{5.0}},
+	}
+	if !reflect.DeepEqual(formErr.Context(), wantContext) {
+		t.Errorf("got context %v, want %v", formErr.Context(), wantContext)
+	}
+}
+
+func TestEvaluatorLimits(t *testing.T) {
+	defs := `(define (loop n) (loop (+ n 1)))
+(define (always v) #t)
+(define (fib n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))
+(define (misuse n) (loop))`
+	var tests = []struct {
+		a       string
+		opts    EvalOptions
+		wantErr error
+	}{
+		{"(loop 1)", EvalOptions{}, &DepthLimitError{DefaultMaxDepth}},
+		{"(loop 1)", EvalOptions{MaxDepth: 50}, &DepthLimitError{50}},
+		{"(with-handlers ([always always]) (loop 1))", EvalOptions{MaxDepth: 50}, &DepthLimitError{50}},
+		{"(fib 10)", EvalOptions{MaxDepth: 10}, nil},
+		{"(fib 10)", EvalOptions{MaxDepth: 9}, &DepthLimitError{9}},
+		// a call with the wrong number of arguments fails before it counts
+		{"(misuse 1)", EvalOptions{MaxDepth: 1}, arityError("loop", "1", 0)},
+		{"(+ 1 2)", EvalOptions{Fuel: 3}, nil},
+		{"(+ 1 2)", EvalOptions{Fuel: 2}, &FuelExhaustedError{2}},
+		{"(fib 15)", EvalOptions{Fuel: 1000}, &FuelExhaustedError{1000}},
+		{"(with-handlers ([always always]) (fib 15))", EvalOptions{Fuel: 1000}, &FuelExhaustedError{1000}},
+		{"(fib 50)", EvalOptions{Timeout: 20 * time.Millisecond}, &TimeoutError{20 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s %+v", tt.a, tt.opts)
+		t.Run(testname, func(t *testing.T) {
+			env := newTestEnv()
+			prog, err := ParseSource(defs)
+			if err != nil {
+				t.Fatalf("ParseSource(): %v", err)
+			}
+			if _, err := EvaluateProgram(prog, env); err != nil {
+				t.Fatalf("EvaluateProgram(): %v", err)
+			}
+			_, exp, _ := Parser(mustTokenize(t, tt.a))
+			session := env.session(nil, []EvalOptions{tt.opts})
+			_, err = Evaluator(exp, session)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("got %v, want no error", err)
+				}
+			} else {
+				target := reflect.New(reflect.TypeOf(tt.wantErr))
+				if !errors.As(err, target.Interface()) || !reflect.DeepEqual(target.Elem().Interface(), tt.wantErr) {
+					t.Errorf("got %v, want %v", err, tt.wantErr)
+				}
+			}
+			if len(session.CallStack) != 0 || len(session.frames) != 0 {
+				t.Errorf("evaluation state left behind: %v %v", session.CallStack, session.frames)
+			}
+		})
+	}
+}
+
+func TestNestedEvaluationLimits(t *testing.T) {
+	env := newTestEnv()
+	if _, err := evalLines(env, "(define (fib n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))"); err != nil {
+		t.Fatalf("evalLines(): %v", err)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	var tests = []struct {
+		ctx          context.Context
+		outer, inner EvalOptions
+		outerDepth   int // calls the outer evaluation is in when it nests
+		a            string
+		wantErr      interface{}
+	}{
+		{nil, EvalOptions{Fuel: 100}, EvalOptions{Fuel: 1000000}, 0, "(fib 15)", &FuelExhaustedError{100}},
+		{nil, EvalOptions{Fuel: 1000000}, EvalOptions{Fuel: 50}, 0, "(fib 15)", &FuelExhaustedError{50}},
+		{nil, EvalOptions{MaxDepth: 20}, EvalOptions{MaxDepth: 1000}, 15, "(fib 10)", &DepthLimitError{20}},
+		{nil, EvalOptions{MaxDepth: 20}, EvalOptions{MaxDepth: 1000}, 5, "(fib 10)", nil},
+		{nil, EvalOptions{MaxDepth: 1000}, EvalOptions{MaxDepth: 5}, 0, "(fib 10)", &DepthLimitError{5}},
+		{nil, EvalOptions{Timeout: 20 * time.Millisecond}, EvalOptions{Fuel: 1 << 40}, 0, "(fib 50)", &TimeoutError{20 * time.Millisecond}},
+		{canceled, EvalOptions{}, EvalOptions{Fuel: 1 << 40}, 0, "(fib 50)", &CanceledError{context.Canceled}},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s %+v in %+v", tt.a, tt.inner, tt.outer)
+		t.Run(testname, func(t *testing.T) {
+			outer := env.session(tt.ctx, []EvalOptions{tt.outer})
+			for i := 0; i < tt.outerDepth; i++ {
+				outer.CallStack = append(outer.CallStack, nil)
+			}
+			_, exp, _ := Parser(mustTokenize(t, tt.a))
+			_, err := Evaluator(exp, outer, tt.inner)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("got %v, want no error", err)
+				}
+				return
+			}
+			target := reflect.New(reflect.TypeOf(tt.wantErr))
+			if !errors.As(err, target.Interface()) || !reflect.DeepEqual(target.Elem().Interface(), tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	// the steps of the nested evaluation count against the outer one
+	outer := env.session(nil, []EvalOptions{{Fuel: 1000}})
+	_, exp, _ := Parser(mustTokenize(t, "(fib 5)"))
+	if _, err := Evaluator(exp, outer, EvalOptions{Fuel: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if outer.limits.steps == 0 {
+		t.Errorf("nested steps were not charged to the outer evaluation")
+	}
+}
+
+func mustTokenize(t *testing.T, line string) []Token {
+	tokens, err := Tokenizer(line)
+	if err != nil {
+		t.Fatalf("Tokenizer(%q): %v", line, err)
+	}
+	return tokens
+}
+
+func TestEvaluateContext(t *testing.T) {
+	env := newTestEnv()
+	// spin never returns in practice, but stays within the depth limit
+	_, err := evalLines(env,
+		"(define (spin n) (if (= n 0) 0 (+ (spin (- n 1)) (spin (- n 1)))))",
+		"(define (fib n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))")
+	if err != nil {
+		t.Fatalf("evalLines(): %v", err)
+	}
+	canceled := func() (context.Context, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx, cancel
+	}
+	cancelDuring := func() (context.Context, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		return ctx, cancel
+	}
+	expired := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), 20*time.Millisecond)
+	}
+	var tests = []struct {
+		a    string
+		ctx  func() (context.Context, context.CancelFunc)
+		want error
+	}{
+		{"(spin 1000)", cancelDuring, context.Canceled},
+		{"(+ 1 2)", canceled, context.Canceled},
+		{"(fib 100)", expired, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			_, exp, _ := Parser(mustTokenize(t, tt.a))
+			_, err := EvaluateContext(ctx, exp, env)
+			var cancelErr *CanceledError
+			if !errors.As(err, &cancelErr) || !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateContextCancelRecursion(t *testing.T) {
+	env := newTestEnv()
+	_, err := evalLines(env, "(define (fib n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))")
+	if err != nil {
+		t.Fatalf("evalLines(): %v", err)
+	}
+	_, exp, _ := Parser(mustTokenize(t, "(fib 100)"))
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	session := env.session(ctx, nil)
+	_, err = Evaluator(exp, session)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if len(session.CallStack) != 0 || len(session.frames) != 0 {
+		t.Errorf("evaluation state left behind: %v %v", session.CallStack, session.frames)
+	}
+	if got, err := evalLines(env, "(fib 10)"); got != 55.0 || err != nil {
+		t.Errorf("env unusable after cancel: got %v %v", got, err)
+	}
+}
+
+func TestDepthLimitErrorCollapsesRepeats(t *testing.T) {
+	prog, err := ParseSource("(define (loop n) (loop n))\n(loop 1)")
+	if err != nil {
+		t.Fatalf("ParseSource(): %v", err)
+	}
+	_, err = EvaluateProgram(prog, newTestEnv().session(nil, []EvalOptions{{MaxDepth: 100}}))
+	want := "recursion depth limit of 100 exceeded\n" +
+		"  in: (loop n) (repeated 16 times)\n" +
+		"  context...:\n   (loop 1) at 1:18 (repeated 32 times)"
+	if got := fmt.Sprintf("%+v", err); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,197 @@
+package minrkt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// exception kinds, from most to least general
+const (
+	EXN                = "exn"
+	EXN_FAIL           = "exn:fail"
+	EXN_CONTRACT       = "exn:fail:contract"
+	EXN_DIVIDE_BY_ZERO = "exn:fail:contract:divide-by-zero"
+	EXN_VARIABLE       = "exn:fail:contract:variable"
+	EXN_ARITY          = "exn:fail:contract:arity"
+)
+
+// Exn is the exception struct value created by error and by the
+// evaluator when a built-in operation fails
+type Exn struct {
+	kind    string
+	message string
+}
+
+func (e *Exn) String() string {
+	return fmt.Sprintf("#<%s>", e.kind)
+}
+
+// isA reports whether the exception is kind or one of its subtypes
+func (e *Exn) isA(kind string) bool {
+	return e.kind == kind || strings.HasPrefix(e.kind, kind+":")
+}
+
+// RaiseError carries a value passed to raise up through Eval
+type RaiseError struct {
+	val interface{}
+}
+
+func (e *RaiseError) Error() string {
+	if exn, ok := e.val.(*Exn); ok {
+		return exn.message
+	}
+	return "uncaught exception: " + showValue(e.val)
+}
+
+// UndefinedError is returned when a variable or function is referenced
+// before its definition
+type UndefinedError struct {
+	name string
+}
+
+func (e *UndefinedError) Error() string {
+	return e.name + " undefined"
+}
+
+func newExnError(kind, message string) error {
+	return &RaiseError{&Exn{kind, message}}
+}
+
+func arityError(name string, expected string, given int) error {
+	return newExnError(EXN_ARITY, fmt.Sprintf("%s: arity mismatch; expected %s, given %d", name, expected, given))
+}
+
+// exnValue maps an error returned by Eval onto the value a handler
+// receives. Errors that are not evaluation failures are not catchable,
+// nor are limit errors, even when a module error wraps them.
+func exnValue(err error) (interface{}, bool) {
+	if isLimitError(err) {
+		return nil, false
+	}
+	var raiseErr *RaiseError
+	var undefinedErr *UndefinedError
+	var evalErr *EvalError
+	var parseErr *ParseError
+	var argErr *ArgumentError
+	var hostErr *HostError
+	var convErr *ConversionError
+	var moduleErr *ModuleError
+	var cycleErr *CycleError
+	switch {
+	case errors.As(err, &raiseErr):
+		return raiseErr.val, true
+	case errors.As(err, &undefinedErr):
+		return &Exn{EXN_VARIABLE, undefinedErr.Error()}, true
+	case errors.As(err, &evalErr), errors.As(err, &parseErr):
+		return &Exn{EXN_CONTRACT, err.Error()}, true
+	case errors.As(err, &argErr):
+		return &Exn{EXN_ARITY, argErr.Error()}, true
+	case errors.As(err, &convErr):
+		return &Exn{EXN_CONTRACT, convErr.Error()}, true
+	case errors.As(err, &hostErr):
+		return &Exn{EXN_FAIL, hostErr.Error()}, true
+	case errors.As(err, &moduleErr), errors.As(err, &cycleErr):
+		return &Exn{EXN_FAIL, err.Error()}, true
+	}
+	return nil, false
+}
+
+type handlerClause struct {
+	predicate string
+	handler   string
+}
+
+type expWithHandlers struct {
+	clauses []handlerClause
+	body    Exp
+}
+
+func (e *expWithHandlers) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	depth, frameDepth := len(env.CallStack), len(env.frames)
+	result, err := e.body.Eval(env)
+	if err == nil {
+		return result, nil
+	}
+	val, ok := exnValue(err)
+	if !ok {
+		return nil, err
+	}
+	// unwind any frames the failing body left behind
+	env.CallStack = env.CallStack[:depth]
+	env.frames = env.frames[:frameDepth]
+	for _, clause := range e.clauses {
+		matched, predErr := applyProc(env, e, clause.predicate, []interface{}{val})
+		if predErr != nil {
+			return nil, predErr
+		}
+		if matched != false {
+			return applyProc(env, e, clause.handler, []interface{}{val})
+		}
+	}
+	return nil, err
+}
+
+// parses the remainder of (with-handlers ([pred handler] ...) body)
+// after the with-handlers keyword
+func (p *parser) parseWithHandlers(tokens []Token) ([]Token, Exp, error) {
+	var exp Exp
+	if len(tokens) == 0 || !isLeftParenthesis(tokens[0]) {
+		return []Token{}, exp, &ParseError{"with-handlers requires a list of handlers"}
+	}
+	leftOver := tokens[1:]
+	var clauses []handlerClause
+	for len(leftOver) > 0 && leftOver[0].tokType != TOK_RPAREN {
+		if len(leftOver) < 4 || !isLeftParenthesis(leftOver[0]) ||
+			!isIdentifier(leftOver[1]) || !isIdentifier(leftOver[2]) ||
+			leftOver[3].tokType != TOK_RPAREN {
+			return []Token{}, exp, &ParseError{"invalid with-handlers clause"}
+		}
+		clauses = append(clauses, handlerClause{leftOver[1].val, leftOver[2].val})
+		leftOver = leftOver[4:]
+	}
+	if len(leftOver) == 0 {
+		return []Token{}, exp, &ParseError{"missing closing )"}
+	}
+	leftOver, body, err := p.parse(leftOver[1:])
+	if err != nil {
+		return []Token{}, exp, err
+	}
+	if len(leftOver) == 0 || leftOver[0].tokType != TOK_RPAREN {
+		return []Token{}, exp, &ParseError{"missing closing )"}
+	}
+	return leftOver[1:], &expWithHandlers{clauses, body}, nil
+}
+
+func init() {
+	defineStandard("raise", funcType(tAny, tAny), func(args []Value) (Value, error) {
+		return nil, &RaiseError{args[0]}
+	})
+	defineStandard("error", restType(tAny, tAny, tString), func(args []Value) (Value, error) {
+		msg, ok := args[0].(string)
+		if !ok {
+			return nil, &EvalError{"error: contract violation; expected string"}
+		}
+		for _, arg := range args[1:] {
+			msg += " " + showValue(arg)
+		}
+		return nil, newExnError(EXN_FAIL, msg)
+	})
+	defineStandard("exn-message", funcType(tString, tAny), func(args []Value) (Value, error) {
+		exn, ok := args[0].(*Exn)
+		if !ok {
+			return nil, &EvalError{"exn-message: contract violation; expected exn?"}
+		}
+		return exn.message, nil
+	})
+	for _, kind := range []string{EXN, EXN_FAIL, EXN_CONTRACT, EXN_DIVIDE_BY_ZERO, EXN_VARIABLE, EXN_ARITY} {
+		kind := kind
+		defineStandard(kind+"?", funcType(tBoolean, tAny), func(args []Value) (Value, error) {
+			exn, ok := args[0].(*Exn)
+			return ok && exn.isA(kind), nil
+		})
+	}
+}
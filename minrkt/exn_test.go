@@ -0,0 +1,118 @@
+package minrkt
+
+import (
+	"fmt"
+	"testing"
+)
+
+// evalLines tokenizes, parses and evaluates each line in env,
+// returning the result of the last one
+func evalLines(env *Environment, lines ...string) (interface{}, error) {
+	var result interface{}
+	for _, line := range lines {
+		tokens, err := Tokenizer(line)
+		if err != nil {
+			return nil, err
+		}
+		_, exp, err := Parser(tokens)
+		if err != nil {
+			return nil, err
+		}
+		result, err = Evaluator(exp, env)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func newTestEnv() *Environment {
+	env := &Environment{}
+	env.variables = make(map[string]interface{})
+	env.functions = make(map[string]FuncParamExpr)
+	return env
+}
+
+func TestWithHandlers(t *testing.T) {
+	defs := []string{
+		"(define (msg e) (exn-message e))",
+		"(define (always v) #t)",
+		"(define (zero v) 1)",
+		"(define (fails x) (error \"bad input:\" x))",
+	}
+	var tests = []struct {
+		a    string
+		want interface{}
+	}{
+		{`(with-handlers ([exn:fail? msg]) (error "boom"))`, "boom"},
+		{`(with-handlers ([exn:fail? msg]) (fails 5))`, "bad input: 5"},
+		{`(with-handlers ([exn:fail? msg]) (+ 1 2))`, 3.0},
+		{`(with-handlers ([always zero]) (raise 42))`, 1.0},
+		{`(with-handlers ([exn:fail:contract? zero] [always msg]) (error "first"))`, "first"},
+		{`(with-handlers ([exn:fail:contract:variable? msg]) (nope 1))`, "nope undefined"},
+		{`(with-handlers ([exn:fail:contract:variable? msg]) y)`, "y undefined"},
+		{`(with-handlers ([exn:fail:contract? msg]) (= 1 #t))`, "=: contract violation; expected: number?; given: #t"},
+		{`(with-handlers ([exn:fail:contract:arity? msg]) (msg))`, "msg: arity mismatch; expected 1, given 0"},
+		{`(with-handlers ([exn? msg]) (with-handlers ([exn:fail:contract? zero]) (error "inner")))`, "inner"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			session := newTestEnv().session(nil, nil)
+			got, err := evalLines(session, append(defs, tt.a)...)
+			if err != nil || got != tt.want {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+			if len(session.CallStack) != 0 || len(session.frames) != 0 {
+				t.Errorf("call stack not unwound: %v %v", session.CallStack, session.frames)
+			}
+		})
+	}
+}
+
+func TestUncaughtExceptions(t *testing.T) {
+	var tests = []struct {
+		a       string
+		wantErr string
+	}{
+		{`(raise 5)`, "uncaught exception: 5"},
+		{`(error "oops" 1 #t)`, "oops 1 #t"},
+		{`(with-handlers ([exn:fail:contract? exn-message]) (error "not contract"))`, "not contract"},
+		{`(with-handlers ([exn:fail? exn-message]) (raise 7))`, "uncaught exception: 7"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			_, err := evalLines(newTestEnv(), tt.a)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExnPredicates(t *testing.T) {
+	divByZero := &Exn{EXN_DIVIDE_BY_ZERO, "/: division by zero"}
+	var tests = []struct {
+		pred string
+		a    interface{}
+		want bool
+	}{
+		{"exn?", divByZero, true},
+		{"exn:fail?", divByZero, true},
+		{"exn:fail:contract?", divByZero, true},
+		{"exn:fail:contract:divide-by-zero?", divByZero, true},
+		{"exn:fail:contract:variable?", divByZero, false},
+		{"exn:fail:contract?", &Exn{EXN_FAIL, "plain"}, false},
+		{"exn?", 5.0, false},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s %v", tt.pred, tt.a)
+		t.Run(testname, func(t *testing.T) {
+			got, err := standardBuiltins[tt.pred].call([]Value{tt.a})
+			if err != nil || got != tt.want {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
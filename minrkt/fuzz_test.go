@@ -0,0 +1,116 @@
+package minrkt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fuzzSeeds are inputs from the other tests, the programs in testdata
+// and each of their lines
+var fuzzSeeds = []string{
+	"(+ 1 2)",
+	"(- 10 (* 0.5 50))",
+	"(define x 5)",
+	"(define (f a b) (+ a b))",
+	"(f 1 2)",
+	"(if (< 1 2) \"yes\" \"no\")",
+	"(and #t (or #f (not #f)))",
+	"(/ 1 0)",
+	"+inf.0 -nan.0",
+	"(let ([x 1] [y 2]) (+ x y))",
+	"(with-handlers ([exn:fail? exn-message]) (error \"boom\"))",
+	"(: f (-> Number Number Boolean))",
+	"(define-syntax my-or (syntax-rules () [(_ a b) (let ([t a]) (if t t b))]))\n(my-or #f 1)",
+	"(define-syntax (swap stx) (syntax-case stx () [(_ a b) #'(list b a)]))\n(swap 1 2)",
+	"(list 1 \"a\" #t)",
+	"(check-equal? (+ 1 1) 2)",
+	"(test-case \"t\" (check-exn exn:fail? (/ 1 0)))",
+	"(module m racket (provide f) (define (f x) x))\n(require (prefix-in m: m))",
+	"; comment\n#lang racket\n(displayln \"hi\")",
+	// inputs that used to hang or panic the parser
+	"(+ 1",
+	"(define (f",
+	"(define (",
+	"(+ 1 (1 2))",
+	"(if #t 1",
+	"(-",
+}
+
+func addFuzzSeeds(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	files, _ := filepath.Glob(filepath.Join("testdata", "*.rkt"))
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(src))
+		for _, line := range strings.Split(string(src), "\n") {
+			f.Add(line)
+		}
+	}
+}
+
+func FuzzTokenizer(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, src string) {
+		tokens, positions, err := TokenizeSource(src)
+		if err != nil {
+			return
+		}
+		if len(tokens) != len(positions) {
+			t.Fatalf("%d tokens but %d positions", len(tokens), len(positions))
+		}
+		for i, tok := range tokens {
+			if tok.val == "" {
+				t.Fatalf("empty token %d", i)
+			}
+			if pos := positions[i]; pos.Line < 1 || pos.Col < 1 {
+				t.Fatalf("token %q at invalid position %v", tok.val, pos)
+			}
+		}
+	})
+}
+
+func FuzzParser(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, src string) {
+		prog, err := NewStandardExpander().ParseSource(src)
+		if err == nil {
+			for _, form := range prog.Forms {
+				if form == nil {
+					t.Fatal("nil form without an error")
+				}
+				_ = unparse(form)
+			}
+		}
+		// ParseFile always returns a program, with every error in a SyntaxErrors
+		partial, err := NewStandardExpander().ParseFile(src)
+		if _, ok := err.(SyntaxErrors); err != nil && !ok {
+			t.Fatalf("ParseFile returned %T", err)
+		}
+		for _, form := range partial.Forms {
+			_ = unparse(form)
+		}
+	})
+}
+
+func FuzzEvaluate(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, src string) {
+		prog, err := NewStandardExpander().ParseSource(src)
+		if err != nil {
+			return
+		}
+		env, err := NewSandboxEnvironment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		EvaluateProgram(prog, env, EvalOptions{MaxDepth: 100, Fuel: 10000, Timeout: time.Second})
+	})
+}
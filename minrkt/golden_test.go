@@ -0,0 +1,78 @@
+package minrkt
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// transcript runs the program in file form by form, as the REPL would,
+// and returns everything it printed: output, the value of each form and
+// the errors of the forms that failed
+func transcript(file string) (string, error) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	env, err := NewEnvironment(WithStandardPrelude(), WithOutput(&out), WithDirectory(filepath.Dir(file)))
+	if err != nil {
+		return "", err
+	}
+	prog, err := NewStandardExpander().ParseSource(string(src))
+	if err != nil {
+		fmt.Fprintf(&out, "Parse Error: %v\n", err)
+		return out.String(), nil
+	}
+	for _, form := range prog.Forms {
+		results, err := EvaluateProgram(&Program{[]Exp{form}, prog.Positions}, env, EvalOptions{Fuel: 1000000})
+		for _, result := range results {
+			if result != nil {
+				fmt.Fprintln(&out, FormatValue(result))
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(&out, "%+v\n", err)
+		}
+	}
+	return out.String(), nil
+}
+
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.rkt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no programs in testdata")
+	}
+	for _, file := range files {
+		file := file
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			got, err := transcript(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := strings.TrimSuffix(file, ".rkt") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v; run go test -run TestGolden -update to create it", err)
+			}
+			if got != string(want) {
+				t.Errorf("output differs from %s:\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
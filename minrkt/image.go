@@ -0,0 +1,405 @@
+package minrkt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// ImageVersion is the version of the image format SaveImage writes.
+// LoadImage accepts images of this version only. Version 2 added
+// inexact numbers.
+const ImageVersion = 2
+
+const imageFormat = "minrkt-image"
+
+// ImageVersionError is returned when loading an image written by an
+// incompatible version of minrkt
+type ImageVersionError struct {
+	Format  string
+	Version int
+}
+
+func (e *ImageVersionError) Error() string {
+	if e.Format != imageFormat {
+		return fmt.Sprintf("not a MiniRacket image (format %q)", e.Format)
+	}
+	return fmt.Sprintf("image version %d is not supported, want version %d", e.Version, ImageVersion)
+}
+
+// image is the JSON form of an Environment's definitions
+type image struct {
+	Format    string                `json:"format"`
+	Version   int                   `json:"version"`
+	Variables map[string]*imageNode `json:"variables"`
+	Functions map[string]*imageFunc `json:"functions"`
+}
+
+type imageFunc struct {
+	Params []string   `json:"params"`
+	Body   *imageNode `json:"body"`
+}
+
+// imageNode is a value or an expression. Numbers are kept as text so
+// that +inf.0 and +nan.0 survive the round trip.
+type imageNode struct {
+	Kind     string       `json:"kind"`
+	Name     string       `json:"name,omitempty"`
+	Value    string       `json:"value,omitempty"`
+	Params   []string     `json:"params,omitempty"`
+	Children []*imageNode `json:"children,omitempty"`
+}
+
+// SaveImage writes env's global variables and functions, including the
+// AST of each function body, to w as JSON. Builtins are not saved; the
+// host must define them again before loading. A function whose body uses
+// syntax, syntax-case or a module form cannot be saved, nor can one
+// imported from a module; require it again after loading instead.
+func (env *Environment) SaveImage(w io.Writer) error {
+	g := env.globals()
+	unlock := g.rlock()
+	img := image{
+		Format:    imageFormat,
+		Version:   ImageVersion,
+		Variables: make(map[string]*imageNode, len(g.variables)),
+		Functions: make(map[string]*imageFunc, len(g.functions)),
+	}
+	var err error
+	for name, val := range g.variables {
+		if img.Variables[name], err = encodeValue(val); err != nil {
+			break
+		}
+	}
+	// in order, so that the first function that cannot be saved is the
+	// one reported every time
+	names := make([]string, 0, len(g.functions))
+	for name := range g.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err != nil {
+			break
+		}
+		fn := g.functions[name]
+		var body *imageNode
+		if body, err = encodeExp(fn.expression); err != nil {
+			err = fmt.Errorf("function %s: %w", name, err)
+		} else {
+			img.Functions[name] = &imageFunc{fn.params, body}
+		}
+	}
+	unlock()
+	if err != nil {
+		return fmt.Errorf("save image: %w", err)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(img)
+}
+
+// LoadImage reads an image written by SaveImage and defines its
+// variables and functions in env, replacing definitions of the same name
+func (env *Environment) LoadImage(r io.Reader) error {
+	var img image
+	if err := json.NewDecoder(r).Decode(&img); err != nil {
+		return fmt.Errorf("load image: %w", err)
+	}
+	if img.Format != imageFormat || img.Version != ImageVersion {
+		return &ImageVersionError{img.Format, img.Version}
+	}
+	variables := make(map[string]interface{}, len(img.Variables))
+	for name, node := range img.Variables {
+		val, err := decodeValue(node)
+		if err != nil {
+			return fmt.Errorf("load image: variable %s: %w", name, err)
+		}
+		variables[name] = val
+	}
+	functions := make(map[string]FuncParamExpr, len(img.Functions))
+	for name, fn := range img.Functions {
+		if fn == nil {
+			return fmt.Errorf("load image: function %s: missing definition", name)
+		}
+		body, err := decodeExp(fn.Body)
+		if err != nil {
+			return fmt.Errorf("load image: function %s: %w", name, err)
+		}
+		functions[name] = FuncParamExpr{fn.Params, body}
+	}
+	g := env.globals()
+	defer g.lock()()
+	g.own()
+	for name, val := range variables {
+		g.variables[name] = val
+	}
+	for name, fn := range functions {
+		g.functions[name] = fn
+	}
+	return nil
+}
+
+func formatNumber(num float64) string {
+	return strconv.FormatFloat(num, 'g', -1, 64)
+}
+
+func encodeValue(val Value) (*imageNode, error) {
+	switch v := val.(type) {
+	case nil:
+		return &imageNode{Kind: "void"}, nil
+	case float64:
+		return &imageNode{Kind: "number", Value: formatNumber(v)}, nil
+	case inexact:
+		return &imageNode{Kind: "inexact", Value: formatNumber(float64(v))}, nil
+	case bool:
+		return &imageNode{Kind: "boolean", Value: writeValue(v)}, nil
+	case string:
+		return &imageNode{Kind: "string", Value: v}, nil
+	case *Exn:
+		return &imageNode{Kind: "exn", Name: v.kind, Value: v.message}, nil
+	case []Value:
+		node := &imageNode{Kind: "list"}
+		for _, elem := range v {
+			child, err := encodeValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			node.Children = append(node.Children, child)
+		}
+		return node, nil
+	case map[string]Value:
+		node := &imageNode{Kind: "hash"}
+		var keys []string
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			child, err := encodeValue(v[key])
+			if err != nil {
+				return nil, err
+			}
+			node.Params = append(node.Params, key)
+			node.Children = append(node.Children, child)
+		}
+		return node, nil
+	}
+	return nil, &ConversionError{Value: val, Reason: fmt.Sprintf("%T cannot be saved in an image", val)}
+}
+
+func decodeValue(node *imageNode) (Value, error) {
+	if node == nil {
+		return nil, fmt.Errorf("missing value")
+	}
+	switch node.Kind {
+	case "void":
+		return nil, nil
+	case "number":
+		return strconv.ParseFloat(node.Value, 64)
+	case "inexact":
+		num, err := strconv.ParseFloat(node.Value, 64)
+		return inexact(num), err
+	case "boolean":
+		return node.Value == "#t", nil
+	case "string":
+		return node.Value, nil
+	case "exn":
+		return &Exn{node.Name, node.Value}, nil
+	case "list":
+		lst := make([]Value, len(node.Children))
+		for i, child := range node.Children {
+			elem, err := decodeValue(child)
+			if err != nil {
+				return nil, err
+			}
+			lst[i] = elem
+		}
+		return lst, nil
+	case "hash":
+		if len(node.Params) != len(node.Children) {
+			return nil, fmt.Errorf("hash has %d keys and %d values", len(node.Params), len(node.Children))
+		}
+		table := make(map[string]Value, len(node.Children))
+		for i, child := range node.Children {
+			elem, err := decodeValue(child)
+			if err != nil {
+				return nil, err
+			}
+			table[node.Params[i]] = elem
+		}
+		return table, nil
+	}
+	return nil, fmt.Errorf("unknown value kind %q", node.Kind)
+}
+
+func encodeExps(exps []Exp) ([]*imageNode, error) {
+	nodes := make([]*imageNode, len(exps))
+	for i, exp := range exps {
+		node, err := encodeExp(exp)
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+func encodeExp(exp Exp) (*imageNode, error) {
+	switch e := exp.(type) {
+	case *expVar:
+		return &imageNode{Kind: "var", Name: e.name}, nil
+	case *expLocal:
+		// images hold unresolved code; resolve again after loading
+		return &imageNode{Kind: "var", Name: e.name}, nil
+	case *expFrame:
+		return encodeExp(e.body)
+	case *expNumConst:
+		return &imageNode{Kind: "number", Value: formatNumber(e.val)}, nil
+	case *expInexactConst:
+		return &imageNode{Kind: "inexact", Value: formatNumber(e.val)}, nil
+	case *expBoolConst:
+		return &imageNode{Kind: "boolean", Value: writeValue(e.val)}, nil
+	case *expStrConst:
+		return &imageNode{Kind: "string", Value: e.val}, nil
+	case *expFunc:
+		args, err := encodeExps(e.arguments)
+		return &imageNode{Kind: "call", Name: e.name, Children: args}, err
+	case *expOperator:
+		operands, err := encodeExps(e.operands)
+		return &imageNode{Kind: "operator", Name: operatorNames[e.opType], Children: operands}, err
+	case *expDefineVar:
+		val, err := encodeExps([]Exp{e.val})
+		return &imageNode{Kind: "define", Name: e.name, Children: val}, err
+	case *expDefineFunc:
+		body, err := encodeExps([]Exp{e.expression})
+		return &imageNode{Kind: "define-function", Name: e.name, Params: e.paramNames, Children: body}, err
+	case *expLet:
+		children, err := encodeExps(append(append([]Exp(nil), e.vals...), e.body))
+		return &imageNode{Kind: "let", Params: e.names, Children: children}, err
+	case *expWithHandlers:
+		body, err := encodeExps([]Exp{e.body})
+		node := &imageNode{Kind: "with-handlers", Children: body}
+		for _, clause := range e.clauses {
+			node.Params = append(node.Params, clause.predicate, clause.handler)
+		}
+		return node, err
+	case *expCheck:
+		children := e.args
+		if e.message != nil {
+			children = append(append([]Exp(nil), e.args...), e.message)
+		}
+		args, err := encodeExps(children)
+		return &imageNode{Kind: "check", Name: e.name, Value: e.predicate, Children: args}, err
+	case *expTestCase:
+		children, err := encodeExps(append([]Exp{e.name}, e.body...))
+		return &imageNode{Kind: e.keyword(), Children: children}, err
+	case *expSyntax, *expSyntaxCase:
+		return nil, fmt.Errorf("syntax and syntax-case cannot be saved in an image")
+	case *expRequire, *expProvide, *expModule:
+		return nil, fmt.Errorf("module forms cannot be saved in an image")
+	case *expImport:
+		return nil, fmt.Errorf("imported from %s; require it again after loading", e.from.name)
+	}
+	return nil, fmt.Errorf("%T cannot be saved in an image", exp)
+}
+
+// the number of children each kind of expression has, -1 for any
+var imageChildren = map[string]int{
+	"var": 0, "number": 0, "inexact": 0, "boolean": 0, "string": 0,
+	"call": -1, "operator": -1, "let": -1, "check": -1, "test-case": -1, "test-suite": -1,
+	"define": 1, "define-function": 1, "with-handlers": 1,
+}
+
+func decodeExps(nodes []*imageNode) ([]Exp, error) {
+	exps := make([]Exp, len(nodes))
+	for i, node := range nodes {
+		exp, err := decodeExp(node)
+		if err != nil {
+			return nil, err
+		}
+		exps[i] = exp
+	}
+	return exps, nil
+}
+
+func decodeExp(node *imageNode) (Exp, error) {
+	if node == nil {
+		return nil, fmt.Errorf("missing expression")
+	}
+	children, err := decodeExps(node.Children)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := imageChildren[node.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown expression kind %q", node.Kind)
+	}
+	if n >= 0 && len(children) != n {
+		return nil, fmt.Errorf("%s expression has %d children, want %d", node.Kind, len(children), n)
+	}
+	switch node.Kind {
+	case "var":
+		return &expVar{node.Name}, nil
+	case "number":
+		num, err := strconv.ParseFloat(node.Value, 64)
+		return &expNumConst{num}, err
+	case "inexact":
+		num, err := strconv.ParseFloat(node.Value, 64)
+		return &expInexactConst{num}, err
+	case "boolean":
+		return &expBoolConst{node.Value == "#t"}, nil
+	case "string":
+		return &expStrConst{node.Value}, nil
+	case "call":
+		return &expFunc{node.Name, children}, nil
+	case "operator":
+		for opType, name := range operatorNames {
+			if name == node.Name {
+				return &expOperator{opType, children}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown operator %q", node.Name)
+	case "define":
+		return &expDefineVar{node.Name, children[0]}, nil
+	case "define-function":
+		return &expDefineFunc{node.Name, children[0], node.Params}, nil
+	case "let":
+		if len(children) != len(node.Params)+1 {
+			return nil, fmt.Errorf("let expression has %d children, want %d", len(children), len(node.Params)+1)
+		}
+		n := len(node.Params)
+		return &expLet{node.Params, children[:n], children[n]}, nil
+	case "check":
+		n, ok := checkArgs[node.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown check %q", node.Name)
+		}
+		if len(children) != n && len(children) != n+1 {
+			return nil, fmt.Errorf("%s expression has %d children, want %d or %d", node.Name, len(children), n, n+1)
+		}
+		if (node.Name == "check-exn") != (node.Value != "") {
+			return nil, fmt.Errorf("%s expression with predicate %q", node.Name, node.Value)
+		}
+		e := &expCheck{name: node.Name, predicate: node.Value, args: children[:n]}
+		if len(children) > n {
+			e.message = children[n]
+		}
+		return e, nil
+	case "test-case", "test-suite":
+		if len(children) == 0 {
+			return nil, fmt.Errorf("%s expression without a name", node.Kind)
+		}
+		return &expTestCase{node.Kind == "test-suite", children[0], children[1:]}, nil
+	default: // with-handlers
+		if len(node.Params)%2 != 0 {
+			return nil, fmt.Errorf("with-handlers clause without a handler")
+		}
+		e := &expWithHandlers{body: children[0]}
+		for i := 0; i < len(node.Params); i += 2 {
+			e.clauses = append(e.clauses, handlerClause{node.Params[i], node.Params[i+1]})
+		}
+		return e, nil
+	}
+}
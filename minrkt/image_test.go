@@ -0,0 +1,178 @@
+package minrkt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestImageRoundTrip(t *testing.T) {
+	env, err := NewSandboxEnvironment(WithStandardPrelude(), WithPrelude(`
+		(define inf +inf.0)
+		(define zero 0.0)
+		(define (over-zero n) (/ n 0.0))
+		(define greeting "hi \"there\"")
+		(define empty "")
+		(define lst (list 1 #t "s" (list)))
+		(define table (hash "a" 1 "b" (list 2)))
+		(define (safe-div a b) (with-handlers ([exn:fail:contract:divide-by-zero? exn-message]) (/ a b)))
+		(define (fact n) (if (< n 1) 1 (* n (fact (sub1 n)))))
+		(define (both a b) (and a (or b (not a))))
+		(define (hyp a b) (let ([a2 (* a a)] [b2 (* b b)]) (+ a2 b2)))
+		(define (self-test n)
+		  (test-suite "self"
+		    (test-case "checks" (check-equal? (fact n) 6 "fact") (check-true #t) (check-exn exn:fail? (/ n 0)))))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := env.SaveImage(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewSandboxEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.LoadImage(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		a    string
+		want interface{}
+	}{
+		{"(fact 5)", 120.0},
+		{"(safe-div 1 0)", "/: division by zero"},
+		{"(both #t #f)", "#f"},
+		{"(hyp 3 4)", 25.0},
+		{"(odd? 7)", "#t"},
+		{"inf", "+inf.0"},
+		{"(/ 1 zero)", "+inf.0"},
+		{"(over-zero 1)", "+inf.0"},
+		{"greeting", `hi "there"`},
+		{"empty", ""},
+		{"(length lst)", 4.0},
+		{"(first (hash-ref table \"b\"))", 2.0},
+		{"(self-test 3)", nil},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			got, err := evalLines(loaded, tt.a)
+			if err != nil || got != tt.want {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+	_, err = evalLines(loaded, "(self-test 4)")
+	if want := `(check-equal? (fact n) 6 "fact") failed (fact): actual 24, expected 6`; fmt.Sprint(err) != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+	for _, name := range []string{"lst", "table"} {
+		if !valuesEqual(env.variables[name], loaded.variables[name]) {
+			t.Errorf("%s: got %v, want %v", name, loaded.variables[name], env.variables[name])
+		}
+	}
+}
+
+func TestImageNaN(t *testing.T) {
+	env := &Environment{variables: map[string]interface{}{"n": math.NaN(), "x": &Exn{EXN_FAIL, "m"}}}
+	var buf bytes.Buffer
+	if err := env.SaveImage(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Environment{}
+	if err := loaded.LoadImage(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := loaded.variables["n"].(float64); !math.IsNaN(n) {
+		t.Errorf("got %v, want NaN", loaded.variables["n"])
+	}
+	if x, _ := loaded.variables["x"].(*Exn); x == nil || *x != (Exn{EXN_FAIL, "m"}) {
+		t.Errorf("got %v, want #<exn:fail>", loaded.variables["x"])
+	}
+}
+
+func TestImageUnsavable(t *testing.T) {
+	env := &Environment{variables: map[string]interface{}{"f": func() {}}}
+	var convErr *ConversionError
+	if err := env.SaveImage(&bytes.Buffer{}); !errors.As(err, &convErr) {
+		t.Errorf("got %v, want a ConversionError", err)
+	}
+}
+
+func TestImageUnsavableForms(t *testing.T) {
+	var tests = []struct {
+		a       string
+		wantErr string
+	}{
+		{"(define (f x) (syntax (x 1)))", "save image: function f: syntax and syntax-case cannot be saved in an image"},
+		{"(define (f x) (syntax-case x () [(a b) (syntax b)]))", "save image: function f: syntax and syntax-case cannot be saved in an image"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			env := newTestEnv()
+			if _, err := evalLines(env, tt.a); err != nil {
+				t.Fatal(err)
+			}
+			if err := env.SaveImage(&bytes.Buffer{}); fmt.Sprint(err) != tt.wantErr {
+				t.Errorf("got %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadImageErrors(t *testing.T) {
+	var tests = []struct {
+		a       string
+		wantErr string
+	}{
+		{`{"format": "minrkt-image", "version": 99}`, "image version 99 is not supported, want version 2"},
+		// version 1 images have no inexact numbers, but are not read either
+		{`{"format": "minrkt-image", "version": 1, "variables": {"x": {"kind": "number", "value": "1"}}}`, "image version 1 is not supported, want version 2"},
+		{`{"format": "png", "version": 1}`, `not a MiniRacket image (format "png")`},
+		{`{"format": "minrkt-image", "version": 2`, "load image: unexpected EOF"},
+		{`{"format": "minrkt-image", "version": 2, "variables": {"x": {"kind": "blob"}}}`, `load image: variable x: unknown value kind "blob"`},
+		{`{"format": "minrkt-image", "version": 2, "functions": {"f": {"body": {"kind": "operator", "name": "%"}}}}`, `load image: function f: unknown operator "%"`},
+		{`{"format": "minrkt-image", "version": 2, "functions": {"f": {"body": {"kind": "define"}}}}`, "load image: function f: define expression has 0 children, want 1"},
+		{`{"format": "minrkt-image", "version": 2, "functions": {"f": {"body": {"kind": "check", "name": "check-it"}}}}`, `load image: function f: unknown check "check-it"`},
+		{`{"format": "minrkt-image", "version": 2, "functions": {"f": {"body": {"kind": "check", "name": "check-true"}}}}`, "load image: function f: check-true expression has 0 children, want 1 or 2"},
+		{`{"format": "minrkt-image", "version": 2, "functions": {"f": {"body": {"kind": "test-case"}}}}`, "load image: function f: test-case expression without a name"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			env := newTestEnv()
+			err := env.LoadImage(strings.NewReader(tt.a))
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got %v, want %s", err, tt.wantErr)
+			}
+			if len(env.variables) != 0 || len(env.functions) != 0 {
+				t.Errorf("failed load left definitions behind")
+			}
+		})
+	}
+}
+
+func TestLoadImageOtherVersion(t *testing.T) {
+	env := newTestEnv()
+	if _, err := evalLines(env, "(define half 0.5)"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := env.SaveImage(&buf); err != nil {
+		t.Fatal(err)
+	}
+	old := strings.Replace(buf.String(), fmt.Sprintf(`"version": %d`, ImageVersion), `"version": 1`, 1)
+	err := newTestEnv().LoadImage(strings.NewReader(old))
+	var versionErr *ImageVersionError
+	if !errors.As(err, &versionErr) || versionErr.Version != 1 {
+		t.Fatalf("got %v, want an ImageVersionError for version 1", err)
+	}
+	if want := "image version 1 is not supported, want version 2"; err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+}
@@ -0,0 +1,80 @@
+package minrkt
+
+// expLet is (let ([name val] ...) body). The values are evaluated in the
+// enclosing scope and the body sees the new names alongside the
+// parameters of the enclosing function.
+type expLet struct {
+	names []string
+	vals  []Exp
+	body  Exp
+}
+
+func (e *expLet) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	scope := make(map[string]interface{})
+	if len(env.CallStack) > 0 {
+		for name, val := range env.CallStack[len(env.CallStack)-1] {
+			scope[name] = val
+		}
+	}
+	for i, exp := range e.vals {
+		val, err := exp.Eval(env)
+		if err != nil {
+			return nil, inForm(err, e)
+		}
+		scope[e.names[i]] = val
+	}
+	env.CallStack = append(env.CallStack, scope)
+	result, err := e.body.Eval(env)
+	env.CallStack = env.CallStack[:len(env.CallStack)-1]
+	if err != nil {
+		return nil, inForm(err, e)
+	}
+	return result, nil
+}
+
+// parses the remainder of (let ([name val] ...) body) after the let
+// keyword
+func (p *parser) parseLet(tokens []Token) ([]Token, Exp, error) {
+	var exp Exp
+	if len(tokens) == 0 || !isLeftParenthesis(tokens[0]) {
+		return []Token{}, exp, &ParseError{"let requires a list of bindings"}
+	}
+	leftOver := tokens[1:]
+	let := &expLet{}
+	for len(leftOver) > 0 && leftOver[0].tokType != TOK_RPAREN {
+		if len(leftOver) < 3 || !isLeftParenthesis(leftOver[0]) || !isIdentifier(leftOver[1]) {
+			return []Token{}, exp, &ParseError{"invalid let binding"}
+		}
+		let.names = append(let.names, leftOver[1].val)
+		var val Exp
+		var err error
+		leftOver, val, err = p.parse(leftOver[2:])
+		if err != nil {
+			return []Token{}, exp, err
+		}
+		if len(leftOver) == 0 || leftOver[0].tokType != TOK_RPAREN {
+			return []Token{}, exp, &ParseError{"invalid let binding"}
+		}
+		let.vals = append(let.vals, val)
+		leftOver = leftOver[1:]
+	}
+	if len(leftOver) == 0 {
+		return []Token{}, exp, &ParseError{"missing closing )"}
+	}
+	leftOver = leftOver[1:]
+	if len(leftOver) == 0 || leftOver[0].tokType == TOK_RPAREN {
+		return []Token{}, exp, &ParseError{"missing let body"}
+	}
+	leftOver, body, err := p.parse(leftOver)
+	if err != nil {
+		return []Token{}, exp, err
+	}
+	if len(leftOver) == 0 || leftOver[0].tokType != TOK_RPAREN {
+		return []Token{}, exp, &ParseError{"missing closing )"}
+	}
+	let.body = body
+	return leftOver[1:], let, nil
+}
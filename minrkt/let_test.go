@@ -0,0 +1,56 @@
+package minrkt
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLet(t *testing.T) {
+	var tests = []struct {
+		a       string
+		want    interface{}
+		wantErr string
+	}{
+		{"(let ([x 1] [y 2]) (+ x y))", 3.0, ""},
+		{"(let ((x 1)) x)", 1.0, ""},
+		{"(let () 4)", 4.0, ""},
+		{"(let ([x 1]) (let ([x 2] [y x]) (list x y)))", []Value{2.0, 1.0}, ""},
+		{"(let ([x (/ 1 0)]) x)", nil, "/: division by zero"},
+		{"(let x 1)", nil, "1:1: with let requires a list of bindings"},
+		{"(let ([1 2]) 3)", nil, "1:1: with invalid let binding"},
+		{"(let ([x 1 2]) x)", nil, "1:1: with invalid let binding"},
+		{"(let ([x 1]))", nil, "1:1: with missing let body"},
+		{"(let ([x 1]) x x)", nil, "1:1: with missing closing )"},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			prog, err := ParseSource(tt.a)
+			var got interface{}
+			if err == nil {
+				var results []interface{}
+				results, err = EvaluateProgram(prog, newTestEnv())
+				if err == nil {
+					got = results[0]
+				}
+			}
+			if fmt.Sprint(err) != fmt.Sprint(tt.wantErr) && !(err == nil && tt.wantErr == "") {
+				t.Fatalf("got error %v, want %s", err, tt.wantErr)
+			}
+			if err == nil && fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLetString(t *testing.T) {
+	prog, err := ParseSource("(let ((x 1) [y (+ 1 2)]) (* x y))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := unparse(prog.Forms[0]), "(let ([x 1] [y (+ 1 2)]) (* x y))"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,239 @@
+package minrkt
+
+import (
+	"fmt"
+	"sort"
+)
+
+// severities of a Diagnostic
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Diagnostic is a problem Lint found in a program
+type Diagnostic struct {
+	Pos      Pos    `json:"pos"`
+	Severity string `json:"severity"`
+	Code     string `json:"code"` // e.g. unbound-variable or arity-mismatch
+	Message  string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%v: %s: %s", d.Pos, d.Severity, d.Message)
+}
+
+type linter struct {
+	prog  *Program
+	env   *Environment
+	funcs map[string][]*expDefineFunc
+	vars  map[string][]*expDefineVar
+	// uses of each function and variable outside its own definition
+	funcUses, varUses map[string]int
+	// set by (provide (all-defined-out)), which uses every definition
+	exportsAll bool
+	diags      []Diagnostic
+}
+
+// Lint reports, without running prog, the identifiers that are not
+// defined, calls with the wrong number of arguments, parameters that
+// shadow globals or each other, names defined more than once and
+// definitions prog never uses. Definitions in env count as defined.
+func Lint(prog *Program, env *Environment) []Diagnostic {
+	l := &linter{
+		prog:     prog,
+		env:      env,
+		funcs:    make(map[string][]*expDefineFunc),
+		vars:     make(map[string][]*expDefineVar),
+		funcUses: make(map[string]int),
+		varUses:  make(map[string]int),
+	}
+	r := newResolver(prog, env)
+	r.resolveAll(prog.Forms, nil)
+	for name, n := range r.varUses {
+		l.varUses[name] += n
+	}
+	for _, ref := range r.unbound {
+		code, what := "unbound-variable", "variable"
+		if ref.Function {
+			code, what = "unbound-procedure", "procedure"
+		}
+		l.diags = append(l.diags, Diagnostic{ref.Pos, SeverityError, code, "unbound " + what + " " + ref.Name})
+	}
+	for _, form := range prog.Forms {
+		walkExp(form, func(e Exp) {
+			switch e := e.(type) {
+			case *expDefineFunc:
+				l.funcs[e.name] = append(l.funcs[e.name], e)
+			case *expDefineVar:
+				l.vars[e.name] = append(l.vars[e.name], e)
+			}
+		})
+	}
+	for _, form := range prog.Forms {
+		l.lint(form, "")
+	}
+	l.checkDefinitions()
+	SortDiagnostics(l.diags)
+	return l.diags
+}
+
+// SortDiagnostics sorts diags by position, then code, then message,
+// which names the identifier, so that the order does not depend on map
+// iteration
+func SortDiagnostics(diags []Diagnostic) {
+	sort.SliceStable(diags, func(i, j int) bool {
+		a, b := diags[i], diags[j]
+		if a.Pos != b.Pos {
+			return a.Pos.before(b.Pos)
+		}
+		if a.Code != b.Code {
+			return a.Code < b.Code
+		}
+		return a.Message < b.Message
+	})
+}
+
+func (l *linter) report(at Exp, severity, code, format string, args ...interface{}) {
+	l.diags = append(l.diags, Diagnostic{l.prog.Positions[at], severity, code, fmt.Sprintf(format, args...)})
+}
+
+// arity returns the number of parameters of the function name, or -1
+// when it is unknown or differs between definitions
+func (l *linter) arity(name string) (int, bool) {
+	if defs, ok := l.funcs[name]; ok {
+		for _, def := range defs[1:] {
+			if len(def.paramNames) != len(defs[0].paramNames) {
+				return 0, false
+			}
+		}
+		return len(defs[0].paramNames), true
+	}
+	if fn, ok := l.env.lookupFunction(name); ok {
+		return len(fn.params), true
+	}
+	return 0, false
+}
+
+func (l *linter) checkCall(at Exp, name string, given int) {
+	if n, ok := l.arity(name); ok {
+		if n != given {
+			l.report(at, SeverityError, "arity-mismatch", "%s: arity mismatch; expected %d, given %d", name, n, given)
+		}
+		return
+	}
+	if _, ok := l.funcs[name]; ok {
+		return
+	}
+	if builtin, ok := l.env.lookupBuiltin(name); ok && !builtin.accepts(given) {
+		l.report(at, SeverityError, "arity-mismatch", "%s: arity mismatch; expected %s, given %d", name, builtin.arityString(), given)
+	}
+}
+
+// lint checks exp, found in the body of the function owner. The uses of
+// variables were counted by the resolver, which knows their scopes.
+func (l *linter) lint(exp Exp, owner string) {
+	walkExp(exp, func(e Exp) {
+		switch e := e.(type) {
+		case *expFunc:
+			if e.name != owner {
+				l.funcUses[e.name]++
+			}
+			l.checkCall(e, e.name, len(e.arguments))
+		case *expCheck:
+			if e.predicate != "" {
+				if e.predicate != owner {
+					l.funcUses[e.predicate]++
+				}
+				l.checkCall(e, e.predicate, 1)
+			}
+		case *expProvide:
+			// a module's exports are used by the modules requiring it
+			for _, name := range e.names {
+				l.varUses[name]++
+				l.funcUses[name]++
+			}
+			l.exportsAll = l.exportsAll || e.all
+		case *expWithHandlers:
+			for _, clause := range e.clauses {
+				for _, name := range []string{clause.predicate, clause.handler} {
+					if name != owner {
+						l.funcUses[name]++
+					}
+					l.checkCall(e, name, 1)
+				}
+			}
+		}
+	})
+	// walkExp counted the recursive calls in the bodies of nested
+	// definitions as uses
+	walkExp(exp, func(e Exp) {
+		def, ok := e.(*expDefineFunc)
+		if !ok {
+			return
+		}
+		l.checkParams(def)
+		l.funcUses[def.name] -= countCalls(def.expression, def.name)
+	})
+}
+
+// countCalls counts the calls to name in exp, outside of with-handlers
+func countCalls(exp Exp, name string) int {
+	n := 0
+	walkExp(exp, func(e Exp) {
+		if call, ok := e.(*expFunc); ok && call.name == name {
+			n++
+		}
+	})
+	return n
+}
+
+func (l *linter) checkParams(def *expDefineFunc) {
+	seen := make(map[string]bool)
+	for _, param := range def.paramNames {
+		if seen[param] {
+			l.report(def, SeverityWarning, "shadowed", "%s: parameter %s is repeated", def.name, param)
+		}
+		seen[param] = true
+		_, global := l.vars[param]
+		if _, ok := l.env.lookupVariable(param); ok || global {
+			l.report(def, SeverityWarning, "shadowed", "%s: parameter %s shadows the global variable %s", def.name, param, param)
+		}
+	}
+}
+
+// checkDefinitions reports names defined more than once, functions that
+// shadow builtins and definitions that are never used
+func (l *linter) checkDefinitions() {
+	for name, defs := range l.funcs {
+		for _, def := range defs[1:] {
+			l.report(def, SeverityWarning, "redefined", "%s is defined more than once", name)
+		}
+		if _, ok := l.env.lookupFunction(name); ok {
+			l.report(defs[0], SeverityWarning, "shadowed", "%s replaces the existing definition of %s", name, name)
+		} else if _, ok := l.env.lookupBuiltin(name); ok {
+			l.report(defs[0], SeverityWarning, "shadowed", "%s shadows the builtin %s", name, name)
+		}
+		if l.funcUses[name] <= 0 && !l.exportsAll {
+			l.report(defs[0], SeverityWarning, "unused", "%s is defined but never used", name)
+		}
+	}
+	for name, defs := range l.vars {
+		for _, def := range defs[1:] {
+			l.report(def, SeverityWarning, "redefined", "%s is defined more than once", name)
+		}
+		if l.varUses[name] <= 0 && !l.exportsAll {
+			l.report(defs[0], SeverityWarning, "unused", "%s is defined but never used", name)
+		}
+	}
+}
+
+// HasErrors reports whether any of diags is an error
+func HasErrors(diags []Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
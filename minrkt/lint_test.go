@@ -0,0 +1,69 @@
+package minrkt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	var tests = []struct {
+		a    string
+		want []string
+	}{
+		{"(define (f x) (* x 2)) (f 3)", nil},
+		{"(define x 1) (+ x 1)", nil},
+		{"(+ z 1)", []string{"1:4: error: unbound variable z"}},
+		{"(h 3)", []string{"1:1: error: unbound procedure h"}},
+		{"(define (f x y) (+ x y)) (f 1)", []string{"1:26: error: f: arity mismatch; expected 2, given 1"}},
+		{"(exn-message 1 2)", []string{"1:1: error: exn-message: arity mismatch; expected 1, given 2"}},
+		{"(define x 1) (define (f x) x) (f x)", []string{"1:14: warning: f: parameter x shadows the global variable x"}},
+		{"(define (f a a) a) (f 1 2)", []string{"1:1: warning: f: parameter a is repeated"}},
+		{"(define (f) 1) (define (f) 2) (f)", []string{"1:16: warning: f is defined more than once"}},
+		{"(define (exn-message e) e) (exn-message 1)", []string{"1:1: warning: exn-message shadows the builtin exn-message"}},
+		{"(define x 1)", []string{"1:1: warning: x is defined but never used"}},
+		// a let-bound name hides the global it shadows, but not in its own value
+		{"(define x 1) (let ([x 2]) x)", []string{"1:1: warning: x is defined but never used"}},
+		{"(define x 1) (define (f y) (let ([x y]) x)) (f 2)", []string{"1:1: warning: x is defined but never used"}},
+		{"(define x 1) (let ([x x]) x)", nil},
+		{"(define (fact n) (if (= n 0) 1 (* n (fact (- n 1)))))", []string{"1:1: warning: fact is defined but never used"}},
+		// diagnostics at one position are ordered by code, then message
+		{"(define x 1) (define y 2) (define (f y x) x) (f x y)", []string{
+			"1:27: warning: f: parameter x shadows the global variable x",
+			"1:27: warning: f: parameter y shadows the global variable y"}},
+		{"(define (f a a) a)", []string{"1:1: warning: f: parameter a is repeated", "1:1: warning: f is defined but never used"}},
+		{"(define (p e) #t) (define (h e) 0) (with-handlers ([p h]) (raise 1))", nil},
+		{"(define (p a b) #t) (define (h e) 0) (with-handlers ([p h]) (raise 1))",
+			[]string{"1:38: error: p: arity mismatch; expected 2, given 1"}},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			prog, err := ParseSource(tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, diag := range Lint(prog, newTestEnv()) {
+				got = append(got, diag.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLintUsesEnvironment(t *testing.T) {
+	env := newTestEnv()
+	evalLines(env, "(define (double x) (* x 2))", "(define y 3)")
+	prog, err := ParseSource("(double y) (double 1 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	diags := Lint(prog, env)
+	if len(diags) != 1 || diags[0].Code != "arity-mismatch" || !HasErrors(diags) {
+		t.Errorf("got %v, want one arity mismatch", diags)
+	}
+}
@@ -0,0 +1,85 @@
+package minrkt
+
+import "fmt"
+
+// lists are []Value and hash tables are map[string]Value
+func init() {
+	defineStandard("list", restType(tList, tAny), func(args []Value) (Value, error) {
+		return append([]Value{}, args...), nil
+	})
+	defineStandard("cons", funcType(tList, tAny, tList), func(args []Value) (Value, error) {
+		lst, err := listArg("cons", args[1])
+		if err != nil {
+			return nil, err
+		}
+		return append([]Value{args[0]}, lst...), nil
+	})
+	defineStandard("first", funcType(tAny, tList), func(args []Value) (Value, error) {
+		lst, err := listArg("first", args[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(lst) == 0 {
+			return nil, &EvalError{"first: contract violation; expected: non-empty list; given: '()"}
+		}
+		return lst[0], nil
+	})
+	defineStandard("rest", funcType(tList, tList), func(args []Value) (Value, error) {
+		lst, err := listArg("rest", args[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(lst) == 0 {
+			return nil, &EvalError{"rest: contract violation; expected: non-empty list; given: '()"}
+		}
+		return lst[1:], nil
+	})
+	defineStandard("null?", funcType(tBoolean, tAny), func(args []Value) (Value, error) {
+		lst, ok := args[0].([]Value)
+		return ok && len(lst) == 0, nil
+	})
+	defineStandard("length", funcType(tNumber, tList), func(args []Value) (Value, error) {
+		lst, err := listArg("length", args[0])
+		if err != nil {
+			return nil, err
+		}
+		return float64(len(lst)), nil
+	})
+	defineStandard("hash", restType(tAny, tAny), func(args []Value) (Value, error) {
+		if len(args)%2 != 0 {
+			return nil, &EvalError{"hash: key does not have a value"}
+		}
+		table := make(map[string]Value)
+		for i := 0; i < len(args); i += 2 {
+			key, ok := args[i].(string)
+			if !ok {
+				return nil, &EvalError{"hash: contract violation; expected: string?; given: " + showValue(args[i])}
+			}
+			table[key] = args[i+1]
+		}
+		return table, nil
+	})
+	defineStandard("hash-ref", funcType(tAny, tAny, tString), func(args []Value) (Value, error) {
+		table, ok := args[0].(map[string]Value)
+		if !ok {
+			return nil, &EvalError{"hash-ref: contract violation; expected: hash?; given: " + showValue(args[0])}
+		}
+		key, ok := args[1].(string)
+		if !ok {
+			return nil, &EvalError{"hash-ref: contract violation; expected: string?; given: " + showValue(args[1])}
+		}
+		val, ok := table[key]
+		if !ok {
+			return nil, &EvalError{"hash-ref: no value found for key " + showValue(args[1])}
+		}
+		return val, nil
+	})
+}
+
+func listArg(op string, val Value) ([]Value, error) {
+	lst, ok := val.([]Value)
+	if !ok {
+		return nil, &EvalError{fmt.Sprintf("%s: contract violation; expected: list?; given: %s", op, showValue(val))}
+	}
+	return lst, nil
+}
@@ -0,0 +1,38 @@
+package minrkt
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestListBuiltins(t *testing.T) {
+	var tests = []struct {
+		a    string
+		want interface{}
+	}{
+		{"(list 1 2 3)", []Value{1.0, 2.0, 3.0}},
+		{"(list)", []Value{}},
+		{"(cons 1 (list 2))", []Value{1.0, 2.0}},
+		{"(first (list 1 2))", 1.0},
+		{"(rest (list 1 2))", []Value{2.0}},
+		{"(null? (rest (list 1)))", "#t"},
+		{"(null? 5)", "#f"},
+		{"(length (list 1 2 3))", 3.0},
+		{`(hash-ref (hash "a" 1 "b" 2) "b")`, 2.0},
+		{"(= (list 1 (list 2)) (list 1 (list 2)))", "#t"},
+		{"(= (list 1) (list 2))", "#f"},
+		{"(with-handlers ([exn:fail:contract? exn-message]) (first (list)))", "first: contract violation; expected: non-empty list; given: '()"},
+		{`(with-handlers ([exn:fail:contract? exn-message]) (hash-ref (hash) "k"))`, `hash-ref: no value found for key "k"`},
+		{`(with-handlers ([exn:fail:contract? exn-message]) (hash-ref (hash "" 7) 5))`, "hash-ref: contract violation; expected: string?; given: 5"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			got, err := evalLines(newTestEnv(), tt.a)
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
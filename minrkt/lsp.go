@@ -0,0 +1,563 @@
+package minrkt
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ServeLSP runs a Language Server Protocol server for MiniRacket over r
+// and w until the client sends exit. It reports syntax errors as
+// diagnostics and answers go-to-definition, hover, completion and
+// document symbol requests. env supplies the builtins and prelude
+// functions that completion and hover know about; it is never evaluated
+// in. Positions are counted in characters, which matches the UTF-16
+// columns of the protocol for all but the characters outside the Basic
+// Multilingual Plane.
+func ServeLSP(r io.Reader, w io.Writer, env *Environment) error {
+	s := &lspServer{env: env, out: w, docs: make(map[string]*lspDocument)}
+	in := textproto.NewReader(bufio.NewReader(r))
+	for {
+		header, err := in.ReadMIMEHeader()
+		if err != nil {
+			return err
+		}
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			return fmt.Errorf("lsp: bad Content-Length: %w", err)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(in.R, body); err != nil {
+			return err
+		}
+		var msg rpcRequest
+		if err := json.Unmarshal(body, &msg); err != nil {
+			if err := s.reply(nil, nil, &rpcError{rpcParseError, err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return errors.New("lsp: exit before shutdown")
+			}
+			return nil
+		}
+		result, rpcErr, err := s.handle(msg.Method, msg.Params)
+		if err != nil {
+			return err
+		}
+		// notifications have no id and get no reply
+		if msg.ID != nil {
+			if err := s.reply(msg.ID, result, rpcErr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// JSON-RPC error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidParams  = -32602
+	rpcMethodNotFound = -32601
+)
+
+type rpcRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// LSP kinds used in the replies
+const (
+	lspSeverityError   = 1
+	lspCompleteFunc    = 3
+	lspCompleteVar     = 6
+	lspCompleteKeyword = 14
+	lspSymbolFunc      = 12
+	lspSymbolVar       = 13
+)
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspHover struct {
+	Contents lspMarkup `json:"contents"`
+	Range    lspRange  `json:"range"`
+}
+
+type lspMarkup struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type lspCompletion struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type lspSymbol struct {
+	Name           string   `json:"name"`
+	Detail         string   `json:"detail,omitempty"`
+	Kind           int      `json:"kind"`
+	Range          lspRange `json:"range"`
+	SelectionRange lspRange `json:"selectionRange"`
+}
+
+type lspDocumentParams struct {
+	TextDocument struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+	Position lspPosition `json:"position"`
+}
+
+// keywords offered by completion besides the defined names
+var lspKeywords = []string{
+	"and", "check-equal?", "check-exn", "check-true", "define",
+	"define-for-syntax", "define-syntax", "if", "let", "module", "not",
+	"or", "provide", "require", "syntax-case", "syntax-rules", "test-case",
+	"test-suite", "with-handlers",
+}
+
+type lspServer struct {
+	env      *Environment
+	out      io.Writer
+	docs     map[string]*lspDocument
+	shutdown bool
+}
+
+// handle answers one message. The error is a failure to write to the
+// client, which ends the session.
+func (s *lspServer) handle(method string, raw json.RawMessage) (interface{}, *rpcError, error) {
+	var params lspDocumentParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}, nil
+		}
+	}
+	uri := params.TextDocument.URI
+	switch method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       1, // the full text on every change
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"completionProvider":     map[string]interface{}{},
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "minrkt"},
+		}, nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil, nil
+	case "textDocument/didOpen":
+		return nil, nil, s.update(uri, params.TextDocument.Text)
+	case "textDocument/didChange":
+		if n := len(params.ContentChanges); n > 0 {
+			return nil, nil, s.update(uri, params.ContentChanges[n-1].Text)
+		}
+	case "textDocument/didClose":
+		delete(s.docs, uri)
+		return nil, nil, s.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": uri, "diagnostics": []lspDiagnostic{}})
+	case "textDocument/definition":
+		if doc, ok := s.docs[uri]; ok {
+			return doc.definition(uri, params.Position), nil, nil
+		}
+		return nil, nil, nil
+	case "textDocument/hover":
+		if doc, ok := s.docs[uri]; ok {
+			return doc.hover(s.env, params.Position), nil, nil
+		}
+		return nil, nil, nil
+	case "textDocument/completion":
+		doc, ok := s.docs[uri]
+		if !ok {
+			doc = analyze("")
+		}
+		return doc.complete(s.env, params.Position), nil, nil
+	case "textDocument/documentSymbol":
+		if doc, ok := s.docs[uri]; ok {
+			return doc.symbols(), nil, nil
+		}
+		return []lspSymbol{}, nil, nil
+	default:
+		if strings.HasPrefix(method, "$/") || method == "initialized" {
+			return nil, nil, nil
+		}
+		return nil, &rpcError{rpcMethodNotFound, "method not found: " + method}, nil
+	}
+	return nil, nil, nil
+}
+
+// update reparses a document and publishes its diagnostics
+func (s *lspServer) update(uri, text string) error {
+	doc := analyze(text)
+	s.docs[uri] = doc
+	diags := []lspDiagnostic{}
+	for _, err := range doc.errs {
+		diags = append(diags, lspDiagnostic{doc.rangeAt(err.Pos), lspSeverityError, "minrkt", err.Err.Error()})
+	}
+	return s.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": uri, "diagnostics": diags})
+}
+
+func (s *lspServer) reply(id json.RawMessage, result interface{}, rpcErr *rpcError) error {
+	msg := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if rpcErr != nil {
+		msg["error"] = rpcErr
+	} else {
+		msg["result"] = result
+	}
+	return s.write(msg)
+}
+
+func (s *lspServer) notify(method string, params interface{}) error {
+	return s.write(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (s *lspServer) write(msg interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+// lspDocument is an open document, parsed as far as its errors allow
+type lspDocument struct {
+	tokens    []Token
+	positions []Pos
+	prog      *Program
+	errs      SyntaxErrors
+	defs      []lspDefinition
+	locals    []lspBinding
+}
+
+// lspDefinition is a define in a document
+type lspDefinition struct {
+	name string
+	// the parameters of a function; nil for a variable
+	fn  *FuncParamExpr
+	pos Pos // of the defined name
+	// what binds a local name, e.g. "parameter of f"; empty for a define
+	local string
+}
+
+func analyze(text string) *lspDocument {
+	doc := &lspDocument{}
+	doc.tokens, doc.positions, _ = tokenize(text, new(SyntaxErrors))
+	doc.locals = localBindings(doc.tokens)
+	prog, err := NewStandardExpander().ParseFile(text)
+	doc.prog = prog
+	doc.errs, _ = err.(SyntaxErrors)
+	// a define inside a function body defines a global too
+	for _, form := range prog.Forms {
+		walkExp(form, func(e Exp) {
+			switch e := e.(type) {
+			case *expDefineFunc:
+				fn := FuncParamExpr{e.paramNames, e.expression}
+				doc.defs = append(doc.defs, lspDefinition{e.name, &fn, doc.nameAfter(prog.Positions[e], e.name), ""})
+			case *expDefineVar:
+				doc.defs = append(doc.defs, lspDefinition{e.name, nil, doc.nameAfter(prog.Positions[e], e.name), ""})
+			}
+		})
+	}
+	return doc
+}
+
+// nameAfter returns where name is first written at or after pos, the
+// start of its definition, or pos when a macro wrote it
+func (d *lspDocument) nameAfter(pos Pos, name string) Pos {
+	for i, tok := range d.tokens {
+		if !d.positions[i].before(pos) && isIdentifier(tok) && tok.val == name {
+			return d.positions[i]
+		}
+	}
+	return pos
+}
+
+// identAt returns the identifier token at or just before the cursor
+func (d *lspDocument) identAt(at lspPosition) (int, bool) {
+	return d.tokenAt(at, isIdentifier)
+}
+
+// wordAt is identAt for any identifier or keyword
+func (d *lspDocument) wordAt(at lspPosition) (int, bool) {
+	return d.tokenAt(at, func(tok Token) bool {
+		switch tok.tokType {
+		case TOK_LPAREN, TOK_RPAREN, TOK_NUM, TOK_STRING, TOK_SYNTAX:
+			return false
+		}
+		return true
+	})
+}
+
+func (d *lspDocument) tokenAt(at lspPosition, match func(Token) bool) (int, bool) {
+	for i, tok := range d.tokens {
+		pos := d.positions[i]
+		if match(tok) && pos.Line-1 == at.Line && pos.Col-1 <= at.Character && at.Character <= pos.Col-1+utf8.RuneCountInString(tok.val) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// rangeAt is the range of the token at pos, or one character there when
+// there is none
+func (d *lspDocument) rangeAt(pos Pos) lspRange {
+	n := 1
+	for i, tokPos := range d.positions {
+		if tokPos == pos && !strings.Contains(d.tokens[i].val, "\n") {
+			n = utf8.RuneCountInString(d.tokens[i].val)
+			break
+		}
+	}
+	start := lspPosition{pos.Line - 1, pos.Col - 1}
+	return lspRange{start, lspPosition{start.Line, start.Character + n}}
+}
+
+// lookup returns the definition the identifier token i refers to: the
+// innermost parameter or let binding around it, or else the last
+// definition of its name in d
+func (d *lspDocument) lookup(i int) (lspDefinition, bool) {
+	name := d.tokens[i].val
+	var local *lspBinding
+	for j := range d.locals {
+		b := &d.locals[j]
+		if b.name == name && (i == b.at || (b.from <= i && i < b.to)) && (local == nil || b.from >= local.from) {
+			local = b
+		}
+	}
+	if local != nil {
+		return lspDefinition{name: name, pos: d.positions[local.at], local: local.what}, true
+	}
+	for j := len(d.defs) - 1; j >= 0; j-- {
+		if d.defs[j].name == name {
+			return d.defs[j], true
+		}
+	}
+	return lspDefinition{}, false
+}
+
+// lspBinding is a name a parameter list or let binds. The identifier
+// tokens in [from, to) with its name refer to the one at index at.
+type lspBinding struct {
+	name     string
+	what     string
+	at       int
+	from, to int
+}
+
+// localBindings finds the parameters of the functions defined in tokens
+// and the names their lets bind. It reads the tokens rather than the
+// parsed program so that it works in forms with syntax errors.
+func localBindings(tokens []Token) []lspBinding {
+	var bindings []lspBinding
+	for i := 0; i+2 < len(tokens); i++ {
+		if tokens[i].tokType != TOK_LPAREN || tokens[i+2].tokType != TOK_LPAREN {
+			continue
+		}
+		head, end := tokens[i+1], closingParen(tokens, i)
+		switch {
+		case head.tokType == TOK_DEFINE && i+3 < len(tokens) && isIdentifier(tokens[i+3]):
+			what := "parameter of " + tokens[i+3].val
+			for j := i + 4; j < closingParen(tokens, i+2); j++ {
+				if isIdentifier(tokens[j]) {
+					bindings = append(bindings, lspBinding{tokens[j].val, what, j, j, end})
+				}
+			}
+		case isIdentifier(head) && (head.val == "let" || head.val == "let*"):
+			list := closingParen(tokens, i+2)
+			for j := i + 3; j < list; j = closingParen(tokens, j) + 1 {
+				if tokens[j].tokType != TOK_LPAREN || j+1 >= list || !isIdentifier(tokens[j+1]) {
+					break
+				}
+				// let's bindings are seen by its body, let*'s also by the
+				// bindings after them
+				from := list
+				if head.val == "let*" {
+					from = closingParen(tokens, j)
+				}
+				bindings = append(bindings, lspBinding{tokens[j+1].val, head.val + " binding", j + 1, from, end})
+			}
+		}
+	}
+	return bindings
+}
+
+// closingParen returns the index of the ) matching the ( at tokens[i], or
+// len(tokens) when it is never closed
+func closingParen(tokens []Token, i int) int {
+	depth := 0
+	for j := i; j < len(tokens); j++ {
+		switch tokens[j].tokType {
+		case TOK_LPAREN:
+			depth++
+		case TOK_RPAREN:
+			if depth--; depth == 0 {
+				return j
+			}
+		}
+	}
+	return len(tokens)
+}
+
+func (d *lspDocument) definition(uri string, at lspPosition) interface{} {
+	i, ok := d.identAt(at)
+	if !ok {
+		return nil
+	}
+	def, ok := d.lookup(i)
+	if !ok {
+		return nil
+	}
+	return lspLocation{uri, d.rangeAt(def.pos)}
+}
+
+func (d *lspDocument) hover(env *Environment, at lspPosition) interface{} {
+	i, ok := d.identAt(at)
+	if !ok {
+		return nil
+	}
+	name := d.tokens[i].val
+	var text string
+	if def, ok := d.lookup(i); ok && def.local != "" {
+		text = name + " : " + def.local
+	} else if ok && def.fn != nil {
+		text = def.fn.signature(name)
+	} else if ok {
+		text = name + " : variable"
+	} else if fn, ok := env.lookupFunction(name); ok {
+		text = fn.signature(name)
+	} else if b, ok := env.lookupBuiltin(name); ok {
+		text = fmt.Sprintf("(%s ...) : builtin taking %s arguments", name, b.arityString())
+	} else if _, ok := env.lookupVariable(name); ok {
+		text = name + " : variable"
+	} else {
+		return nil
+	}
+	return lspHover{lspMarkup{"markdown", "```racket\n" + text + "\n```"}, d.rangeAt(d.positions[i])}
+}
+
+// signature is how a call to the function name is written
+func (f FuncParamExpr) signature(name string) string {
+	return "(" + strings.Join(append([]string{name}, f.params...), " ") + ")"
+}
+
+// complete offers the keywords, builtins and definitions starting with
+// the part of the identifier before the cursor
+func (d *lspDocument) complete(env *Environment, at lspPosition) []lspCompletion {
+	prefix := ""
+	if i, ok := d.wordAt(at); ok {
+		prefix = string([]rune(d.tokens[i].val)[:at.Character-(d.positions[i].Col-1)])
+	}
+	items := make(map[string]lspCompletion)
+	add := func(item lspCompletion) {
+		if _, seen := items[item.Label]; !seen && strings.HasPrefix(item.Label, prefix) {
+			items[item.Label] = item
+		}
+	}
+	// the document's own definitions take precedence
+	for i := len(d.defs) - 1; i >= 0; i-- {
+		if def := d.defs[i]; def.fn != nil {
+			add(lspCompletion{def.name, lspCompleteFunc, def.fn.signature(def.name)})
+		} else {
+			add(lspCompletion{def.name, lspCompleteVar, ""})
+		}
+	}
+	snap := env.Snapshot()
+	for name, fn := range snap.functions {
+		add(lspCompletion{name, lspCompleteFunc, fn.signature(name)})
+	}
+	for name, b := range snap.builtins {
+		add(lspCompletion{name, lspCompleteFunc, "builtin taking " + b.arityString() + " arguments"})
+	}
+	for name := range snap.variables {
+		add(lspCompletion{name, lspCompleteVar, ""})
+	}
+	for _, keyword := range lspKeywords {
+		add(lspCompletion{keyword, lspCompleteKeyword, ""})
+	}
+	list := make([]lspCompletion, 0, len(items))
+	for _, item := range items {
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Label < list[j].Label })
+	return list
+}
+
+// symbols lists the top-level definitions of d
+func (d *lspDocument) symbols() []lspSymbol {
+	symbols := []lspSymbol{}
+	for _, form := range d.prog.Forms {
+		var name string
+		var fn *FuncParamExpr
+		switch e := form.(type) {
+		case *expDefineFunc:
+			name, fn = e.name, &FuncParamExpr{e.paramNames, e.expression}
+		case *expDefineVar:
+			name = e.name
+		default:
+			continue
+		}
+		symbol := lspSymbol{Name: name, Kind: lspSymbolVar}
+		if fn != nil {
+			symbol.Kind, symbol.Detail = lspSymbolFunc, fn.signature(name)
+		}
+		symbol.Range = d.formRange(form)
+		symbol.SelectionRange = d.rangeAt(d.nameAfter(d.prog.Positions[form], name))
+		symbols = append(symbols, symbol)
+	}
+	return symbols
+}
+
+// formRange is the range from the ( of a top-level form to its )
+func (d *lspDocument) formRange(form Exp) lspRange {
+	pos := d.prog.Positions[form]
+	r := d.rangeAt(pos)
+	for _, span := range topLevelSpans(d.tokens, d.positions) {
+		if d.positions[span[0]] == pos {
+			end := d.positions[span[1]-1]
+			r.End = lspPosition{end.Line - 1, end.Col - 1 + utf8.RuneCountInString(d.tokens[span[1]-1].val)}
+		}
+	}
+	return r
+}
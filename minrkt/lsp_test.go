@@ -0,0 +1,202 @@
+package minrkt
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// lspExchange sends each message to a server, followed by shutdown and
+// exit, and returns everything the server wrote back
+func lspExchange(t *testing.T, msgs ...string) []string {
+	env, err := NewEnvironment(WithStandardPrelude(), WithOutput(io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs = append(msgs, `{"jsonrpc":"2.0","id":"bye","method":"shutdown"}`, `{"jsonrpc":"2.0","method":"exit"}`)
+	var in, out strings.Builder
+	for _, msg := range msgs {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(msg), msg)
+	}
+	if err := ServeLSP(strings.NewReader(in.String()), &out, env); err != nil {
+		t.Fatal(err)
+	}
+	var replies []string
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(out.String())))
+	for {
+		header, err := r.ReadMIMEHeader()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		length, _ := strconv.Atoi(header.Get("Content-Length"))
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r.R, body); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, string(body))
+	}
+	if last := replies[len(replies)-1]; last != `{"id":"bye","jsonrpc":"2.0","result":null}` {
+		t.Errorf("got shutdown reply %s", last)
+	}
+	return replies[:len(replies)-1]
+}
+
+// sameJSON reports whether a and b are the same JSON value
+func sameJSON(a, b string) bool {
+	var x, y interface{}
+	return json.Unmarshal([]byte(a), &x) == nil && json.Unmarshal([]byte(b), &y) == nil && reflect.DeepEqual(x, y)
+}
+
+func lspOpen(text string) string {
+	msg, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "textDocument/didOpen",
+		"params":  map[string]interface{}{"textDocument": map[string]string{"uri": "file:///a.rkt", "text": text}},
+	})
+	return string(msg)
+}
+
+func lspRequest(method string, line, character int) string {
+	return fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":%q,"params":{"textDocument":{"uri":"file:///a.rkt"},"position":{"line":%d,"character":%d}}}`, method, line, character)
+}
+
+const lspSource = "(define (square x) (* x x))\n(define limit 10)\n(square limit)\n(abs (sq"
+
+func TestLSPRequests(t *testing.T) {
+	var tests = []struct {
+		method          string
+		line, character int
+		want            string
+	}{
+		{"textDocument/definition", 2, 3, `{"uri":"file:///a.rkt","range":{"start":{"line":0,"character":9},"end":{"line":0,"character":15}}}`},
+		{"textDocument/definition", 2, 10, `{"uri":"file:///a.rkt","range":{"start":{"line":1,"character":8},"end":{"line":1,"character":13}}}`},
+		{"textDocument/definition", 3, 2, `null`},
+		{"textDocument/definition", 0, 0, `null`},
+		{"textDocument/hover", 2, 1, "{\"contents\":{\"kind\":\"markdown\",\"value\":\"```racket\\n(square x)\\n```\"},\"range\":{\"start\":{\"line\":2,\"character\":1},\"end\":{\"line\":2,\"character\":7}}}"},
+		{"textDocument/hover", 2, 9, "{\"contents\":{\"kind\":\"markdown\",\"value\":\"```racket\\nlimit : variable\\n```\"},\"range\":{\"start\":{\"line\":2,\"character\":8},\"end\":{\"line\":2,\"character\":13}}}"},
+		// prelude functions and builtins from the environment
+		{"textDocument/hover", 3, 2, "{\"contents\":{\"kind\":\"markdown\",\"value\":\"```racket\\n(abs n)\\n```\"},\"range\":{\"start\":{\"line\":3,\"character\":1},\"end\":{\"line\":3,\"character\":4}}}"},
+		{"textDocument/hover", 0, 20, `null`},
+		{"textDocument/completion", 3, 8, `[{"label":"square","kind":3,"detail":"(square x)"}]`},
+		{"textDocument/completion", 2, 11, `[{"label":"limit","kind":6}]`},
+		{"textDocument/completion", 1, 4, `[{"label":"define","kind":14},{"label":"define-for-syntax","kind":14},{"label":"define-syntax","kind":14}]`},
+		{"textDocument/documentSymbol", 0, 0, `[{"name":"square","detail":"(square x)","kind":12,"range":{"start":{"line":0,"character":0},"end":{"line":0,"character":27}},"selectionRange":{"start":{"line":0,"character":9},"end":{"line":0,"character":15}}},` +
+			`{"name":"limit","kind":13,"range":{"start":{"line":1,"character":0},"end":{"line":1,"character":17}},"selectionRange":{"start":{"line":1,"character":8},"end":{"line":1,"character":13}}}]`},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s %d:%d", tt.method, tt.line, tt.character)
+		t.Run(testname, func(t *testing.T) {
+			replies := lspExchange(t, lspOpen(lspSource), lspRequest(tt.method, tt.line, tt.character))
+			want := `{"jsonrpc":"2.0","id":1,"result":` + tt.want + `}`
+			if got := replies[len(replies)-1]; !sameJSON(got, want) {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestLSPScopes(t *testing.T) {
+	src := "(define x 1)\n(define (f x) (let ([y x] [x 2]) (+ x y)))\n(let* ([a x] [b a]) b)\n(f x)"
+	hover := func(text string, line, character, end int) string {
+		return fmt.Sprintf("{\"contents\":{\"kind\":\"markdown\",\"value\":\"```racket\\n%s\\n```\"},\"range\":{\"start\":{\"line\":%d,\"character\":%d},\"end\":{\"line\":%d,\"character\":%d}}}", text, line, character, line, end)
+	}
+	at := func(line, character, end int) string {
+		return fmt.Sprintf(`{"uri":"file:///a.rkt","range":{"start":{"line":%d,"character":%d},"end":{"line":%d,"character":%d}}}`, line, character, line, end)
+	}
+	var tests = []struct {
+		method          string
+		line, character int
+		want            string
+	}{
+		// a let's initial values see the parameter, its body the binding
+		{"textDocument/definition", 1, 23, at(1, 11, 12)},
+		{"textDocument/definition", 1, 36, at(1, 27, 28)},
+		{"textDocument/definition", 1, 38, at(1, 21, 22)},
+		{"textDocument/definition", 1, 11, at(1, 11, 12)},
+		{"textDocument/hover", 1, 23, hover("x : parameter of f", 1, 23, 24)},
+		{"textDocument/hover", 1, 36, hover("x : let binding", 1, 36, 37)},
+		// let* bindings see the ones before them
+		{"textDocument/definition", 2, 10, at(0, 8, 9)},
+		{"textDocument/definition", 2, 16, at(2, 8, 9)},
+		{"textDocument/hover", 2, 20, hover("b : let* binding", 2, 20, 21)},
+		{"textDocument/definition", 3, 3, at(0, 8, 9)},
+		{"textDocument/hover", 3, 3, hover("x : variable", 3, 3, 4)},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s %d:%d", tt.method, tt.line, tt.character)
+		t.Run(testname, func(t *testing.T) {
+			replies := lspExchange(t, lspOpen(src), lspRequest(tt.method, tt.line, tt.character))
+			want := `{"jsonrpc":"2.0","id":1,"result":` + tt.want + `}`
+			if got := replies[len(replies)-1]; !sameJSON(got, want) {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection closed")
+}
+
+func TestLSPWriteErrors(t *testing.T) {
+	for _, msg := range []string{lspOpen("(+ 1"), "{", `{"jsonrpc":"2.0","method":"textDocument/didClose","params":{"textDocument":{"uri":"file:///a.rkt"}}}`} {
+		t.Run(msg, func(t *testing.T) {
+			in := fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(msg), msg)
+			err := ServeLSP(strings.NewReader(in), failingWriter{}, &Environment{})
+			if err == nil || err.Error() != "connection closed" {
+				t.Errorf("got %v, want the write error", err)
+			}
+		})
+	}
+}
+
+func TestLSPDiagnostics(t *testing.T) {
+	change := `{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":{"uri":"file:///a.rkt"},"contentChanges":[{"text":"(+ 1 2)"}]}}`
+	replies := lspExchange(t,
+		`{"jsonrpc":"2.0","id":0,"method":"initialize","params":{"capabilities":{}}}`,
+		`{"jsonrpc":"2.0","method":"initialized","params":{}}`,
+		lspOpen("(define (f x)\n(define y @)\n(f 2)"),
+		change,
+		`{"jsonrpc":"2.0","id":2,"method":"workspace/symbol","params":{}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/didClose","params":{"textDocument":{"uri":"file:///a.rkt"}}}`,
+	)
+	want := []string{
+		`{"jsonrpc":"2.0","id":0,"result":{"capabilities":{"textDocumentSync":1,"definitionProvider":true,"hoverProvider":true,"completionProvider":{},"documentSymbolProvider":true},"serverInfo":{"name":"minrkt"}}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"file:///a.rkt","diagnostics":[` +
+			`{"range":{"start":{"line":0,"character":0},"end":{"line":0,"character":1}},"severity":1,"source":"minrkt","message":"with missing function expression"},` +
+			`{"range":{"start":{"line":1,"character":10},"end":{"line":1,"character":11}},"severity":1,"source":"minrkt","message":"Invalid Character @"}]}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"file:///a.rkt","diagnostics":[]}}`,
+		`{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"method not found: workspace/symbol"}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"file:///a.rkt","diagnostics":[]}}`,
+	}
+	if len(replies) != len(want) {
+		t.Fatalf("got %d replies %q, want %d", len(replies), replies, len(want))
+	}
+	for i := range want {
+		if !sameJSON(replies[i], want[i]) {
+			t.Errorf("got %s, want %s", replies[i], want[i])
+		}
+	}
+}
+
+func TestLSPExitWithoutShutdown(t *testing.T) {
+	msg := `{"jsonrpc":"2.0","method":"exit"}`
+	in := fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(msg), msg)
+	err := ServeLSP(strings.NewReader(in), io.Discard, &Environment{})
+	if err == nil || err.Error() != "lsp: exit before shutdown" {
+		t.Errorf("got %v, want an error for exit before shutdown", err)
+	}
+}
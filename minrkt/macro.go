@@ -0,0 +1,863 @@
+package minrkt
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//go:embed lib/syntax.rkt
+var standardSyntax string
+
+// maxExpansions bounds the macro uses expanded in one top-level form, so
+// a macro that always expands into itself fails instead of looping
+const maxExpansions = 10000
+
+// transformerFuel bounds the evaluation steps of one call to a macro's
+// transformer procedure
+const transformerFuel = 1000000
+
+// MacroError is a malformed define-syntax or a macro use that matches
+// none of the macro's patterns
+type MacroError struct {
+	Name string
+	Msg  string
+}
+
+func (e *MacroError) Error() string {
+	return e.Name + ": " + e.Msg
+}
+
+// stx is a form read from the tokens before it is parsed: an atom or a
+// list of forms
+type stx struct {
+	tok   Token // the atom, or the parenthesis that opens the list
+	elems []*stx
+	list  bool
+	pos   Pos
+	// mark numbers the expansion whose template introduced an atom, 0
+	// for one written in the source
+	mark int
+}
+
+func (s *stx) ident() (string, bool) {
+	if s.list || !isIdentifier(s.tok) {
+		return "", false
+	}
+	return s.tok.val, true
+}
+
+func (s *stx) isEllipsis() bool {
+	name, _ := s.ident()
+	return name == "..."
+}
+
+// head returns the identifier or keyword a list starts with, if any
+func (s *stx) head() string {
+	if !s.list || len(s.elems) == 0 || s.elems[0].list {
+		return ""
+	}
+	return s.elems[0].tok.val
+}
+
+// readSyntax groups tokens into forms, reading #'form as (syntax form).
+// It reports false when the parentheses do not balance and leaves the
+// error to the parser.
+func readSyntax(tokens []Token, positions []Pos) ([]*stx, bool) {
+	var forms, open []*stx
+	// whether each open list is a #' that closes after one form
+	var quoted []bool
+	add := func(s *stx) {
+		for len(open) > 0 {
+			parent := open[len(open)-1]
+			parent.elems = append(parent.elems, s)
+			if !quoted[len(open)-1] {
+				return
+			}
+			open, quoted = open[:len(open)-1], quoted[:len(open)-1]
+			s = parent
+		}
+		forms = append(forms, s)
+	}
+	for i, tok := range tokens {
+		switch tok.tokType {
+		case TOK_LPAREN:
+			open = append(open, &stx{tok: tok, list: true, pos: positions[i]})
+			quoted = append(quoted, false)
+		case TOK_SYNTAX:
+			keyword := &stx{tok: Token{TOK_VAR, "syntax"}, pos: positions[i]}
+			open = append(open, &stx{tok: Token{TOK_LPAREN, "("}, list: true, pos: positions[i], elems: []*stx{keyword}})
+			quoted = append(quoted, true)
+		case TOK_RPAREN:
+			if len(open) == 0 || quoted[len(open)-1] {
+				return nil, false
+			}
+			s := open[len(open)-1]
+			open, quoted = open[:len(open)-1], quoted[:len(open)-1]
+			add(s)
+		default:
+			add(&stx{tok: tok, pos: positions[i]})
+		}
+	}
+	return forms, len(open) == 0
+}
+
+// flatten appends the tokens of s, and their positions, for the parser
+func flatten(s *stx, tokens []Token, positions []Pos) ([]Token, []Pos) {
+	if !s.list {
+		return append(tokens, s.tok), append(positions, s.pos)
+	}
+	tokens, positions = append(tokens, s.tok), append(positions, s.pos)
+	for _, elem := range s.elems {
+		tokens, positions = flatten(elem, tokens, positions)
+	}
+	return append(tokens, Token{TOK_RPAREN, ")"}), append(positions, s.pos)
+}
+
+// Expander expands the macros defined with define-syntax before a
+// program is parsed. It remembers the macros of every source it parses,
+// so a REPL keeps one Expander for the whole session.
+type Expander struct {
+	// Trace, when set, receives every expansion step
+	Trace  io.Writer
+	macros map[string]*macro
+	// where transformer procedures and define-for-syntax definitions
+	// run, created when first needed
+	env *Environment
+	// expansions and renamed identifiers so far
+	marks, renames int
+}
+
+func NewExpander() *Expander {
+	return &Expander{macros: make(map[string]*macro)}
+}
+
+// NewStandardExpander returns an Expander that already has the macros of
+// lib/syntax.rkt: when, unless, cond and let*
+func NewStandardExpander() *Expander {
+	x := NewExpander()
+	if _, err := x.ParseSource(standardSyntax); err != nil {
+		panic(err)
+	}
+	return x
+}
+
+// ParseSource parses every top-level form in src
+func ParseSource(src string) (*Program, error) {
+	return NewExpander().ParseSource(src)
+}
+
+// ParseSource defines the macros in src, expands every macro use and
+// parses the result. Expanded forms have the position of the macro use.
+// The Expander is unchanged if src has an error.
+func (x *Expander) ParseSource(src string) (*Program, error) {
+	tokens, positions, err := TokenizeSource(src)
+	if err != nil {
+		return nil, err
+	}
+	return x.parse(tokens, positions)
+}
+
+// ParseFile is ParseSource for an editor or a linter: it does not stop
+// at the first syntax error. After an error it resyncs at the next
+// top-level form and carries on, returning the forms it could parse
+// together with a SyntaxErrors of every error.
+func ParseFile(src string) (*Program, error) {
+	return NewExpander().ParseFile(src)
+}
+
+// ParseFile is ParseSource, recovering from syntax errors like the
+// package-level ParseFile. The macros of the forms that parsed are kept.
+func (x *Expander) ParseFile(src string) (*Program, error) {
+	var errs SyntaxErrors
+	tokens, positions, _ := tokenize(src, &errs)
+	tokErrs := len(errs)
+	prog := &Program{Positions: make(map[Exp]Pos)}
+	spans := topLevelSpans(tokens, positions)
+	for i, span := range spans {
+		start, end := span[0], span[1]
+		// a form with an invalid character in it is reported once. An
+		// unclosed form runs up to the next form or the end of src.
+		bad := false
+		for _, err := range errs[:tokErrs] {
+			inside := err.Pos.before(positions[end-1])
+			if !inside && !balanced(tokens[start:end]) {
+				inside = i+1 == len(spans) || err.Pos.before(positions[spans[i+1][0]])
+			}
+			bad = bad || (!err.Pos.before(positions[start]) && inside)
+		}
+		if bad {
+			continue
+		}
+		part, err := x.parse(tokens[start:end], positions[start:end])
+		if err != nil {
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				syntaxErr = &SyntaxError{positions[start], err}
+			}
+			errs = append(errs, syntaxErr)
+			continue
+		}
+		prog.Forms = append(prog.Forms, part.Forms...)
+		for exp, pos := range part.Positions {
+			prog.Positions[exp] = pos
+		}
+	}
+	if len(errs) > 0 {
+		errs.sort()
+		return prog, errs
+	}
+	return prog, nil
+}
+
+// parse expands and parses tokens, the whole of a source
+func (x *Expander) parse(tokens []Token, positions []Pos) (*Program, error) {
+	forms, ok := readSyntax(tokens, positions)
+	if !ok || (len(x.macros) == 0 && !needsExpander(tokens)) {
+		return parseTokens(tokens, positions)
+	}
+	undo := x.save()
+	tokens, positions = nil, nil
+	for _, form := range forms {
+		expanded, err := x.expandTop(form)
+		if err != nil {
+			undo()
+			return nil, err
+		}
+		if expanded != nil {
+			tokens, positions = flatten(expanded, tokens, positions)
+		}
+	}
+	prog, err := parseTokens(tokens, positions)
+	if err != nil {
+		undo()
+	}
+	return prog, err
+}
+
+// save returns a function that puts back the macros and the phase 1
+// definitions x has now
+func (x *Expander) save() func() {
+	macros := make(map[string]*macro, len(x.macros))
+	for name, m := range x.macros {
+		macros[name] = m
+	}
+	env := x.env
+	var snap *Snapshot
+	if env != nil {
+		snap = env.Snapshot()
+	}
+	return func() {
+		x.macros, x.env = macros, env
+		if snap != nil {
+			env.Restore(snap)
+		}
+	}
+}
+
+// needsExpander reports whether tokens define macros or build syntax
+func needsExpander(tokens []Token) bool {
+	for _, tok := range tokens {
+		if tok.tokType == TOK_SYNTAX || (isIdentifier(tok) && (tok.val == "define-syntax" || tok.val == "define-for-syntax")) {
+			return true
+		}
+	}
+	return false
+}
+
+// phase1 returns the environment transformers run in
+func (x *Expander) phase1() *Environment {
+	if x.env == nil {
+		env, err := NewSandboxEnvironment(WithStandardPrelude())
+		if err != nil {
+			panic(err)
+		}
+		x.env = env
+	}
+	return x.env
+}
+
+// runPhase1 expands and evaluates a definition for use by transformers
+func (x *Expander) runPhase1(form *stx, budget *int) error {
+	form, err := x.expand(form, budget)
+	if err != nil {
+		return err
+	}
+	prog, err := parseTokens(flatten(form, nil, nil))
+	if err != nil {
+		return err
+	}
+	_, err = EvaluateProgram(prog, x.phase1(), EvalOptions{Fuel: transformerFuel})
+	if err != nil {
+		return &SyntaxError{form.pos, err}
+	}
+	return nil
+}
+
+// expandTop expands a top-level form, returning nil for a define-syntax
+func (x *Expander) expandTop(form *stx) (*stx, error) {
+	budget := maxExpansions
+	form, err := x.expandUse(form, &budget)
+	if err != nil {
+		return nil, err
+	}
+	switch form.head() {
+	case "define-syntax":
+		return nil, x.defineSyntax(form, &budget)
+	case "define-for-syntax":
+		define := &stx{tok: form.tok, list: true, pos: form.pos, elems: append([]*stx{
+			{tok: Token{TOK_DEFINE, "define"}, pos: form.pos},
+		}, form.elems[1:]...)}
+		return nil, x.runPhase1(define, &budget)
+	case "module":
+		return x.expandModule(form)
+	}
+	form, err = x.expand(form, &budget)
+	if err != nil {
+		return nil, err
+	}
+	// a definition replaces a macro of the same name
+	if form.head() == "define" && len(form.elems) > 1 {
+		name, _ := form.elems[1].ident()
+		if form.elems[1].list && len(form.elems[1].elems) > 0 {
+			name, _ = form.elems[1].elems[0].ident()
+		}
+		delete(x.macros, name)
+	}
+	return form, nil
+}
+
+// expandModule expands the body of (module name language form ...) like
+// a source of its own. The macros it defines are local to it.
+func (x *Expander) expandModule(form *stx) (*stx, error) {
+	if len(form.elems) < 3 {
+		return form, nil
+	}
+	macros := make(map[string]*macro, len(x.macros))
+	for name, m := range x.macros {
+		macros[name] = m
+	}
+	defer func() { x.macros = macros }()
+	module := &stx{tok: form.tok, list: true, pos: form.pos, mark: form.mark, elems: form.elems[:3:3]}
+	for _, elem := range form.elems[3:] {
+		expanded, err := x.expandTop(elem)
+		if err != nil {
+			return nil, err
+		}
+		if expanded != nil {
+			module.elems = append(module.elems, expanded)
+		}
+	}
+	return module, nil
+}
+
+// expandUse expands s while it is a use of a macro
+func (x *Expander) expandUse(s *stx, budget *int) (*stx, error) {
+	for {
+		m, ok := x.macros[s.head()]
+		if !ok {
+			return s, nil
+		}
+		if *budget--; *budget < 0 {
+			return nil, &SyntaxError{s.pos, &MacroError{m.name, "expansion limit exceeded"}}
+		}
+		before := s
+		var err error
+		if m.transformer != "" {
+			s, err = x.transform(m, s)
+		} else {
+			s, err = x.transcribe(m, s)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if x.Trace != nil {
+			fmt.Fprintf(x.Trace, "%v: %v\n  => %v\n", before.pos, before, s)
+		}
+	}
+}
+
+// expand expands every macro use in s. Forms are never changed in place,
+// since a pattern variable may put the same form in several places.
+func (x *Expander) expand(s *stx, budget *int) (*stx, error) {
+	s, err := x.expandUse(s, budget)
+	if err != nil || !s.list || len(s.elems) == 0 {
+		return s, err
+	}
+	elems := append([]*stx(nil), s.elems...)
+	expandFrom := func(start int) error {
+		for i := start; i < len(elems); i++ {
+			if elems[i], err = x.expand(elems[i], budget); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	switch s.head() {
+	case "define-syntax", "define-for-syntax", "module":
+		return nil, &SyntaxError{s.pos, &MacroError{s.head(), "only allowed at the top level"}}
+	case ":", "syntax", "require", "provide":
+		return s, nil
+	case "syntax-case":
+		// only the subject and the clause bodies are expressions
+		if len(elems) > 1 {
+			if elems[1], err = x.expand(elems[1], budget); err != nil {
+				return nil, err
+			}
+		}
+		for i := 3; i < len(elems); i++ {
+			if clause := elems[i]; clause.list && len(clause.elems) == 2 {
+				body, err := x.expand(clause.elems[1], budget)
+				if err != nil {
+					return nil, err
+				}
+				elems[i] = withElem(clause, 1, body)
+			}
+		}
+	case "define", "with-handlers":
+		err = expandFrom(2)
+	case "let":
+		if len(elems) > 1 && elems[1].list {
+			bindings := &stx{tok: elems[1].tok, list: true, pos: elems[1].pos}
+			for _, binding := range elems[1].elems {
+				if binding.list && len(binding.elems) == 2 {
+					val, err := x.expand(binding.elems[1], budget)
+					if err != nil {
+						return nil, err
+					}
+					binding = &stx{tok: binding.tok, list: true, pos: binding.pos, elems: []*stx{binding.elems[0], val}}
+				}
+				bindings.elems = append(bindings.elems, binding)
+			}
+			elems[1] = bindings
+		}
+		err = expandFrom(2)
+	default:
+		if elems[0].list {
+			err = expandFrom(0)
+		} else {
+			err = expandFrom(1)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return x.hygiene(&stx{tok: s.tok, list: true, pos: s.pos, elems: elems}), nil
+}
+
+// withElem returns list with its i-th element replaced by elem, copying
+// it only if that changes it
+func withElem(list *stx, i int, elem *stx) *stx {
+	if list.elems[i] == elem {
+		return list
+	}
+	copied := *list
+	copied.elems = append([]*stx(nil), list.elems...)
+	copied.elems[i] = elem
+	return &copied
+}
+
+// mapNames returns s with f applied to every identifier in it that
+// names a procedure when fn is true, or a variable otherwise
+func mapNames(s *stx, fn bool, f func(*stx) *stx) *stx {
+	if !s.list {
+		if fn {
+			return s
+		}
+		return f(s)
+	}
+	// at applies f to the i-th element of list, which names a procedure
+	// when isFn is true
+	at := func(list *stx, i int, isFn bool) *stx {
+		if i >= len(list.elems) || list.elems[i].list || isFn != fn {
+			return list
+		}
+		return withElem(list, i, f(list.elems[i]))
+	}
+	// from maps the elements of list from the i-th on
+	from := func(list *stx, i int) *stx {
+		for ; i < len(list.elems); i++ {
+			list = withElem(list, i, mapNames(list.elems[i], fn, f))
+		}
+		return list
+	}
+	switch s.head() {
+	case ":", "syntax", "require", "provide":
+		return s
+	case "with-handlers":
+		if len(s.elems) > 1 && s.elems[1].list {
+			clauses := s.elems[1]
+			for i, clause := range clauses.elems {
+				if clause.list {
+					clauses = withElem(clauses, i, at(at(clause, 0, true), 1, true))
+				}
+			}
+			s = withElem(s, 1, clauses)
+		}
+		return from(s, 2)
+	case "define":
+		if len(s.elems) > 1 && s.elems[1].list {
+			sig := at(s.elems[1], 0, true)
+			for i := 1; i < len(sig.elems); i++ {
+				sig = at(sig, i, false)
+			}
+			s = withElem(s, 1, sig)
+		} else {
+			s = at(s, 1, false)
+		}
+		return from(s, 2)
+	case "let":
+		if len(s.elems) > 1 && s.elems[1].list {
+			bindings := s.elems[1]
+			for i, binding := range bindings.elems {
+				if binding.list {
+					bindings = withElem(bindings, i, from(at(binding, 0, false), 1))
+				}
+			}
+			s = withElem(s, 1, bindings)
+		}
+		return from(s, 2)
+	}
+	if len(s.elems) > 0 && s.elems[0].list {
+		return from(s, 0)
+	}
+	return from(at(s, 0, true), 1)
+}
+
+// renameIn renames the identifiers called name with the given mark in
+// the forms of list from the i-th on
+func renameIn(list *stx, i int, fn bool, name string, mark int, to string) *stx {
+	rename := func(a *stx) *stx {
+		if id, ok := a.ident(); ok && id == name && a.mark == mark {
+			return &stx{tok: Token{TOK_VAR, to}, pos: a.pos}
+		}
+		return a
+	}
+	for ; i < len(list.elems); i++ {
+		list = withElem(list, i, mapNames(list.elems[i], fn, rename))
+	}
+	return list
+}
+
+// captures reports whether a variable called name, introduced by a
+// different expansion than mark, appears in the forms of list from the
+// i-th on
+func captures(list *stx, i int, name string, mark int) bool {
+	found := false
+	for ; i < len(list.elems); i++ {
+		mapNames(list.elems[i], false, func(a *stx) *stx {
+			if id, ok := a.ident(); ok && id == name && a.mark != mark {
+				found = true
+			}
+			return a
+		})
+	}
+	return found
+}
+
+// hygiene renames the variables a let or define binds when a macro
+// introduced them, so they cannot capture the identifiers of the macro's
+// arguments, and when the body has a variable of the same name that a
+// macro introduced, so they cannot capture it either. A function name is
+// global and only renamed when a macro introduced it.
+func (x *Expander) hygiene(s *stx) *stx {
+	fresh := func(name string) string {
+		x.renames++
+		return fmt.Sprintf("%s.%d", name, x.renames)
+	}
+	// bind renames the binder at i of list and the variables of body
+	// from start on that refer to it
+	bind := func(list *stx, i int, body *stx, start int) (*stx, *stx) {
+		binder := list.elems[i]
+		name, ok := binder.ident()
+		if !ok || (binder.mark == 0 && !captures(body, start, name, 0)) {
+			return list, body
+		}
+		to := fresh(name)
+		list = withElem(list, i, &stx{tok: Token{TOK_VAR, to}, pos: binder.pos})
+		return list, renameIn(body, start, false, name, binder.mark, to)
+	}
+	if len(s.elems) < 2 {
+		return s
+	}
+	switch s.head() {
+	case "let":
+		bindings := s.elems[1]
+		if !bindings.list {
+			return s
+		}
+		for i, binding := range bindings.elems {
+			if binding.list && len(binding.elems) > 0 {
+				binding, s = bind(binding, 0, s, 2)
+				bindings = withElem(bindings, i, binding)
+			}
+		}
+		return withElem(s, 1, bindings)
+	case "define":
+		sig := s.elems[1]
+		if !sig.list {
+			if sig.mark != 0 {
+				name, _ := sig.ident()
+				s = withElem(s, 1, &stx{tok: Token{TOK_VAR, fresh(name)}, pos: sig.pos})
+			}
+			return s
+		}
+		for i := 1; i < len(sig.elems); i++ {
+			sig, s = bind(sig, i, s, 2)
+		}
+		if len(sig.elems) > 0 && sig.elems[0].mark != 0 {
+			if name, ok := sig.elems[0].ident(); ok {
+				to, mark := fresh(name), sig.elems[0].mark
+				sig = withElem(sig, 0, &stx{tok: Token{TOK_VAR, to}, pos: sig.elems[0].pos})
+				s = renameIn(s, 2, true, name, mark, to)
+			}
+		}
+		return withElem(s, 1, sig)
+	}
+	return s
+}
+
+// macro is a macro defined with syntax-rules, or with a transformer
+// procedure of the phase 1 environment
+type macro struct {
+	name        string
+	literals    map[string]bool
+	rules       []syntaxRule
+	transformer string
+}
+
+type syntaxRule struct {
+	pattern, template *stx
+}
+
+// binding is what a pattern variable matched: one form, or one binding
+// per repetition for a variable under an ellipsis
+type binding struct {
+	form *stx
+	seq  []*binding
+	many bool
+}
+
+// defineSyntax defines the macro of
+// (define-syntax name (syntax-rules (literal ...) [pattern template] ...))
+// or of (define-syntax (name stx) body), whose body returns the
+// expansion of the syntax object stx
+func (x *Expander) defineSyntax(form *stx, budget *int) error {
+	name := ""
+	if len(form.elems) == 3 {
+		name, _ = form.elems[1].ident()
+		if sig := form.elems[1]; sig.list && len(sig.elems) == 2 {
+			name, _ = sig.elems[0].ident()
+			if _, ok := sig.elems[1].ident(); ok && name != "" {
+				define := withElem(form, 0, &stx{tok: Token{TOK_DEFINE, "define"}, pos: form.pos})
+				if err := x.runPhase1(define, budget); err != nil {
+					return err
+				}
+				x.macros[name] = &macro{name: name, transformer: name}
+				return nil
+			}
+			name = ""
+		}
+	}
+	if name == "" {
+		return &SyntaxError{form.pos, &MacroError{"define-syntax", "bad syntax"}}
+	}
+	spec := form.elems[2]
+	bad := &SyntaxError{spec.pos, &MacroError{"syntax-rules", "bad syntax"}}
+	if spec.head() != "syntax-rules" || len(spec.elems) < 2 || !spec.elems[1].list {
+		return bad
+	}
+	m := &macro{name: name, literals: make(map[string]bool)}
+	for _, literal := range spec.elems[1].elems {
+		id, ok := literal.ident()
+		if !ok {
+			return bad
+		}
+		m.literals[id] = true
+	}
+	for _, clause := range spec.elems[2:] {
+		if !clause.list || len(clause.elems) != 2 || !clause.elems[0].list || len(clause.elems[0].elems) == 0 {
+			return bad
+		}
+		m.rules = append(m.rules, syntaxRule{clause.elems[0], clause.elems[1]})
+	}
+	x.macros[name] = m
+	return nil
+}
+
+// transcribe expands one use of m with the first rule whose pattern
+// matches it. The identifiers the template introduces get a new mark.
+func (x *Expander) transcribe(m *macro, use *stx) (*stx, error) {
+	for _, rule := range m.rules {
+		b := make(map[string]*binding)
+		// the macro keyword itself is not matched
+		if !m.matchList(rule.pattern.elems[1:], use.elems[1:], b) {
+			continue
+		}
+		x.marks++
+		expanded, err := m.instantiate(rule.template, b, x.marks, use.pos)
+		if err != nil {
+			return nil, &SyntaxError{use.pos, err}
+		}
+		return expanded, nil
+	}
+	return nil, &SyntaxError{use.pos, &MacroError{m.name, "bad syntax"}}
+}
+
+// transform expands one use of m by calling its transformer procedure
+// with the use as a syntax object
+func (x *Expander) transform(m *macro, use *stx) (*stx, error) {
+	env := x.phase1().session(nil, []EvalOptions{{Fuel: transformerFuel}})
+	result, err := applyProc(env, nil, m.transformer, []interface{}{&Syntax{use}})
+	if err != nil {
+		return nil, &SyntaxError{use.pos, err}
+	}
+	expanded, ok := result.(*Syntax)
+	if !ok {
+		return nil, &SyntaxError{use.pos, &MacroError{m.name, "received value from syntax expander was not syntax: " + showValue(result)}}
+	}
+	x.marks++
+	return relabel(expanded.stx, x.marks, use.pos), nil
+}
+
+// relabel gives the syntax a transformer's templates created the mark of
+// its expansion and the position of the macro use
+func relabel(s *stx, mark int, pos Pos) *stx {
+	if s.mark == freshMark {
+		copied := *s
+		copied.mark, copied.pos = mark, pos
+		s = &copied
+	}
+	for i, elem := range s.elems {
+		s = withElem(s, i, relabel(elem, mark, pos))
+	}
+	return s
+}
+
+// patternVars returns the pattern variables in p
+func (m *macro) patternVars(p *stx) []string {
+	if !p.list {
+		if id, ok := p.ident(); ok && id != "_" && id != "..." && !m.literals[id] {
+			return []string{id}
+		}
+		return nil
+	}
+	var vars []string
+	for _, elem := range p.elems {
+		vars = append(vars, m.patternVars(elem)...)
+	}
+	return vars
+}
+
+// matchList matches forms against the patterns pats, one of which may be
+// followed by an ellipsis
+func (m *macro) matchList(pats, forms []*stx, b map[string]*binding) bool {
+	for i, p := range pats {
+		if i+1 < len(pats) && pats[i+1].isEllipsis() {
+			after := pats[i+2:]
+			n := len(forms) - i - len(after)
+			if n < 0 {
+				return false
+			}
+			for _, v := range m.patternVars(p) {
+				b[v] = &binding{many: true}
+			}
+			for _, form := range forms[i : i+n] {
+				inner := make(map[string]*binding)
+				if !m.match(p, form, inner) {
+					return false
+				}
+				for v, bv := range inner {
+					b[v].seq = append(b[v].seq, bv)
+				}
+			}
+			return m.matchList(after, forms[i+n:], b)
+		}
+		if i >= len(forms) || !m.match(p, forms[i], b) {
+			return false
+		}
+	}
+	return len(forms) == len(pats)
+}
+
+func (m *macro) match(p, form *stx, b map[string]*binding) bool {
+	if p.list {
+		return form.list && m.matchList(p.elems, form.elems, b)
+	}
+	id, ok := p.ident()
+	switch {
+	case !ok:
+		return !form.list && form.tok == p.tok
+	case id == "_":
+		return true
+	case m.literals[id]:
+		name, ok := form.ident()
+		return ok && name == id
+	}
+	b[id] = &binding{form: form}
+	return true
+}
+
+// instantiate builds the expansion of template t from the bindings of
+// the pattern variables. Everything else in t is marked and placed at
+// pos, or keeps its own position when pos is the zero Pos.
+func (m *macro) instantiate(t *stx, b map[string]*binding, mark int, pos Pos) (*stx, error) {
+	at := pos
+	if at == (Pos{}) {
+		at = t.pos
+	}
+	if !t.list {
+		id, ok := t.ident()
+		if bv, bound := b[id]; ok && bound {
+			if bv.many {
+				return nil, &MacroError{m.name, "missing ellipsis with pattern variable " + id + " in template"}
+			}
+			return bv.form, nil
+		}
+		return &stx{tok: t.tok, pos: at, mark: mark}, nil
+	}
+	expanded := &stx{tok: t.tok, list: true, pos: at, mark: mark}
+	for i := 0; i < len(t.elems); i++ {
+		elem := t.elems[i]
+		if i+1 >= len(t.elems) || !t.elems[i+1].isEllipsis() {
+			inst, err := m.instantiate(elem, b, mark, pos)
+			if err != nil {
+				return nil, err
+			}
+			expanded.elems = append(expanded.elems, inst)
+			continue
+		}
+		i++
+		var vars []string
+		for _, v := range m.patternVars(elem) {
+			if bv, ok := b[v]; ok && bv.many {
+				vars = append(vars, v)
+			}
+		}
+		if len(vars) == 0 {
+			return nil, &MacroError{m.name, "no pattern variables before ellipsis in template"}
+		}
+		n := len(b[vars[0]].seq)
+		for _, v := range vars[1:] {
+			if len(b[v].seq) != n {
+				return nil, &MacroError{m.name, "incompatible ellipsis match counts for template"}
+			}
+		}
+		for k := 0; k < n; k++ {
+			inner := make(map[string]*binding, len(b))
+			for v, bv := range b {
+				inner[v] = bv
+			}
+			for _, v := range vars {
+				inner[v] = b[v].seq[k]
+			}
+			inst, err := m.instantiate(elem, inner, mark, pos)
+			if err != nil {
+				return nil, err
+			}
+			expanded.elems = append(expanded.elems, inst)
+		}
+	}
+	return expanded, nil
+}
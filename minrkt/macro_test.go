@@ -0,0 +1,157 @@
+package minrkt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// expandLines is evalLines with every line parsed by x
+func expandLines(x *Expander, env *Environment, lines ...string) (interface{}, error) {
+	var result interface{}
+	for _, line := range lines {
+		prog, err := x.ParseSource(line)
+		if err != nil {
+			return nil, err
+		}
+		results, err := EvaluateProgram(prog, env)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) > 0 {
+			result = results[len(results)-1]
+		}
+	}
+	return result, nil
+}
+
+func TestMacros(t *testing.T) {
+	var tests = []struct {
+		a       []string
+		want    interface{}
+		wantErr string
+	}{
+		{[]string{"(unless #f 1)"}, 1.0, ""},
+		{[]string{"(unless #t 1)"}, nil, ""},
+		{[]string{"(when (< 1 2) 5)"}, 5.0, ""},
+		{[]string{"(define (sign n) (cond [(< n 0) (- 1)] [(= n 0) 0] [else 1]))", "(list (sign (- 5)) (sign 0) (sign 5))"}, []Value{-1.0, 0.0, 1.0}, ""},
+		{[]string{"(cond [#f 1])"}, nil, ""},
+		{[]string{"(cond)"}, nil, ""},
+		{[]string{"(define (f n) (when (< n 3) (- n 1) (* n 2) (+ n 1)))", "(f 1)"}, 2.0, ""},
+		{[]string{"(unless (< 1 0) (void) 2)"}, 2.0, ""},
+		{[]string{"(when #f (car 1) 2)"}, nil, ""},
+		{[]string{"(when #t (car 1) 2)"}, nil, "car undefined"},
+		{[]string{"(unless #f (car 1) 2)"}, nil, "car undefined"},
+		// the bindings that sequence the body do not capture the user's names
+		{[]string{"(define ignored 5)", "(when #t (void) ignored)"}, 5.0, ""},
+		{[]string{"(let* ([x 1] [y (+ x 1)]) (* x y 10))"}, 20.0, ""},
+		{[]string{"(let* () 3)"}, 3.0, ""},
+		// ellipses
+		{[]string{"(define-syntax my-let (syntax-rules () [(_ ([name val] ...) body) (let ([name val] ...) body)]))",
+			"(my-let ([a 1] [b 2]) (+ a b))"}, 3.0, ""},
+		{[]string{"(define-syntax sum (syntax-rules () [(_ x ...) (+ 0 x ...)]))", "(sum)", "(sum 1 2 3)"}, 6.0, ""},
+		{[]string{"(define-syntax rev (syntax-rules () [(_ a b ... z) (list z b ... a)]))", "(rev 1 2 3 4)"}, []Value{4.0, 2.0, 3.0, 1.0}, ""},
+		// literals
+		{[]string{"(define-syntax span (syntax-rules (to) [(_ a to b) (- b a)]))", "(span 1 to 5)"}, 4.0, ""},
+		{[]string{"(define-syntax span (syntax-rules (to) [(_ a to b) (- b a)]))", "(span 1 from 5)"}, nil, "1:1: span: bad syntax"},
+		// hygiene: the macro's binding does not capture the argument...
+		{[]string{"(define-syntax my-or (syntax-rules () [(_ a b) (let ([t a]) (if t t b))]))", "(define t #t)", "(my-or #f t)"}, "#t", ""},
+		{[]string{"(define-syntax define-adder (syntax-rules () [(_ name e) (define (name x) (+ x e))]))",
+			"(define x 10)", "(define-adder add-x x)", "(add-x 1)"}, 11.0, ""},
+		// ...and the user's binding does not capture the macro's global
+		{[]string{"(define one 1)", "(define-syntax inc (syntax-rules () [(_ e) (+ e one)]))",
+			"(define (g one) (inc one))", "(g 5)"}, 6.0, ""},
+		{[]string{"(define-syntax inc (syntax-rules () [(_ e) (+ e one)]))", "(define one 1)", "(let ([one 5]) (inc one))"}, 6.0, ""},
+		// a helper the template defines keeps its name inside the template
+		{[]string{"(define-syntax count-down (syntax-rules () [(_ n) (define (loop k) (if (= k 0) n (loop (- k 1))))]))",
+			"(count-down 7)", "(loop 3)"}, nil, "loop undefined"},
+		// macros may use macros, including themselves
+		{[]string{"(define-syntax my-and (syntax-rules () [(_) #t] [(_ e) e] [(_ e r ...) (if e (my-and r ...) #f)]))",
+			"(my-and #t #t (< 1 2))"}, "#t", ""},
+		// a definition replaces a macro of the same name
+		{[]string{"(define (when a b) (+ a b))", "(when 1 2)"}, 3.0, ""},
+		{[]string{"(unless)"}, nil, "1:1: unless: bad syntax"},
+		{[]string{"(define-syntax 5 (syntax-rules ()))"}, nil, "1:1: define-syntax: bad syntax"},
+		{[]string{"(define-syntax m (rules))"}, nil, "1:18: syntax-rules: bad syntax"},
+		{[]string{"(+ 1 (define-syntax m (syntax-rules ())))"}, nil, "1:6: define-syntax: only allowed at the top level"},
+		{[]string{"(define-syntax forever (syntax-rules () [(_) (forever)]))", "(forever)"}, nil, "1:1: forever: expansion limit exceeded"},
+		{[]string{"(define-syntax flat (syntax-rules () [(_ x ...) (list x)]))", "(flat 1 2)"}, nil, "1:1: flat: missing ellipsis with pattern variable x in template"},
+		{[]string{"(define-syntax bad (syntax-rules () [(_ x) (list x ...)]))", "(bad 1)"}, nil, "1:1: bad: no pattern variables before ellipsis in template"},
+		{[]string{"(define-syntax zip (syntax-rules () [(_ (a ...) (b ...)) (list (+ a b) ...)]))", "(zip (1 2) (3 4))"}, []Value{4.0, 6.0}, ""},
+		{[]string{"(define-syntax zip (syntax-rules () [(_ (a ...) (b ...)) (list (+ a b) ...)]))", "(zip (1 2) (3))"}, nil, "1:1: zip: incompatible ellipsis match counts for template"},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", strings.Join(tt.a, " "))
+		t.Run(testname, func(t *testing.T) {
+			got, err := expandLines(NewStandardExpander(), newTestEnv(), tt.a...)
+			if fmt.Sprint(err) != fmt.Sprint(tt.wantErr) && !(err == nil && tt.wantErr == "") {
+				t.Fatalf("got error %v, want %s", err, tt.wantErr)
+			}
+			if err == nil && fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMacroExpansion(t *testing.T) {
+	var tests = []struct {
+		a    string
+		want string
+	}{
+		{"(unless (< x 1) (f x))", "(if (< x 1) (void) (f x))"},
+		{"(when t (f 1) (f 2) 3)", "(if t (let ([ignored.2 (f 1)]) (let ([ignored.1 (f 2)]) (let () 3))) (void))"},
+		{"(let* ([a 1] [b a]) b)", "(let ([a 1]) (let ([b a]) (let () b)))"},
+		{"(define-syntax my-or (syntax-rules () [(_ a b) (let ([t a]) (if t t b))]))\n(my-or t #f)", "(let ([t.1 t]) (if t.1 t.1 #f))"},
+		{"(define (f x) (+ x 1))", "(define (f x) (+ x 1))"},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			prog, err := NewStandardExpander().ParseSource(tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := unparse(prog.Forms[len(prog.Forms)-1]); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMacroPositions(t *testing.T) {
+	x := NewStandardExpander()
+	prog, err := x.ParseSource("(define y 1)\n  (unless #f\n    (+ y #t))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := prog.Forms[1]
+	if got, want := prog.Positions[form], (Pos{2, 3}); got != want {
+		t.Errorf("expansion at %v, want %v", got, want)
+	}
+	// the argument keeps its own position
+	arg := form.(*expOperator).operands[2]
+	if got, want := prog.Positions[arg], (Pos{3, 5}); got != want {
+		t.Errorf("argument at %v, want %v", got, want)
+	}
+}
+
+func TestExpanderRemembersMacros(t *testing.T) {
+	x := NewExpander()
+	if _, err := x.ParseSource("(define-syntax two (syntax-rules () [(_) 2]))"); err != nil {
+		t.Fatal(err)
+	}
+	// a source with an error defines nothing
+	if _, err := x.ParseSource("(define-syntax three (syntax-rules () [(_) 3]))\n(two 1)"); err == nil {
+		t.Fatal("want an error for (two 1)")
+	}
+	got, err := expandLines(x, newTestEnv(), "(+ (two) 1)")
+	if err != nil || got != 3.0 {
+		t.Errorf("got %v %v, want 3", got, err)
+	}
+	if _, ok := x.macros["three"]; ok {
+		t.Error("three was defined by a source with an error")
+	}
+}
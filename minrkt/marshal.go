@@ -0,0 +1,372 @@
+package minrkt
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// ConversionError reports a value that cannot be converted between
+// MiniRacket and Go
+type ConversionError struct {
+	// the value converted, or its reflect.Type when it cannot be printed
+	Value  Value
+	Type   reflect.Type // the Go type converted to, nil for a MiniRacket value
+	Reason string
+}
+
+func (e *ConversionError) Error() string {
+	target := "a MiniRacket value"
+	if e.Type != nil {
+		target = e.Type.String()
+	}
+	from := showValue(e.Value)
+	if t, ok := e.Value.(reflect.Type); ok {
+		from = "a " + t.String()
+	}
+	if e.Reason != "" {
+		return fmt.Sprintf("cannot convert %s to %s: %s", from, target, e.Reason)
+	}
+	return fmt.Sprintf("cannot convert %s to %s", from, target)
+}
+
+var (
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	valueType = reflect.TypeOf((*Value)(nil)).Elem()
+	exnType   = reflect.TypeOf(&Exn{})
+)
+
+// DefineGoFunc exposes an arbitrary Go function to scripts as name.
+// Arguments are converted to the function's parameter types with the
+// rules of Get and results are converted back. The function may return
+// nothing, one value, an error, or a value and an error.
+func (env *Environment) DefineGoFunc(name string, fn interface{}) error {
+	fnVal := reflect.ValueOf(fn)
+	fnType := fnVal.Type()
+	if fnType.Kind() != reflect.Func {
+		return fmt.Errorf("DefineGoFunc %s: %v is not a function", name, fnType)
+	}
+	numOut := fnType.NumOut()
+	if numOut > 2 || (numOut == 2 && fnType.Out(1) != errorType) {
+		return fmt.Errorf("DefineGoFunc %s: %v must return at most a value and an error", name, fnType)
+	}
+	for i := 0; i < fnType.NumIn(); i++ {
+		if err := checkGoType(fnType.In(i), make(map[reflect.Type]bool)); err != nil {
+			return fmt.Errorf("DefineGoFunc %s: parameter %d: %w", name, i+1, err)
+		}
+	}
+	arity := fnType.NumIn()
+	if fnType.IsVariadic() {
+		arity = AtLeast(arity - 1)
+	}
+	env.DefineBuiltin(name, arity, func(args []Value) (result Value, err error) {
+		// a panic in fn fails the call instead of the host
+		defer func() {
+			if p := recover(); p != nil {
+				result, err = nil, &HostError{name, fmt.Errorf("panic: %v", p)}
+			}
+		}()
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			paramType := paramTypeAt(fnType, i)
+			goArg := reflect.New(paramType).Elem()
+			if err := toGo(arg, goArg); err != nil {
+				return nil, err
+			}
+			in[i] = goArg
+		}
+		out := fnVal.Call(in)
+		if numOut > 0 && fnType.Out(numOut-1) == errorType {
+			if err, _ := out[numOut-1].Interface().(error); err != nil {
+				return nil, err
+			}
+			out = out[:numOut-1]
+		}
+		if len(out) == 0 {
+			return nil, nil
+		}
+		return fromGo(out[0])
+	})
+	return nil
+}
+
+// paramTypeAt is the type of the i-th argument, including the element
+// type of a variadic parameter
+func paramTypeAt(fnType reflect.Type, i int) reflect.Type {
+	last := fnType.NumIn() - 1
+	if fnType.IsVariadic() && i >= last {
+		return fnType.In(last).Elem()
+	}
+	return fnType.In(i)
+}
+
+// checkGoType rejects parameter types no MiniRacket value converts to.
+// seen holds the types already being checked, so a recursive type such
+// as a linked list node is checked once.
+func checkGoType(t reflect.Type, seen map[reflect.Type]bool) error {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return nil
+	case reflect.Interface:
+		if t == valueType {
+			return nil
+		}
+	case reflect.Slice, reflect.Ptr:
+		return checkGoType(t.Elem(), seen)
+	case reflect.Map:
+		if t.Key().Kind() == reflect.String {
+			return checkGoType(t.Elem(), seen)
+		}
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if field := t.Field(i); field.IsExported() {
+				if err := checkGoType(field.Type, seen); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported Go type %v", t)
+}
+
+// Get converts the global variable name into the Go variable target
+// points to. Numbers convert to any integer or float type (integers must
+// be whole and in range), lists to slices, and hash tables to maps with
+// string keys or to structs, matching keys to field names or to a
+// `minrkt:"key"` tag.
+func (env *Environment) Get(name string, target interface{}) error {
+	ptr := reflect.ValueOf(target)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return fmt.Errorf("Get %s: target must be a non-nil pointer, not %T", name, target)
+	}
+	val, ok := env.lookupVariable(name)
+	if !ok {
+		return &UndefinedError{name}
+	}
+	return toGo(val, ptr.Elem())
+}
+
+// toGo stores the Go form of val in dst
+func toGo(val Value, dst reflect.Value) error {
+	t := dst.Type()
+	fail := func(reason string) error {
+		return &ConversionError{hostValue(val), t, reason}
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		if t != valueType {
+			return fail("unsupported Go type")
+		}
+		if val != nil {
+			dst.Set(reflect.ValueOf(hostValue(val)))
+		}
+		return nil
+	case reflect.Bool:
+		b, ok := val.(bool)
+		if !ok {
+			return fail("")
+		}
+		dst.SetBool(b)
+	case reflect.String:
+		str, ok := val.(string)
+		if !ok {
+			return fail("")
+		}
+		dst.SetString(str)
+	case reflect.Float32, reflect.Float64:
+		num, ok := toFloat(val)
+		if !ok {
+			return fail("")
+		}
+		dst.SetFloat(num)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		num, ok := toFloat(val)
+		if !ok {
+			return fail("")
+		}
+		if num != math.Trunc(num) {
+			return fail("not an integer")
+		}
+		if num < math.MinInt64 || num >= math.MaxInt64 || dst.OverflowInt(int64(num)) {
+			return fail("out of range")
+		}
+		dst.SetInt(int64(num))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		num, ok := toFloat(val)
+		if !ok {
+			return fail("")
+		}
+		if num != math.Trunc(num) {
+			return fail("not an integer")
+		}
+		if num < 0 || num >= math.MaxUint64 || dst.OverflowUint(uint64(num)) {
+			return fail("out of range")
+		}
+		dst.SetUint(uint64(num))
+	case reflect.Slice:
+		lst, ok := val.([]Value)
+		if !ok {
+			return fail("")
+		}
+		slice := reflect.MakeSlice(t, len(lst), len(lst))
+		for i, elem := range lst {
+			if err := toGo(elem, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		dst.Set(slice)
+	case reflect.Map:
+		table, ok := val.(map[string]Value)
+		if !ok || t.Key().Kind() != reflect.String {
+			return fail("")
+		}
+		m := reflect.MakeMapWithSize(t, len(table))
+		for key, elem := range table {
+			goElem := reflect.New(t.Elem()).Elem()
+			if err := toGo(elem, goElem); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key).Convert(t.Key()), goElem)
+		}
+		dst.Set(m)
+	case reflect.Struct:
+		table, ok := val.(map[string]Value)
+		if !ok {
+			return fail("")
+		}
+		fields := structFields(t)
+		for key, elem := range table {
+			i, ok := fields[key]
+			if !ok {
+				return fail("no field for key " + showValue(key))
+			}
+			if err := toGo(elem, dst.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		elem := reflect.New(t.Elem())
+		if err := toGo(val, elem.Elem()); err != nil {
+			return err
+		}
+		dst.Set(elem)
+	default:
+		return fail("unsupported Go type")
+	}
+	return nil
+}
+
+// fromGo converts a Go value into a MiniRacket value
+func fromGo(src reflect.Value) (Value, error) {
+	return fromGoPath(src, make(map[goRef]bool))
+}
+
+// goRef identifies a pointer, map or slice by its address and type
+type goRef struct {
+	ptr uintptr
+	t   reflect.Type
+}
+
+// fromGoPath is fromGo, where path holds the pointers, maps and slices
+// being converted around src. MiniRacket values cannot be cyclic, so
+// meeting one of them again is an error.
+func fromGoPath(src reflect.Value, path map[goRef]bool) (Value, error) {
+	fail := func(reason string) (Value, error) {
+		return nil, &ConversionError{src.Interface(), nil, reason}
+	}
+	if src.Type() == exnType {
+		return src.Interface(), nil
+	}
+	switch src.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if !src.IsNil() {
+			ref := goRef{src.Pointer(), src.Type()}
+			if path[ref] {
+				return nil, &ConversionError{src.Type(), nil, "cyclic value"}
+			}
+			path[ref] = true
+			defer delete(path, ref)
+		}
+	}
+	switch src.Kind() {
+	case reflect.Bool:
+		return src.Bool(), nil
+	case reflect.String:
+		return src.String(), nil
+	case reflect.Float32, reflect.Float64:
+		return src.Float(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(src.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(src.Uint()), nil
+	case reflect.Slice, reflect.Array:
+		if src.Kind() == reflect.Slice && src.IsNil() {
+			return []Value{}, nil
+		}
+		lst := make([]Value, src.Len())
+		for i := range lst {
+			elem, err := fromGoPath(src.Index(i), path)
+			if err != nil {
+				return nil, err
+			}
+			lst[i] = elem
+		}
+		return lst, nil
+	case reflect.Map:
+		if src.Type().Key().Kind() != reflect.String {
+			return fail("map keys must be strings")
+		}
+		table := make(map[string]Value, src.Len())
+		iter := src.MapRange()
+		for iter.Next() {
+			elem, err := fromGoPath(iter.Value(), path)
+			if err != nil {
+				return nil, err
+			}
+			table[iter.Key().String()] = elem
+		}
+		return table, nil
+	case reflect.Struct:
+		table := make(map[string]Value)
+		for key, i := range structFields(src.Type()) {
+			elem, err := fromGoPath(src.Field(i), path)
+			if err != nil {
+				return nil, err
+			}
+			table[key] = elem
+		}
+		return table, nil
+	case reflect.Ptr, reflect.Interface:
+		if src.IsNil() {
+			return nil, nil
+		}
+		return fromGoPath(src.Elem(), path)
+	}
+	return fail("unsupported Go type")
+}
+
+// structFields maps the hash table key of each exported field of t to its
+// index
+func structFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		key := field.Name
+		if tag := field.Tag.Get("minrkt"); tag != "" {
+			key = strings.Split(tag, ",")[0]
+		}
+		fields[key] = i
+	}
+	return fields
+}
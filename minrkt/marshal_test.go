@@ -0,0 +1,246 @@
+package minrkt
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type point struct {
+	X     int
+	Y     int
+	Label string `minrkt:"label"`
+	notes string
+}
+
+// node is a recursive type, which DefineGoFunc must not loop on
+type node struct {
+	Val  float64
+	Next *node
+}
+
+func newGoFuncTestEnv(t *testing.T) *Environment {
+	env := newTestEnv()
+	funcs := map[string]interface{}{
+		"add-ints": func(a, b int) int { return a + b },
+		"halve":    func(x float64) float64 { return x / 2 },
+		"shout":    func(s string) string { return strings.ToUpper(s) + "!" },
+		"negate":   func(b bool) bool { return !b },
+		"sum": func(xs ...int) int {
+			n := 0
+			for _, x := range xs {
+				n += x
+			}
+			return n
+		},
+		"words":   func(s string) []string { return strings.Fields(s) },
+		"join":    func(parts []string, sep string) string { return strings.Join(parts, sep) },
+		"make-pt": func(x, y int) point { return point{X: x, Y: y, Label: "p"} },
+		"pt-x":    func(p point) int { return p.X },
+		"counts":  func(s string) map[string]int { return map[string]int{"len": len(s)} },
+		"checked": func(n int) (int, error) {
+			if n < 0 {
+				return 0, errors.New("negative")
+			}
+			return n, nil
+		},
+		"nothing":   func() {},
+		"ptr-point": func(p *point) string { return p.Label },
+		"explode":   func() int { panic("boom") },
+		"node-sum": func(n *node) float64 {
+			sum := 0.0
+			for ; n != nil; n = n.Next {
+				sum += n.Val
+			}
+			return sum
+		},
+		"make-ring": func() *node {
+			n := &node{Val: 1}
+			n.Next = &node{Val: 2, Next: n}
+			return n
+		},
+		"make-loop": func() map[string]interface{} {
+			m := map[string]interface{}{}
+			m["self"] = m
+			return m
+		},
+	}
+	for name, fn := range funcs {
+		if err := env.DefineGoFunc(name, fn); err != nil {
+			t.Fatalf("DefineGoFunc(%s): %v", name, err)
+		}
+	}
+	return env
+}
+
+func TestDefineGoFunc(t *testing.T) {
+	var tests = []struct {
+		a    string
+		want interface{}
+	}{
+		{"(add-ints 2 3)", 5.0},
+		{"(halve 5)", 2.5},
+		{`(shout "hi")`, "HI!"},
+		{"(negate #f)", "#t"},
+		{"(sum)", 0.0},
+		{"(sum 1 2 3)", 6.0},
+		{`(length (words "a b c"))`, 3.0},
+		{`(first (words "a b c"))`, "a"},
+		{`(join (list "x" "y") "-")`, "x-y"},
+		{"(hash-ref (make-pt 1 2) \"X\")", 1.0},
+		{"(hash-ref (make-pt 1 2) \"label\")", "p"},
+		{"(pt-x (make-pt 7 2))", 7.0},
+		{`(pt-x (hash "X" 4))`, 4.0},
+		{`(ptr-point (hash "label" "q"))`, "q"},
+		{`(hash-ref (counts "abcd") "len")`, 4.0},
+		{`(node-sum (hash "Val" 1 "Next" (hash "Val" 2)))`, 3.0},
+		{"(with-handlers ([exn:fail? exn-message]) (explode))", "explode: panic: boom"},
+		{"(with-handlers ([exn:fail:contract? exn-message]) (make-ring))", "cannot convert a *minrkt.node to a MiniRacket value: cyclic value"},
+		{"(with-handlers ([exn:fail:contract? exn-message]) (make-loop))", "cannot convert a map[string]interface {} to a MiniRacket value: cyclic value"},
+		{"(checked 3)", 3.0},
+		{"(nothing)", nil},
+		{"(with-handlers ([exn:fail? exn-message]) (checked (- 1)))", "checked: negative"},
+		{"(with-handlers ([exn:fail:contract? exn-message]) (add-ints 1.5 2))", "cannot convert 1.5 to int: not an integer"},
+		{"(with-handlers ([exn:fail:contract? exn-message]) (shout 1))", "cannot convert 1 to string"},
+		{`(with-handlers ([exn:fail:contract? exn-message]) (pt-x (hash "Z" 1)))`, `cannot convert '#hash(("Z" . 1)) to minrkt.point: no field for key "Z"`},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			got, err := evalLines(newGoFuncTestEnv(t), tt.a)
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefineGoFuncRejects(t *testing.T) {
+	env := newTestEnv()
+	var tests = []struct {
+		fn      interface{}
+		wantErr string
+	}{
+		{42, "DefineGoFunc f: int is not a function"},
+		{func(c chan int) {}, "DefineGoFunc f: parameter 1: unsupported Go type chan int"},
+		{func(m map[int]string) {}, "DefineGoFunc f: parameter 1: unsupported Go type map[int]string"},
+		{func() (int, int) { return 0, 0 }, "DefineGoFunc f: func() (int, int) must return at most a value and an error"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%T", tt.fn)
+		t.Run(testname, func(t *testing.T) {
+			err := env.DefineGoFunc("f", tt.fn)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnvironmentGet(t *testing.T) {
+	env := newGoFuncTestEnv(t)
+	_, err := evalLines(env,
+		"(define n 42)",
+		"(define f 2.5)",
+		`(define s "str")`,
+		"(define b #t)",
+		"(define xs (list 1 2 3))",
+		`(define pt (hash "X" 1 "Y" 2 "label" "origin"))`,
+		`(define nested (list (hash "X" 5) (hash "Y" 6)))`)
+	if err != nil {
+		t.Fatalf("evalLines(): %v", err)
+	}
+	var n int
+	var u8 uint8
+	var f float64
+	var s string
+	var b bool
+	var xs []int
+	var pt point
+	var m map[string]interface{}
+	var pts []point
+	var any Value
+	var tests = []struct {
+		name   string
+		target interface{}
+		want   interface{}
+	}{
+		{"n", &n, 42},
+		{"n", &u8, uint8(42)},
+		{"f", &f, 2.5},
+		{"s", &s, "str"},
+		{"b", &b, true},
+		{"xs", &xs, []int{1, 2, 3}},
+		{"pt", &pt, point{X: 1, Y: 2, Label: "origin"}},
+		{"pt", &m, map[string]interface{}{"X": 1.0, "Y": 2.0, "label": "origin"}},
+		{"nested", &pts, []point{{X: 5}, {Y: 6}}},
+		{"xs", &any, []Value{1.0, 2.0, 3.0}},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s %T", tt.name, tt.target)
+		t.Run(testname, func(t *testing.T) {
+			err := env.Get(tt.name, tt.target)
+			got := reflect.ValueOf(tt.target).Elem().Interface()
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvironmentGetErrors(t *testing.T) {
+	env := newTestEnv()
+	if _, err := evalLines(env, "(define f 2.5)", "(define big 300)", `(define s "x")`); err != nil {
+		t.Fatalf("evalLines(): %v", err)
+	}
+	var n int
+	var u8 uint8
+	var b bool
+	var ch chan int
+	var tests = []struct {
+		name    string
+		target  interface{}
+		wantErr string
+	}{
+		{"f", &n, "cannot convert 2.5 to int: not an integer"},
+		{"big", &u8, "cannot convert 300 to uint8: out of range"},
+		{"s", &b, `cannot convert "x" to bool`},
+		{"s", &ch, `cannot convert "x" to chan int: unsupported Go type`},
+		{"missing", &n, "missing undefined"},
+		{"f", n, "Get f: target must be a non-nil pointer, not int"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s %T", tt.name, tt.target)
+		t.Run(testname, func(t *testing.T) {
+			err := env.Get(tt.name, tt.target)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+	var convErr *ConversionError
+	if err := env.Get("f", &n); !errors.As(err, &convErr) || convErr.Type != reflect.TypeOf(n) {
+		t.Errorf("got %v, want *ConversionError to int", err)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	var tests = []struct {
+		a    Value
+		want string
+	}{
+		{"str", "str"},
+		{[]Value{1.0, "a", true, []Value{}}, `'(1 "a" #t ())`},
+		{map[string]Value{"b": 2.0, "a": []Value{1.0}}, `'#hash(("a" . (1)) ("b" . 2))`},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%v", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			if got := FormatValue(tt.a); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
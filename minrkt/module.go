@@ -0,0 +1,695 @@
+package minrkt
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ModuleError is an error loading or instantiating a module
+type ModuleError struct {
+	Module string
+	Err    error
+}
+
+func (e *ModuleError) Error() string {
+	return e.Module + ": " + e.Err.Error()
+}
+
+func (e *ModuleError) Unwrap() error {
+	return e.Err
+}
+
+// CycleError reports modules that require each other, from the first
+// module of the cycle back to itself
+type CycleError struct {
+	Modules []string
+}
+
+func (e *CycleError) Error() string {
+	return "require: cycle in loading modules: " + strings.Join(e.Modules, " -> ")
+}
+
+// moduleCache holds the modules required by an Environment, by the
+// modules it requires, and by its forks, so each is instantiated once
+type moduleCache struct {
+	// how the environment of each module is built
+	config envConfig
+	// held by a require at the top level; requires inside a module run
+	// while their top-level require holds it
+	mu sync.Mutex
+	// instantiated modules by key: the absolute path of a file, or
+	// 'name for a module declared with (module name ...)
+	instances map[string]*moduleInstance
+	declared  map[string]*moduleDecl
+}
+
+func newModuleCache(config envConfig) *moduleCache {
+	return &moduleCache{
+		config:    config,
+		instances: make(map[string]*moduleInstance),
+		declared:  make(map[string]*moduleDecl),
+	}
+}
+
+// moduleDecl is a module declared with (module name ...) and not yet
+// required
+type moduleDecl struct {
+	prog *Program
+	dir  string
+}
+
+type moduleInstance struct {
+	name    string
+	env     *Environment
+	exports []string
+}
+
+// moduleName is how errors show the module with the given key
+func moduleName(key string) string {
+	if strings.HasPrefix(key, "'") {
+		return key
+	}
+	return filepath.Base(key)
+}
+
+// requireSpec is a module path, or one of only-in, prefix-in and
+// rename-in applied to another spec
+type requireSpec struct {
+	// a file path, or the name of a declared module when declared is set
+	path     string
+	declared bool
+	form     string
+	spec     *requireSpec
+	// only-in's names; rename-in's old names, renamed to renames
+	names, renames []string
+	prefix         string
+}
+
+func (s *requireSpec) String() string {
+	switch s.form {
+	case "only-in":
+		return "(only-in " + s.spec.String() + " " + strings.Join(s.names, " ") + ")"
+	case "prefix-in":
+		return "(prefix-in " + s.prefix + " " + s.spec.String() + ")"
+	case "rename-in":
+		pairs := make([]string, len(s.names))
+		for i := range s.names {
+			pairs[i] = "[" + s.names[i] + " " + s.renames[i] + "]"
+		}
+		return "(rename-in " + s.spec.String() + " " + strings.Join(pairs, " ") + ")"
+	}
+	if s.declared {
+		return s.path
+	}
+	return strconv.Quote(s.path)
+}
+
+// module returns the module path s imports from
+func (s *requireSpec) module() *requireSpec {
+	for s.spec != nil {
+		s = s.spec
+	}
+	return s
+}
+
+// expRequire is (require spec ...). It instantiates each module the
+// specs name, if that has not happened yet, and defines the variables
+// and functions they import.
+type expRequire struct {
+	specs []*requireSpec
+}
+
+func (e *expRequire) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	imports, err := env.imports(e)
+	if err != nil {
+		return nil, inForm(err, e)
+	}
+	for _, imp := range imports {
+		if val, ok := imp.from.env.lookupVariable(imp.source); ok {
+			env.setVariable(imp.local, val)
+		}
+		if fn, ok := imp.from.env.lookupFunction(imp.source); ok {
+			if _, reexported := fn.expression.(*expImport); !reexported {
+				fn = FuncParamExpr{fn.params, &expImport{imp.from, imp.source}}
+			}
+			env.setFunction(imp.local, fn)
+		}
+	}
+	return nil, nil
+}
+
+func (e *expRequire) String() string {
+	specs := make([]string, len(e.specs))
+	for i, spec := range e.specs {
+		specs[i] = spec.String()
+	}
+	return "(require " + strings.Join(specs, " ") + ")"
+}
+
+// expProvide is (provide name ...), where (all-defined-out) stands for
+// every name the module defines. It does nothing when evaluated; the
+// module's exports are read from it once the module has run.
+type expProvide struct {
+	names []string
+	all   bool
+}
+
+func (e *expProvide) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (e *expProvide) String() string {
+	specs := append([]string(nil), e.names...)
+	if e.all {
+		specs = append(specs, "(all-defined-out)")
+	}
+	return "(provide " + strings.Join(specs, " ") + ")"
+}
+
+// expModule is (module name language form ...). It declares a module
+// that (require name) instantiates. The language is not checked; every
+// module is MiniRacket.
+type expModule struct {
+	name, lang string
+	forms      []Exp
+}
+
+func (e *expModule) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	g := env.globals()
+	if g.modules == nil {
+		return nil, inForm(&EvalError{"module: modules are not available in this environment"}, e)
+	}
+	defer g.enterModules()()
+	prog := &Program{Forms: e.forms, Positions: make(map[Exp]Pos)}
+	for _, form := range e.forms {
+		walkExp(form, func(exp Exp) {
+			if pos, ok := env.positions[exp]; ok {
+				prog.Positions[exp] = pos
+			}
+		})
+	}
+	g.modules.declared[e.name] = &moduleDecl{prog, g.dir}
+	delete(g.modules.instances, "'"+e.name)
+	return nil, nil
+}
+
+func (e *expModule) String() string {
+	forms := []string{"module", e.name, e.lang}
+	for _, form := range e.forms {
+		forms = append(forms, unparse(form))
+	}
+	return "(" + strings.Join(forms, " ") + ")"
+}
+
+// expImport is the body of a function imported from a module. It runs
+// the module's function with the caller's arguments and limits but the
+// module's own definitions.
+type expImport struct {
+	from *moduleInstance
+	name string
+}
+
+func (e *expImport) Eval(env *Environment) (interface{}, error) {
+	fn, ok := e.from.env.lookupFunction(e.name)
+	if !ok {
+		return nil, &UndefinedError{e.name}
+	}
+	inner := &Environment{
+		CallStack: env.CallStack,
+		frames:    env.frames,
+		limits:    env.limits,
+		tests:     env.tests,
+		positions: e.from.env.sourceOf(fn.expression),
+		root:      e.from.env.globals(),
+	}
+	return fn.expression.Eval(inner)
+}
+
+func (e *expImport) String() string {
+	return "(" + e.name + " from " + e.from.name + ")"
+}
+
+// enterModules locks env's module cache unless env belongs to a module,
+// whose require already holds it, and returns the matching unlock
+func (env *Environment) enterModules() func() {
+	if len(env.loading) > 0 {
+		return func() {}
+	}
+	env.modules.mu.Lock()
+	return env.modules.mu.Unlock
+}
+
+type importedName struct {
+	local, source string
+	// the instance the name comes from, or nil when the static passes
+	// read it, which record whether it is a function instead
+	from     *moduleInstance
+	function bool
+}
+
+// imports instantiates the modules e requires and lists the names it
+// imports from them
+func (env *Environment) imports(e *expRequire) ([]importedName, error) {
+	g := env.globals()
+	if g.modules == nil {
+		return nil, &EvalError{"require: modules are not available in this environment"}
+	}
+	defer g.enterModules()()
+	instantiated := func(spec *requireSpec) ([]importedName, error) {
+		m, err := g.instantiate(env, spec)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]importedName, len(m.exports))
+		for i, name := range m.exports {
+			names[i] = importedName{local: name, source: name, from: m}
+		}
+		return names, nil
+	}
+	var imports []importedName
+	for _, spec := range e.specs {
+		names, err := importSpec(spec, instantiated)
+		if err != nil {
+			return nil, err
+		}
+		imports = append(imports, names...)
+	}
+	return imports, nil
+}
+
+// importSpec lists the names spec imports, given the exports of each
+// module as listed by exported
+func importSpec(spec *requireSpec, exported func(*requireSpec) ([]importedName, error)) ([]importedName, error) {
+	if spec.form == "" {
+		return exported(spec)
+	}
+	inner, err := importSpec(spec.spec, exported)
+	if err != nil {
+		return nil, err
+	}
+	find := func(name string) (importedName, error) {
+		for _, imp := range inner {
+			if imp.local == name {
+				return imp, nil
+			}
+		}
+		module := spec.module()
+		return importedName{}, &EvalError{spec.form + ": " + name + " is not provided by " + module.String()}
+	}
+	var names []importedName
+	switch spec.form {
+	case "only-in":
+		for _, name := range spec.names {
+			imp, err := find(name)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, imp)
+		}
+	case "prefix-in":
+		for _, imp := range inner {
+			imp.local = spec.prefix + imp.local
+			names = append(names, imp)
+		}
+	case "rename-in":
+		names = append(names, inner...)
+		for i, name := range spec.names {
+			if _, err := find(name); err != nil {
+				return nil, err
+			}
+			for j := range inner {
+				if inner[j].local == name {
+					names[j].local = spec.renames[i]
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+// instantiate returns the module spec names, running it first if no
+// earlier require did. Its top-level forms are evaluated with the
+// limits of caller.
+func (g *Environment) instantiate(caller *Environment, spec *requireSpec) (*moduleInstance, error) {
+	key, err := g.moduleKey(spec)
+	if err != nil {
+		return nil, err
+	}
+	for i, loading := range g.loading {
+		if loading == key {
+			var cycle []string
+			for _, k := range append(g.loading[i:], key) {
+				cycle = append(cycle, moduleName(k))
+			}
+			return nil, &CycleError{cycle}
+		}
+	}
+	c := g.modules
+	if m, ok := c.instances[key]; ok {
+		return m, nil
+	}
+	name := moduleName(key)
+	prog, dir, err := g.moduleSource(spec, key)
+	if err != nil {
+		return nil, err
+	}
+	env, err := newEnvironment(c.config, nil)
+	if err != nil {
+		return nil, &ModuleError{name, err}
+	}
+	env.modules, env.dir = c, dir
+	env.loading = append(append([]string(nil), g.loading...), key)
+	run := env
+	if caller.limits != nil {
+		run = &Environment{CallStack: make([]map[string]interface{}, 0), limits: caller.limits, root: env}
+	}
+	if _, err := EvaluateProgram(prog, run); err != nil {
+		var cycle *CycleError
+		if errors.As(err, &cycle) {
+			return nil, err
+		}
+		return nil, &ModuleError{name, err}
+	}
+	m := &moduleInstance{name: name, env: env}
+	if m.exports, err = exports(prog, env); err != nil {
+		return nil, &ModuleError{name, err}
+	}
+	c.instances[key] = m
+	return m, nil
+}
+
+// moduleKey is the key of the module spec names in the module cache
+func (g *Environment) moduleKey(spec *requireSpec) (string, error) {
+	if spec.declared {
+		return "'" + spec.path, nil
+	}
+	path := spec.path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(g.dir, path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", &ModuleError{spec.path, err}
+	}
+	return abs, nil
+}
+
+// moduleSource parses the module with the given key and returns it with
+// the directory its own requires are relative to
+func (g *Environment) moduleSource(spec *requireSpec, key string) (*Program, string, error) {
+	name := moduleName(key)
+	if spec.declared {
+		decl, ok := g.modules.declared[spec.path]
+		if !ok {
+			return nil, "", &EvalError{"require: unknown module " + name}
+		}
+		return decl.prog, decl.dir, nil
+	}
+	src, err := os.ReadFile(key)
+	if err != nil {
+		// the module's name is enough, without the absolute path
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return nil, "", &ModuleError{name, err}
+	}
+	prog, err := NewStandardExpander().ParseSource(string(src))
+	if err != nil {
+		return nil, "", &ModuleError{name, err}
+	}
+	if len(prog.Forms) == 1 {
+		if module, ok := prog.Forms[0].(*expModule); ok {
+			prog = &Program{Forms: module.forms, Positions: prog.Positions}
+		}
+	}
+	return prog, filepath.Dir(key), nil
+}
+
+// exports lists the names the provides of prog export, in sorted order
+func exports(prog *Program, env *Environment) ([]string, error) {
+	provided := make(map[string]bool)
+	for _, form := range prog.Forms {
+		provide, ok := form.(*expProvide)
+		if !ok {
+			continue
+		}
+		for _, name := range provide.names {
+			provided[name] = true
+		}
+		if provide.all {
+			for _, form := range prog.Forms {
+				walkExp(form, func(e Exp) {
+					switch e := e.(type) {
+					case *expDefineVar:
+						provided[e.name] = true
+					case *expDefineFunc:
+						provided[e.name] = true
+					}
+				})
+			}
+		}
+	}
+	var names []string
+	for name := range provided {
+		_, isVar := env.lookupVariable(name)
+		_, isFunc := env.lookupFunction(name)
+		if !isVar && !isFunc {
+			return nil, &EvalError{"provide: " + name + " is not defined or required"}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// requiredNames lists the variables and functions e imports, for the
+// static passes. It reads the provides of each module without running
+// it. A module that cannot be read imports nothing here; the require
+// reports the error when it runs.
+func (env *Environment) requiredNames(e *expRequire) (vars, funcs []string) {
+	g := env.globals()
+	if g.modules == nil {
+		return nil, nil
+	}
+	defer g.enterModules()()
+	for _, spec := range e.specs {
+		names, err := importSpec(spec, func(spec *requireSpec) ([]importedName, error) {
+			return g.staticExports(spec, make(map[string]bool))
+		})
+		if err != nil {
+			continue
+		}
+		for _, imp := range names {
+			if imp.function {
+				funcs = append(funcs, imp.local)
+			} else {
+				vars = append(vars, imp.local)
+			}
+		}
+	}
+	return vars, funcs
+}
+
+// staticExports lists the names the module spec names provides, reading
+// them from its source. The module's definitions and its own requires
+// tell its functions from its variables; seen holds the modules being
+// read, so a require cycle ends the search instead of looping.
+func (g *Environment) staticExports(spec *requireSpec, seen map[string]bool) ([]importedName, error) {
+	key, err := g.moduleKey(spec)
+	if err != nil || seen[key] {
+		return nil, err
+	}
+	seen[key] = true
+	prog, dir, err := g.moduleSource(spec, key)
+	if err != nil {
+		return nil, err
+	}
+	// whether each name the module defines or requires is a function
+	function := make(map[string]bool)
+	module := &Environment{modules: g.modules, dir: dir}
+	for _, form := range prog.Forms {
+		if require, ok := form.(*expRequire); ok {
+			for _, spec := range require.specs {
+				names, err := importSpec(spec, func(spec *requireSpec) ([]importedName, error) {
+					return module.staticExports(spec, seen)
+				})
+				if err != nil {
+					continue
+				}
+				for _, imp := range names {
+					function[imp.local] = imp.function
+				}
+			}
+		}
+	}
+	defined := make(map[string]bool)
+	for _, form := range prog.Forms {
+		walkExp(form, func(e Exp) {
+			switch e := e.(type) {
+			case *expDefineVar:
+				function[e.name], defined[e.name] = false, true
+			case *expDefineFunc:
+				function[e.name], defined[e.name] = true, true
+			}
+		})
+	}
+	provided := make(map[string]bool)
+	for _, form := range prog.Forms {
+		if provide, ok := form.(*expProvide); ok {
+			for _, name := range provide.names {
+				provided[name] = true
+			}
+			if provide.all {
+				for name := range defined {
+					provided[name] = true
+				}
+			}
+		}
+	}
+	var names []importedName
+	for name := range provided {
+		if fn, ok := function[name]; ok {
+			names = append(names, importedName{local: name, source: name, function: fn})
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].local < names[j].local })
+	return names, nil
+}
+
+// parses the remainder of (require spec ...) after the require keyword
+func (p *parser) parseRequire(tokens []Token) ([]Token, Exp, error) {
+	var exp Exp
+	e := &expRequire{}
+	leftOver := tokens
+	for len(leftOver) > 0 && leftOver[0].tokType != TOK_RPAREN {
+		var s *stx
+		var err error
+		if s, leftOver, err = p.readDatum(leftOver); err != nil {
+			return []Token{}, exp, &ParseError{"invalid require spec"}
+		}
+		spec, ok := toRequireSpec(s)
+		if !ok {
+			return []Token{}, exp, &ParseError{"invalid require spec " + s.String()}
+		}
+		e.specs = append(e.specs, spec)
+	}
+	if len(leftOver) == 0 {
+		return []Token{}, exp, &ParseError{"missing closing )"}
+	}
+	return leftOver[1:], e, nil
+}
+
+func toRequireSpec(s *stx) (*requireSpec, bool) {
+	if !s.list {
+		if s.tok.tokType == TOK_STRING {
+			return &requireSpec{path: constantValue(buildOperandNode(s.tok)).(string)}, true
+		}
+		name, ok := s.ident()
+		return &requireSpec{path: name, declared: true}, ok
+	}
+	form := s.head()
+	if len(s.elems) < 2 {
+		return nil, false
+	}
+	spec := &requireSpec{form: form}
+	args := s.elems[2:]
+	switch form {
+	case "only-in", "rename-in":
+		var ok bool
+		if spec.spec, ok = toRequireSpec(s.elems[1]); !ok {
+			return nil, false
+		}
+	case "prefix-in":
+		var ok bool
+		if spec.prefix, ok = s.elems[1].ident(); !ok || len(args) != 1 {
+			return nil, false
+		}
+		spec.spec, ok = toRequireSpec(args[0])
+		return spec, ok
+	default:
+		return nil, false
+	}
+	for _, arg := range args {
+		if form == "only-in" {
+			name, ok := arg.ident()
+			if !ok {
+				return nil, false
+			}
+			spec.names = append(spec.names, name)
+			continue
+		}
+		if !arg.list || len(arg.elems) != 2 {
+			return nil, false
+		}
+		old, ok := arg.elems[0].ident()
+		renamed, ok2 := arg.elems[1].ident()
+		if !ok || !ok2 {
+			return nil, false
+		}
+		spec.names = append(spec.names, old)
+		spec.renames = append(spec.renames, renamed)
+	}
+	return spec, true
+}
+
+// parses the remainder of (provide spec ...) after the provide keyword
+func (p *parser) parseProvide(tokens []Token) ([]Token, Exp, error) {
+	var exp Exp
+	e := &expProvide{}
+	leftOver := tokens
+	for len(leftOver) > 0 && leftOver[0].tokType != TOK_RPAREN {
+		if isIdentifier(leftOver[0]) {
+			e.names = append(e.names, leftOver[0].val)
+			leftOver = leftOver[1:]
+			continue
+		}
+		if len(leftOver) < 3 || !isLeftParenthesis(leftOver[0]) || leftOver[1].val != "all-defined-out" || leftOver[2].tokType != TOK_RPAREN {
+			return []Token{}, exp, &ParseError{"invalid provide spec"}
+		}
+		e.all = true
+		leftOver = leftOver[3:]
+	}
+	if len(leftOver) == 0 {
+		return []Token{}, exp, &ParseError{"missing closing )"}
+	}
+	return leftOver[1:], e, nil
+}
+
+// parses the remainder of (module name language form ...) after the
+// module keyword
+func (p *parser) parseModule(tokens []Token) ([]Token, Exp, error) {
+	var exp Exp
+	if len(tokens) < 2 || !isIdentifier(tokens[0]) || !isIdentifier(tokens[1]) {
+		return []Token{}, exp, &ParseError{"module requires a name and a language"}
+	}
+	e := &expModule{name: tokens[0].val, lang: tokens[1].val}
+	leftOver := tokens[2:]
+	for len(leftOver) > 0 && leftOver[0].tokType != TOK_RPAREN {
+		var form Exp
+		var err error
+		if leftOver, form, err = p.parse(leftOver); err != nil {
+			return []Token{}, exp, err
+		}
+		e.forms = append(e.forms, form)
+	}
+	if len(leftOver) == 0 {
+		return []Token{}, exp, &ParseError{"missing closing )"}
+	}
+	return leftOver[1:], e, nil
+}
@@ -0,0 +1,282 @@
+package minrkt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeModules creates the files of a test in a new directory
+func writeModules(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+var testModules = map[string]string{
+	"math.rkt":     "#lang racket\n(provide square pi)\n(define pi 3)\n(define (square x) (* x x))\n(define (secret) 42)",
+	"area.rkt":     "(module area racket\n  (require \"math.rkt\")\n  (provide area)\n  (define (area r) (* pi (square r))))",
+	"all.rkt":      "(provide (all-defined-out))\n(define (inc x) (+ x 1))\n(define (helper x) (inc (inc x)))",
+	"lib/a.rkt":    "(require \"b.rkt\")\n(provide a)\n(define a (+ b 1))",
+	"lib/b.rkt":    "(provide b)\n(define b 10)",
+	"cycle1.rkt":   "(require \"cycle2.rkt\")",
+	"cycle2.rkt":   "(require \"cycle1.rkt\")",
+	"self.rkt":     "(require \"self.rkt\")",
+	"loud.rkt":     "(provide x)\n(displayln \"loading\")\n(define x 1)",
+	"uses1.rkt":    "(require \"loud.rkt\")\n(provide y)\n(define y (+ x 1))",
+	"uses2.rkt":    "(require \"loud.rkt\")\n(provide z)\n(define z (+ x 2))",
+	"bad.rkt":      "(provide nothing)",
+	"broken.rkt":   "(provide f)\n(define (f x) (+ x undefined-thing))\n(f 1)",
+	"reexport.rkt": "(require \"math.rkt\")\n(provide square)",
+	"macros.rkt":   "(define-syntax twice (syntax-rules () [(_ e) (+ e e)]))\n(provide four)\n(define four (twice 2))",
+}
+
+func TestRequire(t *testing.T) {
+	var tests = []struct {
+		a       []string
+		want    interface{}
+		wantErr string
+	}{
+		{[]string{"(require \"math.rkt\")", "(list (square 4) pi)"}, []Value{16.0, 3.0}, ""},
+		// unexported definitions stay private, but exported functions
+		// still see them
+		{[]string{"(require \"math.rkt\")", "(secret)"}, nil, "secret undefined"},
+		{[]string{"(require \"area.rkt\")", "(area 2)"}, 12.0, ""},
+		{[]string{"(require \"area.rkt\")", "pi"}, nil, "pi undefined"},
+		{[]string{"(require \"all.rkt\")", "(helper 1)"}, 3.0, ""},
+		{[]string{"(require \"lib/a.rkt\")", "a"}, 11.0, ""},
+		{[]string{"(require \"reexport.rkt\")", "(square 3)"}, 9.0, ""},
+		{[]string{"(require \"macros.rkt\")", "four"}, 4.0, ""},
+		// the names in the requiring module win after they are defined
+		{[]string{"(require \"math.rkt\")", "(define pi 4)", "pi"}, 4.0, ""},
+		// only-in, prefix-in and rename-in
+		{[]string{"(require (only-in \"math.rkt\" square))", "(square 5)"}, 25.0, ""},
+		{[]string{"(require (only-in \"math.rkt\" square))", "pi"}, nil, "pi undefined"},
+		{[]string{"(require (only-in \"math.rkt\" secret))"}, nil, "only-in: secret is not provided by \"math.rkt\""},
+		{[]string{"(require (prefix-in m: \"math.rkt\"))", "(m:square m:pi)"}, 9.0, ""},
+		{[]string{"(require (prefix-in m: \"math.rkt\"))", "(square 2)"}, nil, "square undefined"},
+		{[]string{"(require (rename-in \"math.rkt\" [square sq] [pi tau]))", "(list (sq 2) tau)"}, []Value{4.0, 3.0}, ""},
+		{[]string{"(require (rename-in \"math.rkt\" [e euler]))"}, nil, "rename-in: e is not provided by \"math.rkt\""},
+		{[]string{"(require (prefix-in m: (only-in \"math.rkt\" pi)))", "m:pi"}, 3.0, ""},
+		// modules declared in the same source
+		{[]string{"(module shapes racket (provide sq) (define (sq x) (* x x)))", "(require shapes)", "(sq 6)"}, 36.0, ""},
+		{[]string{"(require shapes)"}, nil, "require: unknown module 'shapes"},
+		// errors
+		{[]string{"(require \"cycle1.rkt\")"}, nil, "require: cycle in loading modules: cycle1.rkt -> cycle2.rkt -> cycle1.rkt"},
+		{[]string{"(require \"self.rkt\")"}, nil, "require: cycle in loading modules: self.rkt -> self.rkt"},
+		{[]string{"(require \"missing.rkt\")"}, nil, "missing.rkt: no such file or directory"},
+		{[]string{"(require \"bad.rkt\")"}, nil, "bad.rkt: provide: nothing is not defined or required"},
+		{[]string{"(require \"broken.rkt\")"}, nil, "broken.rkt: undefined-thing undefined"},
+		{[]string{"(with-handlers ([exn:fail? exn-message]) (require \"bad.rkt\"))"}, "bad.rkt: provide: nothing is not defined or required", ""},
+	}
+
+	dir := writeModules(t, testModules)
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", strings.Join(tt.a, " "))
+		t.Run(testname, func(t *testing.T) {
+			env, err := NewEnvironment(WithDirectory(dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := expandLines(NewStandardExpander(), env, tt.a...)
+			if err != nil && tt.wantErr != "" && strings.Contains(err.Error(), tt.wantErr) {
+				return
+			}
+			if err != nil || tt.wantErr != "" {
+				t.Fatalf("got error %v, want %s", err, tt.wantErr)
+			}
+			if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModulesAreInstantiatedOnce(t *testing.T) {
+	dir := writeModules(t, testModules)
+	var out strings.Builder
+	env, err := NewEnvironment(WithDirectory(dir), WithOutput(&out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := expandLines(NewExpander(), env, "(require \"uses1.rkt\" \"uses2.rkt\")", "(require \"loud.rkt\")", "(list x y z)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("got %v, want [1 2 3]", got)
+	}
+	// forks share the instances too
+	if _, err := expandLines(NewExpander(), env.Fork(), "(require \"loud.rkt\")"); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "loading\n" {
+		t.Errorf("got output %q, want one loading line", got)
+	}
+}
+
+func TestRequireErrors(t *testing.T) {
+	dir := writeModules(t, testModules)
+	env, err := NewEnvironment(WithDirectory(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = expandLines(NewExpander(), env, "(require \"cycle1.rkt\")")
+	var cycle *CycleError
+	if !errors.As(err, &cycle) || len(cycle.Modules) != 3 {
+		t.Errorf("got %v, want a CycleError of 3 modules", err)
+	}
+	_, err = expandLines(NewExpander(), env, "(require \"missing.rkt\")")
+	var moduleErr *ModuleError
+	if !errors.As(err, &moduleErr) || moduleErr.Module != "missing.rkt" || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want a ModuleError for missing.rkt", err)
+	}
+	sandbox, err := NewSandboxEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = expandLines(NewExpander(), sandbox, "(require \"math.rkt\")")
+	if err == nil || !strings.Contains(err.Error(), "require: modules are not available in this environment") {
+		t.Errorf("got %v, want require to be unavailable in a sandbox", err)
+	}
+}
+
+func TestParseRequire(t *testing.T) {
+	var tests = []struct {
+		a       string
+		want    string
+		wantErr string
+	}{
+		{"(require \"a.rkt\" m)", "(require \"a.rkt\" m)", ""},
+		{"(require (only-in \"a.rkt\" f g) (prefix-in p: m) (rename-in m [f g]))", "(require (only-in \"a.rkt\" f g) (prefix-in p: m) (rename-in m [f g]))", ""},
+		{"(provide f x (all-defined-out))", "(provide f x (all-defined-out))", ""},
+		{"(module m racket (define x 1) x)", "(module m racket (define x 1) x)", ""},
+		{"(require 5)", "", "1:1: with invalid require spec 5"},
+		{"(require (only-in \"a.rkt\" 5))", "", "1:1: with invalid require spec (only-in \"a.rkt\" 5)"},
+		{"(require (rename-in \"a.rkt\" f))", "", "1:1: with invalid require spec (rename-in \"a.rkt\" f)"},
+		{"(provide 5)", "", "1:1: with invalid provide spec"},
+		{"(module m)", "", "1:1: with module requires a name and a language"},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			prog, err := ParseSource(tt.a)
+			if fmt.Sprint(err) != fmt.Sprint(tt.wantErr) && !(err == nil && tt.wantErr == "") {
+				t.Fatalf("got error %v, want %s", err, tt.wantErr)
+			}
+			if err == nil && unparse(prog.Forms[0]) != tt.want {
+				t.Errorf("got %s, want %s", prog.Forms[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestLintRequire(t *testing.T) {
+	dir := writeModules(t, testModules)
+	env, err := NewEnvironment(WithDirectory(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := ParseSource("(require (prefix-in m: \"math.rkt\"))\n(provide twice)\n(define (twice x) (* 2 (m:square m:pi)))\n(m:cube 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, diag := range Lint(prog, env) {
+		got = append(got, diag.String())
+	}
+	want := []string{"4:1: error: unbound procedure m:cube"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStaticPassesDoNotRunModules(t *testing.T) {
+	dir := writeModules(t, testModules)
+	var out strings.Builder
+	env, err := NewEnvironment(WithDirectory(dir), WithOutput(&out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// broken.rkt fails when it runs, but still provides f
+	prog, err := ParseSource("(require \"uses1.rkt\" \"broken.rkt\" \"reexport.rkt\")\n(f y)\n(square 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diags := Lint(prog, env); len(diags) != 0 {
+		t.Errorf("got diagnostics %v, want none", diags)
+	}
+	if _, err := ResolveProgram(prog, env); err != nil {
+		t.Errorf("got %v, want the program to resolve", err)
+	}
+	if got := out.String(); got != "" {
+		t.Errorf("got output %q, want no module to run", got)
+	}
+}
+
+func TestModuleLimitsAreNotCatchable(t *testing.T) {
+	dir := writeModules(t, map[string]string{"spin.rkt": "(define (spin n) (spin (+ n 1)))\n(spin 0)"})
+	env, err := NewEnvironment(WithDirectory(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expandLines(NewExpander(), env, "(define (always v) #t)"); err != nil {
+		t.Fatal(err)
+	}
+	_, exp, err := Parser(mustTokenize(t, "(with-handlers ([always always]) (require \"spin.rkt\"))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Evaluator(exp, env, EvalOptions{MaxDepth: 50})
+	var depthErr *DepthLimitError
+	if !errors.As(err, &depthErr) {
+		t.Errorf("got %v, want the depth limit to stop the require", err)
+	}
+}
+
+func TestExecuteRequire(t *testing.T) {
+	dir := writeModules(t, testModules)
+	env, err := NewEnvironment(WithDirectory(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := execLines(env, "(require (prefix-in m: \"math.rkt\"))", "(provide twice)",
+		"(module shapes racket (provide sq) (define (sq x) (* x x)))", "(require shapes)", "(+ (m:square 4) (sq 3))")
+	if err != nil || got != 25.0 {
+		t.Errorf("got %v %v, want 25", got, err)
+	}
+	_, err = execLines(env, "(require \"missing.rkt\")")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want a missing module", err)
+	}
+	// errors in imported functions have the same context in both backends
+	var context []string
+	for _, run := range []func(*Environment, ...string) (interface{}, error){evalLines, execLines} {
+		fresh, err := NewEnvironment(WithDirectory(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = run(fresh, "(require \"area.rkt\")", "(define (f r) (area r))", "(f #t)")
+		context = append(context, fmt.Sprintf("%+v", err))
+	}
+	if !strings.Contains(context[0], "(square #t) at 4:26\n   (area #t)\n   (f #t)") || context[1] != context[0] {
+		t.Errorf("got %q from Execute, want %q", context[1], context[0])
+	}
+	want := "save image: function m:square: imported from math.rkt; require it again after loading"
+	if err := env.SaveImage(io.Discard); fmt.Sprint(err) != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
@@ -0,0 +1,359 @@
+package minrkt
+
+// maxInlineSize is the number of expressions a function body may have
+// for Optimize to inline it
+const maxInlineSize = 16
+
+type optimizer struct {
+	env *Environment
+	// every function the program defines, and how many times
+	bodies map[string]*expDefineFunc
+	defs   map[string]int
+	// functions defined once by an earlier top-level form, which calls
+	// in later forms may inline
+	inlinable map[string]*expDefineFunc
+	positions map[Exp]Pos
+	optimized map[Exp]Pos
+}
+
+// Optimize returns prog with constant expressions folded, if expressions
+// with a literal test replaced by the branch taken, and calls to small
+// non-recursive functions inlined with their constant or parameter
+// arguments substituted into the body. Results and errors are unchanged;
+// only the fuel used and the calls listed in an error's context differ.
+// Folding is skipped for operators env overrides with DefineBuiltin, and
+// only functions prog defines exactly once are inlined; redefining one
+// later, in another program, does not reach the copies inlined here.
+func Optimize(prog *Program, env *Environment) *Program {
+	o := &optimizer{
+		env:       env,
+		bodies:    make(map[string]*expDefineFunc),
+		defs:      make(map[string]int),
+		inlinable: make(map[string]*expDefineFunc),
+		positions: prog.Positions,
+		optimized: make(map[Exp]Pos),
+	}
+	for _, form := range prog.Forms {
+		o.collect(form)
+	}
+	forms := make([]Exp, len(prog.Forms))
+	for i, form := range prog.Forms {
+		forms[i] = o.opt(form, nil)
+		if def, ok := forms[i].(*expDefineFunc); ok && o.canInline(def) {
+			o.inlinable[def.name] = def
+		}
+	}
+	return &Program{Forms: forms, Positions: o.optimized}
+}
+
+// collect records the functions exp defines
+func (o *optimizer) collect(exp Exp) {
+	walkExp(exp, func(e Exp) {
+		if def, ok := e.(*expDefineFunc); ok {
+			o.bodies[def.name] = def
+			o.defs[def.name]++
+		}
+	})
+}
+
+// walkExp calls visit on exp and every expression inside it
+func walkExp(exp Exp, visit func(Exp)) {
+	visit(exp)
+	switch e := exp.(type) {
+	case *expFunc:
+		for _, arg := range e.arguments {
+			walkExp(arg, visit)
+		}
+	case *expOperator:
+		for _, operand := range e.operands {
+			walkExp(operand, visit)
+		}
+	case *expDefineVar:
+		walkExp(e.val, visit)
+	case *expDefineFunc:
+		walkExp(e.expression, visit)
+	case *expFrame:
+		walkExp(e.body, visit)
+	case *expLet:
+		for _, val := range e.vals {
+			walkExp(val, visit)
+		}
+		walkExp(e.body, visit)
+	case *expWithHandlers:
+		walkExp(e.body, visit)
+	case *expSyntaxCase:
+		walkExp(e.subject, visit)
+		for _, clause := range e.clauses {
+			walkExp(clause.body, visit)
+		}
+	case *expCheck:
+		for _, arg := range e.args {
+			walkExp(arg, visit)
+		}
+		if e.message != nil {
+			walkExp(e.message, visit)
+		}
+	case *expTestCase:
+		walkExp(e.name, visit)
+		for _, form := range e.body {
+			walkExp(form, visit)
+		}
+	}
+}
+
+// canInline reports whether calls to def may be replaced by its body:
+// def is the only definition of its name, is small, defines nothing and
+// cannot reach itself through the functions the program defines. Bodies
+// with a let or a syntax-case are not inlined either, to keep
+// substitution simple.
+func (o *optimizer) canInline(def *expDefineFunc) bool {
+	if o.defs[def.name] != 1 {
+		return false
+	}
+	if _, ok := o.env.lookupFunction(def.name); ok {
+		return false
+	}
+	if _, ok := def.expression.(*expFrame); ok {
+		return false
+	}
+	size, defines := 0, false
+	walkExp(def.expression, func(e Exp) {
+		size++
+		switch e.(type) {
+		case *expDefineVar, *expDefineFunc, *expLet, *expSyntaxCase:
+			defines = true
+		}
+	})
+	return size <= maxInlineSize && !defines && !o.reaches(def.expression, def.name, map[string]bool{})
+}
+
+// reaches reports whether evaluating exp may call name
+func (o *optimizer) reaches(exp Exp, name string, seen map[string]bool) bool {
+	found := false
+	walkExp(exp, func(e Exp) {
+		var callees []string
+		switch e := e.(type) {
+		case *expFunc:
+			callees = []string{e.name}
+		case *expWithHandlers:
+			for _, clause := range e.clauses {
+				callees = append(callees, clause.predicate, clause.handler)
+			}
+		}
+		for _, callee := range callees {
+			if callee == name {
+				found = true
+			} else if def, ok := o.bodies[callee]; ok && !seen[callee] {
+				seen[callee] = true
+				found = found || o.reaches(def.expression, name, seen)
+			}
+		}
+	})
+	return found
+}
+
+func (o *optimizer) optAll(exps []Exp, params []string) []Exp {
+	optimized := make([]Exp, len(exps))
+	for i, exp := range exps {
+		optimized[i] = o.opt(exp, params)
+	}
+	return optimized
+}
+
+// opt optimizes exp, which appears in the body of a function with params
+func (o *optimizer) opt(exp Exp, params []string) Exp {
+	optimized := exp
+	switch e := exp.(type) {
+	case *expFunc:
+		call := &expFunc{e.name, o.optAll(e.arguments, params)}
+		optimized = call
+		if inlined := o.inline(call, params); inlined != nil {
+			optimized = o.opt(inlined, params)
+		}
+	case *expOperator:
+		optimized = o.fold(&expOperator{e.opType, o.optAll(e.operands, params)})
+	case *expDefineVar:
+		optimized = &expDefineVar{e.name, o.opt(e.val, params)}
+	case *expDefineFunc:
+		optimized = &expDefineFunc{e.name, o.opt(e.expression, e.paramNames), e.paramNames}
+	case *expFrame:
+		optimized = &expFrame{o.opt(e.body, nil), e.size}
+	case *expLet:
+		// let-bound names count as parameters, so nothing is inlined
+		// where one of them would capture a global
+		inner := append(append([]string(nil), params...), e.names...)
+		optimized = &expLet{e.names, o.optAll(e.vals, params), o.opt(e.body, inner)}
+	case *expWithHandlers:
+		optimized = &expWithHandlers{e.clauses, o.opt(e.body, params)}
+	case *expSyntaxCase:
+		clauses := make([]syntaxCaseClause, len(e.clauses))
+		for i, clause := range e.clauses {
+			clauses[i] = syntaxCaseClause{clause.pattern, o.opt(clause.body, params)}
+		}
+		optimized = &expSyntaxCase{o.opt(e.subject, params), e.literals, clauses}
+	case *expCheck:
+		check := &expCheck{e.name, e.predicate, o.optAll(e.args, params), nil}
+		if e.message != nil {
+			check.message = o.opt(e.message, params)
+		}
+		optimized = check
+	case *expTestCase:
+		optimized = &expTestCase{e.suite, o.opt(e.name, params), o.optAll(e.body, params)}
+	}
+	if pos, ok := o.positions[exp]; ok {
+		if _, ok := o.optimized[optimized]; !ok {
+			o.optimized[optimized] = pos
+		}
+	}
+	return optimized
+}
+
+func isConstant(exp Exp) bool {
+	switch exp.(type) {
+	case *expNumConst, *expInexactConst, *expBoolConst, *expStrConst:
+		return true
+	}
+	return false
+}
+
+func constantValue(exp Exp) Value {
+	switch e := exp.(type) {
+	case *expNumConst:
+		return e.val
+	case *expInexactConst:
+		return inexact(e.val)
+	case *expBoolConst:
+		return e.val
+	case *expStrConst:
+		return e.val
+	}
+	return nil
+}
+
+func constantExp(val Value) (Exp, bool) {
+	switch v := val.(type) {
+	case float64:
+		return &expNumConst{v}, true
+	case inexact:
+		return &expInexactConst{float64(v)}, true
+	case bool:
+		return &expBoolConst{v}, true
+	case string:
+		return &expStrConst{v}, true
+	}
+	return nil, false
+}
+
+// fold evaluates e now if its operands are constants and doing so cannot
+// change what happens at run time
+func (o *optimizer) fold(e *expOperator) Exp {
+	switch e.opType {
+	case TOK_AND, TOK_OR:
+		if len(e.operands) != 2 {
+			return e
+		}
+		first, ok := e.operands[0].(*expBoolConst)
+		if !ok {
+			return e
+		}
+		if first.val == (e.opType == TOK_OR) {
+			return first
+		}
+		if second, ok := e.operands[1].(*expBoolConst); ok {
+			return second
+		}
+	case TOK_IF:
+		if len(e.operands) != 3 {
+			return e
+		}
+		if test, ok := e.operands[0].(*expBoolConst); ok {
+			if test.val {
+				return e.operands[1]
+			}
+			return e.operands[2]
+		}
+	default:
+		op := operatorNames[e.opType]
+		builtin, ok := o.env.lookupBuiltin(op)
+		if !ok || builtin != standardBuiltins[op] || (e.opType == TOK_NOT && len(e.operands) != 1) {
+			return e
+		}
+		args := make([]Value, len(e.operands))
+		for i, operand := range e.operands {
+			if !isConstant(operand) {
+				return e
+			}
+			args[i] = constantValue(operand)
+		}
+		// an operator that fails keeps failing at run time
+		if result, err := builtin.call(args); err == nil {
+			if folded, ok := constantExp(result); ok {
+				return folded
+			}
+		}
+	}
+	return e
+}
+
+// inline returns the body of the function call calls with its arguments
+// substituted for its parameters, or nil when that could change what the
+// call does. Only constants and the caller's own parameters are
+// substituted, since they are cheap, cannot fail and have no effects.
+func (o *optimizer) inline(call *expFunc, params []string) Exp {
+	def, ok := o.inlinable[call.name]
+	if !ok || len(call.arguments) != len(def.paramNames) {
+		return nil
+	}
+	isParam := func(name string, params []string) bool {
+		for _, param := range params {
+			if param == name {
+				return true
+			}
+		}
+		return false
+	}
+	args := make(map[string]Exp)
+	for i, arg := range call.arguments {
+		v, isVar := arg.(*expVar)
+		if !isConstant(arg) && !(isVar && isParam(v.name, params)) {
+			return nil
+		}
+		args[def.paramNames[i]] = arg
+	}
+	// a global the body reads must not be captured by a caller parameter
+	captured := false
+	walkExp(def.expression, func(e Exp) {
+		if v, ok := e.(*expVar); ok && !isParam(v.name, def.paramNames) && isParam(v.name, params) {
+			captured = true
+		}
+	})
+	if captured {
+		return nil
+	}
+	return substitute(def.expression, args)
+}
+
+// substitute copies exp with the variables in args replaced
+func substitute(exp Exp, args map[string]Exp) Exp {
+	switch e := exp.(type) {
+	case *expVar:
+		if arg, ok := args[e.name]; ok {
+			return arg
+		}
+	case *expFunc:
+		sub := make([]Exp, len(e.arguments))
+		for i, arg := range e.arguments {
+			sub[i] = substitute(arg, args)
+		}
+		return &expFunc{e.name, sub}
+	case *expOperator:
+		sub := make([]Exp, len(e.operands))
+		for i, operand := range e.operands {
+			sub[i] = substitute(operand, args)
+		}
+		return &expOperator{e.opType, sub}
+	case *expWithHandlers:
+		return &expWithHandlers{e.clauses, substitute(e.body, args)}
+	}
+	return exp
+}
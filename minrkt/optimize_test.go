@@ -0,0 +1,123 @@
+package minrkt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// optimizeLines is evalLines with each line optimized before it runs
+func optimizeLines(env *Environment, lines ...string) (interface{}, error) {
+	var result interface{}
+	for _, line := range lines {
+		prog, err := ParseSource(line)
+		if err != nil {
+			return nil, err
+		}
+		results, err := EvaluateProgram(Optimize(prog, env), env)
+		if err != nil {
+			return nil, err
+		}
+		result = results[len(results)-1]
+	}
+	return result, nil
+}
+
+func TestOptimize(t *testing.T) {
+	var tests = []struct {
+		a    string
+		want string
+	}{
+		{"(+ 1 (* 2 3))", "7"},
+		{"(< 1 2)", "#t"},
+		{`(= "a" "a")`, "#t"},
+		{"(not (> 1 2))", "#t"},
+		{"(/ 1 0)", "(/ 1 0)"},
+		{"(= 1 #t)", "(= 1 #t)"},
+		{"(+ x (* 2 3))", "(+ x 6)"},
+		{"(if (< 1 2) a (nope))", "a"},
+		{"(if #f 1 (+ 2 3))", "5"},
+		{"(if 1 2 3)", "(if 1 2 3)"},
+		{"(and #f x)", "#f"},
+		{"(or #t x)", "#t"},
+		{"(and #t x)", "(and #t x)"},
+		{"(and #t (> 2 1))", "#t"},
+		{"(define (sq x) (* x x))\n(sq 3)", "(define (sq x) (* x x))\n9"},
+		{"(sq 3)\n(define (sq x) (* x x))", "(sq 3)\n(define (sq x) (* x x))"},
+		{"(define (abs x) (if (< x 0) (- x) x))\n(define (g y) (abs y))",
+			"(define (abs x) (if (< x 0) (- x) x))\n(define (g y) (if (< y 0) (- y) y))"},
+		{"(define (k) z)\n(define (g z) (k))", "(define (k) z)\n(define (g z) (k))"},
+		{"(define (sq x) (* x x))\n(sq (nope))", "(define (sq x) (* x x))\n(sq (nope))"},
+		{"(define (sq x) (* x x))\n(sq 1 2)", "(define (sq x) (* x x))\n(sq 1 2)"},
+		{"(define (sq x) (* x x))\n(define (sq x) x)\n(sq 2)", "(define (sq x) (* x x))\n(define (sq x) x)\n(sq 2)"},
+		{"(define (fact n) (if (< n 1) 1 (* n (fact (- n 1)))))\n(fact 3)",
+			"(define (fact n) (if (< n 1) 1 (* n (fact (- n 1)))))\n(fact 3)"},
+		{"(define (f n) (g n))\n(define (g n) (f n))\n(f 1)", "(define (f n) (g n))\n(define (g n) (f n))\n(f 1)"},
+		{"(define (twice a) (+ a a))\n(define (quad b) (twice (twice b)))",
+			"(define (twice a) (+ a a))\n(define (quad b) (twice (+ b b)))"},
+		{"(define (one) 1)\n(define (two) (+ (one) (one)))\n(two)", "(define (one) 1)\n(define (two) 2)\n2"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			prog, err := ParseSource(tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var forms []string
+			for _, form := range Optimize(prog, newTestEnv()).Forms {
+				forms = append(forms, unparse(form))
+			}
+			if got := strings.Join(forms, "\n"); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptimizeRespectsOverrides(t *testing.T) {
+	env := newTestEnv()
+	env.DefineBuiltin("+", Variadic, func(args []Value) (Value, error) {
+		return "plus", nil
+	})
+	prog, err := ParseSource("(+ 1 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := unparse(Optimize(prog, env).Forms[0]); got != "(+ 1 2)" {
+		t.Errorf("got %s, want (+ 1 2)", got)
+	}
+}
+
+func TestOptimizePreservesSemantics(t *testing.T) {
+	programs := append(differentialPrograms, []string{
+		"(define (sq x) (* x x))", "(define (h y) (+ (sq y) (sq 2)))", "(h 3)", "(h #t)",
+	}, []string{
+		"(define (div a b) (/ a b))", "(define (safe x) (with-handlers ([exn:fail? exn-message]) (div x 0)))", "(safe 1)",
+	})
+	for _, program := range programs {
+		testname := fmt.Sprintf("%s", strings.Join(program, " "))
+		t.Run(testname, func(t *testing.T) {
+			want, wantErr := evalLines(newTestEnv(), program...)
+			got, gotErr := optimizeLines(newTestEnv(), strings.Join(program, "\n"))
+			if fmt.Sprint(wantErr) != fmt.Sprint(gotErr) {
+				t.Fatalf("got error %v, want %v", gotErr, wantErr)
+			}
+			if wantErr == nil && fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", want) {
+				t.Errorf("got %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestOptimizedPositions(t *testing.T) {
+	prog, err := ParseSource("(define (f n) (if (< n 1) (/ 1 n) (f (- n 1))))\n(+ 1 (f (- 2 1)))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = EvaluateProgram(Optimize(prog, newTestEnv()), newTestEnv())
+	formErr, ok := err.(*FormError)
+	if !ok || len(formErr.Context()) != 2 || formErr.Context()[1].Pos != (Pos{2, 6}) {
+		t.Errorf("got %+v, want the outer call (f 1) at 2:6", err)
+	}
+}
@@ -2,13 +2,82 @@ package minrkt
 
 import (
 	"fmt"
+	"io"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// Environment holds the global definitions scripts share. Every call to
+// Evaluator, EvaluateContext or EvaluateProgram runs in its own session
+// with a private CallStack, so an Environment built by NewEnvironment may
+// be used by several goroutines at once. A zero Environment works but is
+// not safe for concurrent use.
 type Environment struct {
-	Variables map[string]interface{}
-	Functions map[string]FuncParamExpr
+	// global definitions. They are unexported so that every write goes
+	// through own, which copies them while a Snapshot shares them.
+	variables map[string]interface{}
+	functions map[string]FuncParamExpr
 	CallStack []map[string]interface{}
+	// builtins defined by the host with DefineBuiltin
+	builtins map[string]*Builtin
+	// limits of the evaluation in progress, nil outside of Evaluator
+	limits *evalLimits
+	// frames describes each call whose parameters were pushed onto
+	// CallStack, in the same order
+	frames []Frame
+	// the results of the checks evaluated so far, under RunTests
+	tests *testRun
+	// positions of the code a session is running: its program's, or
+	// those of the program that defined the function whose body runs
+	positions map[Exp]Pos
+	// sources holds the positions of the program each function was
+	// defined in, keyed by the function's body
+	sources map[Exp]map[Exp]Pos
+	// types holds the types the TypeChecker inferred for the prelude's
+	// functions, keyed by the function's body. It is filled in once by
+	// NewEnvironment and never changes afterwards.
+	types map[Exp]*typ
+	// mu guards the maps above
+	mu *sync.RWMutex
+	// cow is set while the maps are shared with a Snapshot; the next
+	// write copies them first
+	cow bool
+	// gen counts the changes to the maps above, so that sessions know
+	// when their view of them is out of date
+	gen atomic.Uint64
+	// root is the Environment a session was started from, whose
+	// definitions it reads and writes; nil outside of a session
+	root *Environment
+	// cache holds the definitions a session has read from root
+	cache *sessionCache
+	// the modules require loads, nil where require is not available
+	modules *moduleCache
+	// the directory relative require paths start from
+	dir string
+	// the keys of the modules being instantiated, outermost first, when
+	// env is the environment of the last one
+	loading []string
+}
+
+// Frame records an active call of a user-defined function
+type Frame struct {
+	Name string
+	Pos  Pos // call site, zero when unknown
+	Args []interface{}
+}
+
+func (f Frame) String() string {
+	call := "(" + f.Name
+	for _, arg := range f.Args {
+		call += " " + showValue(arg)
+	}
+	call += ")"
+	if f.Pos.Line == 0 {
+		return call
+	}
+	return fmt.Sprintf("%s at %v", call, f.Pos)
 }
 
 type ArgumentError struct {
@@ -35,6 +104,118 @@ func (e *EvalError) Error() string {
 	return fmt.Sprintf("%s", e.c)
 }
 
+// maximum number of enclosing forms and call frames a FormError records
+const (
+	maxBreadcrumb = 16
+	maxContext    = 32
+)
+
+// FormError wraps an evaluation failure with the forms that enclosed it
+// and the calls that were active when it happened, both innermost first.
+// Error() is the cause's message; format with %+v to include the
+// breadcrumb and the context.
+type FormError struct {
+	Err     error
+	forms   []Exp
+	context []Frame
+}
+
+func (e *FormError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FormError) Unwrap() error {
+	return e.Err
+}
+
+// Forms returns the printed enclosing forms, innermost first
+func (e *FormError) Forms() []string {
+	var forms []string
+	for _, form := range e.forms {
+		forms = append(forms, unparse(form))
+	}
+	return forms
+}
+
+// Context returns the calls active where the error happened, innermost
+// first
+func (e *FormError) Context() []Frame {
+	if e.context == nil {
+		return nil
+	}
+	frames := make([]Frame, len(e.context))
+	for i, frame := range e.context {
+		frames[i] = Frame{frame.Name, frame.Pos, hostArgs(frame.Args)}
+	}
+	return frames
+}
+
+func (e *FormError) Format(f fmt.State, verb rune) {
+	io.WriteString(f, e.Error())
+	if verb == 'v' && f.Flag('+') {
+		writeCollapsed(f, "\n  in: ", e.Forms())
+		if len(e.context) > 0 {
+			io.WriteString(f, "\n  context...:")
+			frames := make([]string, len(e.context))
+			for i, frame := range e.context {
+				frames[i] = frame.String()
+			}
+			writeCollapsed(f, "\n   ", frames)
+		}
+	}
+}
+
+// writeCollapsed writes each of lines after prefix, with a run of
+// identical lines, such as the calls of a runaway recursion, written once
+func writeCollapsed(w io.Writer, prefix string, lines []string) {
+	for i := 0; i < len(lines); {
+		n := 1
+		for i+n < len(lines) && lines[i+n] == lines[i] {
+			n++
+		}
+		io.WriteString(w, prefix+lines[i])
+		if n > 1 {
+			fmt.Fprintf(w, " (repeated %d times)", n)
+		}
+		i += n
+	}
+}
+
+// withContext records the active calls in err unless a deeper call
+// already did. Like inForm, it returns a new FormError rather than
+// changing the one it was given, which a handler may still hold.
+func withContext(err error, frames []Frame) error {
+	formErr, ok := err.(*FormError)
+	if ok && formErr.context != nil {
+		return formErr
+	}
+	wrapped := FormError{Err: err}
+	if ok {
+		wrapped = *formErr
+	}
+	for i := len(frames) - 1; i >= 0 && len(wrapped.context) < maxContext; i-- {
+		wrapped.context = append(wrapped.context, frames[i])
+	}
+	return &wrapped
+}
+
+// inForm returns err with form added to its breadcrumb
+func inForm(err error, form Exp) error {
+	formErr, ok := err.(*FormError)
+	if !ok {
+		return &FormError{Err: err, forms: []Exp{form}}
+	}
+	if len(formErr.forms) >= maxBreadcrumb {
+		return formErr
+	}
+	wrapped := *formErr
+	// the full slice expression makes append copy the forms
+	wrapped.forms = append(formErr.forms[:len(formErr.forms):len(formErr.forms)], form)
+	return &wrapped
+}
+
+// Exp is an expression that can be evaluated. The forms this package
+// parses also implement fmt.Stringer and print as MiniRacket source.
 type Exp interface {
 	Eval(*Environment) (interface{}, error)
 }
@@ -56,6 +237,15 @@ type expNumConst struct {
 	val float64
 }
 
+// expInexactConst is a number literal written with a decimal point
+type expInexactConst struct {
+	val float64
+}
+
+type expStrConst struct {
+	val string
+}
+
 type expOperator struct {
 	opType   TokenType
 	operands []Exp
@@ -78,6 +268,9 @@ type FuncParamExpr struct {
 }
 
 func (e *expVar) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
 	var funcVarMap map[string]interface{}
 	if len(env.CallStack) > 0 {
 		funcVarMap = env.CallStack[len(env.CallStack)-1]
@@ -86,9 +279,9 @@ func (e *expVar) Eval(env *Environment) (interface{}, error) {
 	}
 	funcVar, ok1 := funcVarMap[e.name]
 	if !ok1 { // check global variables
-		varVal, ok := env.Variables[e.name]
+		varVal, ok := env.lookupVariable(e.name)
 		if !ok {
-			return e.name, &EvalError{e.name + " undefined"}
+			return e.name, &UndefinedError{e.name}
 		} else {
 			return varVal, nil
 		}
@@ -98,349 +291,215 @@ func (e *expVar) Eval(env *Environment) (interface{}, error) {
 }
 
 func (e *expFunc) Eval(env *Environment) (interface{}, error) {
-	funcStruct, ok := env.Functions[e.name]
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	args := make([]interface{}, len(e.arguments))
+	for i, argument := range e.arguments {
+		arg, err := argument.Eval(env)
+		if err != nil {
+			return nil, inForm(err, e)
+		}
+		args[i] = arg
+	}
+	result, err := applyProc(env, e, e.name, args)
+	if err != nil {
+		return result, inForm(err, e)
+	}
+	return result, nil
+}
+
+// applyProc calls the user-defined function or primitive procedure
+// bound to name with already evaluated arguments on behalf of site
+func applyProc(env *Environment, site Exp, name string, args []interface{}) (interface{}, error) {
+	funcStruct, ok := env.lookupFunction(name)
 	if !ok {
-		return e.name, &EvalError{e.name + " undefined"}
+		if builtin, ok := env.lookupBuiltin(name); ok {
+			return builtin.call(args)
+		}
+		return name, &UndefinedError{name}
 	}
 	funcExpression := funcStruct.expression
 	funcParams := funcStruct.params
-	localParams := make(map[string]interface{})
-	// populate map of argument to parameter assignment
-	for i, param := range funcParams {
-		arg, err := e.arguments[i].Eval(env)
-		if err == nil {
-			localParams[param] = arg
+	if len(args) != len(funcParams) {
+		return nil, arityError(name, strconv.Itoa(len(funcParams)), len(args))
+	}
+	if err := env.enterCall(); err != nil {
+		return nil, err
+	}
+	var localParams map[string]interface{}
+	// a resolved body reads its arguments from the frame instead
+	if _, resolved := funcExpression.(*expFrame); !resolved {
+		localParams = make(map[string]interface{})
+		// populate map of argument to parameter assignment
+		for i, param := range funcParams {
+			localParams[param] = args[i]
 		}
 	}
 
 	// push localParams to env
 	env.CallStack = append(env.CallStack, localParams)
-	// evaluate Exp
+	env.frames = append(env.frames, Frame{name, env.positions[site], args})
+	// evaluate Exp, among the positions of the program that defined it
+	outer := env.positions
+	env.positions = env.sourceOf(funcExpression)
 	result, err := funcExpression.Eval(env)
+	env.positions = outer
+	if err != nil {
+		err = withContext(err, env.frames)
+	}
 	// pop localParams from env upon return
+	env.frames = env.frames[:len(env.frames)-1]
 	env.CallStack = env.CallStack[:len(env.CallStack)-1]
 
 	return result, err
 }
 
-func (e *expBoolConst) Eval(_ *Environment) (interface{}, error) {
+func (e *expBoolConst) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
 	var val interface{} = e.val
 	return val, nil
 }
 
-func (e *expNumConst) Eval(_ *Environment) (interface{}, error) {
+func (e *expNumConst) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	var val interface{} = e.val
+	return val, nil
+}
+
+func (e *expInexactConst) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	var val interface{} = inexact(e.val)
+	return val, nil
+}
+
+func (e *expStrConst) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
 	var val interface{} = e.val
 	return val, nil
 }
 
 func (e *expDefineVar) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
 	iName := e.name
 	iValue, err := e.val.Eval(env)
-	env.Variables[iName] = iValue
-	return nil, err
+	if err != nil {
+		return nil, inForm(err, e)
+	}
+	env.setVariable(iName, iValue)
+	return nil, nil
 }
 
 func (e *expDefineFunc) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
 	varName := e.name
 	// create struct for map value {Exp, []string}
 	mapVal := FuncParamExpr{e.paramNames, e.expression}
-	env.Functions[varName] = mapVal // struct of param list and Exp
+	env.setFunction(varName, mapVal) // struct of param list and Exp
 	return nil, nil
 }
 
 func (e *expOperator) Eval(env *Environment) (interface{}, error) {
-	var result interface{}
-	var err error
-	switch opType := e.opType; opType {
-	case TOK_ADD:
-		var sum float64
-		for i := 0; i < len(e.operands); i++ {
-			var iSum interface{}
-			iSum, err = e.operands[i].Eval(env)
-			subSum, ok := iSum.(float64)
-			if ok {
-				sum = sum + subSum
-			} else {
-				err = &EvalError{"Operands not Converted"}
-			}
-		}
-		result = sum
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	result, err := e.eval(env)
+	if err != nil {
+		return nil, inForm(err, e)
+	}
+	return result, nil
+}
 
-	case TOK_SUB:
-		var i int
-		var diff float64
-		if len(e.operands) == 0 {
-			diff = 0
-			err = &EvalError{"subtraction requires at least one operand"}
-		} else if len(e.operands) == 1 {
-			i = 0
-		} else {
-			var iDiff interface{}
-			iDiff, err = e.operands[0].Eval(env)
-			subDiff, ok := iDiff.(float64)
-			if ok {
-				diff = subDiff
-				i = 1
-			} else {
-				err = &EvalError{"Operands not Converted"}
-			}
-		}
-		for ; i < len(e.operands); i++ {
-			var iDiff interface{}
-			iDiff, err = e.operands[i].Eval(env)
-			subDiff, ok := iDiff.(float64)
-			if ok {
-				diff = diff - subDiff
-			} else {
-				err = &EvalError{"Operands not Converted"}
-			}
-		}
-		result = diff
-	case TOK_MUL:
-		product := 1.0
-		for i := 0; i < len(e.operands); i++ {
-			var iProduct interface{}
-			iProduct, err = e.operands[i].Eval(env)
-			subProduct, ok := iProduct.(float64)
-			if ok {
-				product = product * subProduct
-			} else {
-				err = &EvalError{"Operands not Converted"}
-			}
-		}
-		result = product
-	case TOK_DIV: // assumes non-empty operandList
-		var i int
-		var quotient float64
-		if len(e.operands) == 0 {
-			quotient = 0
-			err = &EvalError{"division requires at least one operand"}
-		} else if len(e.operands) == 1 {
-			i = 0
-		} else {
-			var iQuotient interface{}
-			iQuotient, err = e.operands[0].Eval(env)
-			subQuotient, ok := iQuotient.(float64)
-			if ok {
-				quotient = subQuotient
-				i = 1
-			} else {
-				err = &EvalError{"Operands not Converted"}
-			}
-		}
-		for ; i < len(e.operands); i++ {
-			var iQuotient interface{}
-			iQuotient, err = e.operands[i].Eval(env)
-			subQuotient, ok := iQuotient.(float64)
-			if ok {
-				quotient = quotient / subQuotient
-			} else {
-				err = &EvalError{"Operands not Converted"}
-			}
-		}
-		result = quotient
-	case TOK_EQ:
-		var boolResult bool
-		if len(e.operands) != 2 {
-			err = &EvalError{"= requires 2 operands"}
-		} else {
-			var iBool1 interface{}
-			var iBool2 interface{}
-			iBool1, err = e.operands[0].Eval(env)
-			iBool2, err = e.operands[1].Eval(env)
-			type1 := fmt.Sprintf("%T", iBool1)
-			type2 := fmt.Sprintf("%T", iBool2)
-			if type1 == type2 {
-				boolResult = iBool1 == iBool2
-			} else {
-				err = &ParseError{"mismatched types"}
-			}
-		}
-		result = boolResult
-	case TOK_GTEQ:
-		var boolResult bool
-		if len(e.operands) != 2 {
-			err = &EvalError{"= requires 2 operands"}
-		} else {
-			var iBool1 interface{}
-			var iBool2 interface{}
-			iBool1, err = e.operands[0].Eval(env)
-			iBool2, err = e.operands[1].Eval(env)
-			type1 := fmt.Sprintf("%T", iBool1)
-			type2 := fmt.Sprintf("%T", iBool2)
-			if type1 == "float64" && type2 == "float64" {
-				subBool1, ok1 := iBool1.(float64)
-				subBool2, ok2 := iBool2.(float64)
-				if ok1 && ok2 {
-					boolResult = subBool1 >= subBool2
-				}
-			} else {
-				err = &ParseError{"mismatched types"}
-			}
+// eval stops at the first operand that fails, so the error returned is
+// always the earliest one in evaluation order
+func (e *expOperator) eval(env *Environment) (interface{}, error) {
+	op := operatorNames[e.opType]
+	switch opType := e.opType; opType {
+	case TOK_ADD, TOK_SUB, TOK_MUL, TOK_DIV, TOK_EQ, TOK_GTEQ, TOK_LTEQ, TOK_GT, TOK_LT:
+		builtin, ok := env.lookupBuiltin(op)
+		if !ok {
+			return nil, &UndefinedError{op}
 		}
-		result = boolResult
-	case TOK_LTEQ:
-		var boolResult bool
-		if len(e.operands) != 2 {
-			err = &EvalError{"= requires 2 operands"}
-		} else {
-			var iBool1 interface{}
-			var iBool2 interface{}
-			iBool1, err = e.operands[0].Eval(env)
-			iBool2, err = e.operands[1].Eval(env)
-			type1 := fmt.Sprintf("%T", iBool1)
-			type2 := fmt.Sprintf("%T", iBool2)
-			if type1 == "float64" && type2 == "float64" {
-				subBool1, ok1 := iBool1.(float64)
-				subBool2, ok2 := iBool2.(float64)
-				if ok1 && ok2 {
-					boolResult = subBool1 <= subBool2
-				}
-			} else {
-				err = &ParseError{"mismatched types"}
+		// an override defined by the host sees every operand instead
+		standard := builtin == standardBuiltins[op]
+		args := make([]Value, len(e.operands))
+		for i, operand := range e.operands {
+			arg, err := operand.Eval(env)
+			if err != nil {
+				return nil, err
 			}
-		}
-		result = boolResult
-	case TOK_GT:
-		var boolResult bool
-		if len(e.operands) != 2 {
-			err = &EvalError{"= requires 2 operands"}
-		} else {
-			var iBool1 interface{}
-			var iBool2 interface{}
-			iBool1, err = e.operands[0].Eval(env)
-			iBool2, err = e.operands[1].Eval(env)
-			type1 := fmt.Sprintf("%T", iBool1)
-			type2 := fmt.Sprintf("%T", iBool2)
-			if type1 == "float64" && type2 == "float64" {
-				subBool1, ok1 := iBool1.(float64)
-				subBool2, ok2 := iBool2.(float64)
-				if ok1 && ok2 {
-					boolResult = subBool1 > subBool2
+			if standard {
+				if err := checkOperand(op, arg, i > 0 || len(e.operands) == 1); err != nil {
+					return nil, err
 				}
-			} else {
-				err = &ParseError{"mismatched types"}
 			}
+			args[i] = arg
 		}
-		result = boolResult
-	case TOK_LT:
-		var boolResult bool
+		return builtin.call(args)
+	case TOK_AND, TOK_OR:
 		if len(e.operands) != 2 {
-			err = &EvalError{"= requires 2 operands"}
-		} else {
-			var iBool1 interface{}
-			var iBool2 interface{}
-			iBool1, err = e.operands[0].Eval(env)
-			iBool2, err = e.operands[1].Eval(env)
-			type1 := fmt.Sprintf("%T", iBool1)
-			type2 := fmt.Sprintf("%T", iBool2)
-			if type1 == "float64" && type2 == "float64" {
-				subBool1, ok1 := iBool1.(float64)
-				subBool2, ok2 := iBool2.(float64)
-				if ok1 && ok2 {
-					boolResult = subBool1 < subBool2
-				}
-			} else {
-				err = &ParseError{"mismatched types"}
-			}
+			return nil, &EvalError{fmt.Sprintf("'%s' requires 2 operands", op)}
 		}
-		result = boolResult
-	case TOK_AND:
-		var boolResult bool
-		if len(e.operands) != 2 {
-			err = &EvalError{"'and' requires 2 operands"}
-		} else {
-			var iBool1 interface{}
-			var iBool2 interface{}
-			iBool1, err = e.operands[0].Eval(env)
-			subBool1, ok1 := iBool1.(bool)
-			if !ok1 {
-				err = &EvalError{"first 'and' operand must be boolean"}
-			} else {
-				if !subBool1 {
-					boolResult = false
-				} else {
-					iBool2, err = e.operands[1].Eval(env)
-					subBool2, ok2 := iBool2.(bool)
-					if !ok2 {
-						err = &EvalError{"second 'and' operand must be boolean"}
-					} else {
-						if !subBool2 {
-							boolResult = false
-						} else {
-							boolResult = true
-						}
-					}
-				}
-			}
+		bool1, err := evalBool(env, "first '"+op+"' operand", e.operands[0])
+		if err != nil {
+			return nil, err
 		}
-		result = boolResult
-	case TOK_OR:
-		var boolResult bool
-		if len(e.operands) != 2 {
-			err = &EvalError{"'or' requires 2 operands"}
-		} else {
-			var iBool1 interface{}
-			var iBool2 interface{}
-			iBool1, err = e.operands[0].Eval(env)
-			subBool1, ok1 := iBool1.(bool)
-			if !ok1 {
-				err = &EvalError{"first 'or' operand must be boolean"}
-			} else {
-				if !subBool1 {
-					iBool2, err = e.operands[1].Eval(env)
-					subBool2, ok2 := iBool2.(bool)
-					if !ok2 {
-						err = &EvalError{"second 'or' operand must be boolean"}
-					} else {
-						if subBool2 {
-							boolResult = true
-						} else {
-							boolResult = false
-						}
-					}
-				} else {
-					boolResult = true
-				}
-			}
+		// the second operand is only evaluated when it decides the result
+		if bool1 == (opType == TOK_OR) {
+			return bool1, nil
 		}
-		result = boolResult
+		return evalBool(env, "second '"+op+"' operand", e.operands[1])
 	case TOK_NOT:
-		var boolResult bool
+		builtin, ok := env.lookupBuiltin(op)
+		if !ok {
+			return nil, &UndefinedError{op}
+		}
 		if len(e.operands) != 1 {
-			err = &EvalError{"'not' requires 1 operand"}
-		} else {
-			var iBool1 interface{}
-			iBool1, err = e.operands[0].Eval(env)
-			subBool1, ok1 := iBool1.(bool)
-			if !ok1 {
-				err = &EvalError{"'not' operand must be boolean"}
-			} else {
-				boolResult = !subBool1
-			}
+			return nil, &EvalError{"'not' requires 1 operand"}
+		}
+		arg, err := e.operands[0].Eval(env)
+		if err != nil {
+			return nil, err
 		}
-		result = boolResult
+		return builtin.call([]Value{arg})
 	case TOK_IF:
-		var ifResult interface{}
 		if len(e.operands) != 3 {
-			err = &EvalError{"'if' requires 3 operands"}
-		} else {
-			var iBool1 interface{}
-			iBool1, err = e.operands[0].Eval(env)
-			subBool1, ok1 := iBool1.(bool)
-			if !ok1 {
-				err = &EvalError{"'not' operand must be boolean"}
-			} else {
-				if subBool1 {
-					ifResult, err = e.operands[1].Eval(env)
-				} else {
-					ifResult, err = e.operands[2].Eval(env)
-				}
-			}
+			return nil, &EvalError{"'if' requires 3 operands"}
+		}
+		test, err := evalBool(env, "'if' test", e.operands[0])
+		if err != nil {
+			return nil, err
+		}
+		if test {
+			return e.operands[1].Eval(env)
 		}
-		result = ifResult
+		return e.operands[2].Eval(env)
 	}
-	return result, err
+	return nil, nil
+}
+
+func evalBool(env *Environment, what string, operand Exp) (bool, error) {
+	val, err := operand.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := val.(bool)
+	if !ok {
+		return false, &EvalError{what + " must be boolean"}
+	}
+	return b, nil
 }
 
 func isLeftParenthesis(tok Token) bool {
@@ -457,6 +516,7 @@ func isIdentifier(tok Token) bool {
 
 func isOperand(tok Token) bool {
 	if tok.tokType == TOK_NUM ||
+		tok.tokType == TOK_STRING ||
 		tok.tokType == TOK_TRUE ||
 		tok.tokType == TOK_FALSE {
 		return true
@@ -477,6 +537,7 @@ func isOperator(tok Token) bool {
 		tok.tokType == TOK_LT ||
 		tok.tokType == TOK_AND ||
 		tok.tokType == TOK_OR ||
+		tok.tokType == TOK_NOT ||
 		tok.tokType == TOK_IF {
 		return true
 	} else {
@@ -493,11 +554,28 @@ func buildOperandNode(token Token) Exp {
 	var opNode Exp
 	switch tokType := token.tokType; tokType {
 	case TOK_NUM:
-		value, err := strconv.ParseFloat(currOp.val, 64)
+		// ParseFloat reads +inf and -inf but not the trailing .0,
+		// and NaN has no sign in Go
+		numStr := currOp.val
+		if strings.HasSuffix(numStr, "inf.0") {
+			numStr = strings.TrimSuffix(numStr, ".0")
+		} else if strings.HasSuffix(numStr, "nan.0") {
+			numStr = "nan"
+		}
+		value, err := strconv.ParseFloat(numStr, 64)
 
-		if err == nil {
+		// +inf.0, -inf.0 and +nan.0 have a decimal point too
+		if err == nil && strings.Contains(currOp.val, ".") {
+			opNode = &expInexactConst{value}
+		} else if err == nil {
 			opNode = &expNumConst{value}
 		}
+	case TOK_STRING:
+		value, err := unquoteString(currOp.val)
+
+		if err == nil {
+			opNode = &expStrConst{value}
+		}
 	case TOK_TRUE:
 		opNode = &expBoolConst{true}
 	case TOK_FALSE:
@@ -506,12 +584,52 @@ func buildOperandNode(token Token) Exp {
 	return opNode
 }
 
+// unquoteString reads a string literal. Unlike Go, Racket strings may
+// span lines, so raw newlines and tabs are escaped before unquoting.
+func unquoteString(lit string) (string, error) {
+	return strconv.Unquote(strings.NewReplacer("\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(lit))
+}
+
 func buildVar(token Token) Exp {
 	return &expVar{token.val}
 }
 
+// parser builds Exps from a token slice. Every slice it recurses on is a
+// suffix of tokens, which lets it find the position of any sub-slice.
+type parser struct {
+	tokens    []Token
+	positions []Pos
+	exps      map[Exp]Pos
+}
+
+// Parser parses the first expression in tokens. It does not expand
+// macros, so when, unless, cond, let* and user macros are ordinary calls
+// to it; ParseSource and Expander expand them.
 // Assumes non-empty input
 func Parser(tokens []Token) ([]Token, Exp, error) {
+	p := &parser{tokens: tokens}
+	return p.parse(tokens)
+}
+
+// posOf returns the position of the first of tokens, if known
+func (p *parser) posOf(tokens []Token) (Pos, bool) {
+	i := len(p.tokens) - len(tokens)
+	if i < 0 || i >= len(p.positions) {
+		return Pos{}, false
+	}
+	return p.positions[i], true
+}
+
+// parse parses one expression and records where it started
+func (p *parser) parse(tokens []Token) ([]Token, Exp, error) {
+	leftOver, exp, err := p.parseExp(tokens)
+	if pos, ok := p.posOf(tokens); ok && exp != nil && p.exps != nil {
+		p.exps[exp] = pos
+	}
+	return leftOver, exp, err
+}
+
+func (p *parser) parseExp(tokens []Token) ([]Token, Exp, error) {
 	// if tokens is empty, return empty slice and set error
 	if len(tokens) == 0 {
 		var exp Exp
@@ -519,7 +637,11 @@ func Parser(tokens []Token) ([]Token, Exp, error) {
 	}
 	currToken := tokens[0]
 	if isOperand(currToken) {
-		return tokens[1:], buildOperandNode(currToken), nil
+		opNode := buildOperandNode(currToken)
+		if opNode == nil {
+			return []Token{}, opNode, &ParseError{"invalid literal " + currToken.val}
+		}
+		return tokens[1:], opNode, nil
 	}
 	if isIdentifier(currToken) {
 		return tokens[1:], buildVar(currToken), nil
@@ -534,22 +656,50 @@ func Parser(tokens []Token) ([]Token, Exp, error) {
 	if isLeftParenthesis(currToken) {
 		operatorToken := tokens[1]
 		var err error
+		if isIdentifier(operatorToken) && operatorToken.val == "with-handlers" {
+			return p.parseWithHandlers(tokens[2:])
+		}
+		if isIdentifier(operatorToken) && operatorToken.val == "let" {
+			return p.parseLet(tokens[2:])
+		}
+		if isIdentifier(operatorToken) && operatorToken.val == "syntax" {
+			return p.parseSyntax(tokens[2:])
+		}
+		if isIdentifier(operatorToken) && operatorToken.val == "syntax-case" {
+			return p.parseSyntaxCase(tokens[2:])
+		}
+		if _, ok := checkArgs[operatorToken.val]; ok && isIdentifier(operatorToken) {
+			return p.parseCheck(operatorToken.val, tokens[2:])
+		}
+		if isIdentifier(operatorToken) && (operatorToken.val == "test-case" || operatorToken.val == "test-suite") {
+			return p.parseTestCase(operatorToken.val == "test-suite", tokens[2:])
+		}
+		if isIdentifier(operatorToken) && operatorToken.val == "require" {
+			return p.parseRequire(tokens[2:])
+		}
+		if isIdentifier(operatorToken) && operatorToken.val == "provide" {
+			return p.parseProvide(tokens[2:])
+		}
+		if isIdentifier(operatorToken) && operatorToken.val == "module" {
+			return p.parseModule(tokens[2:])
+		}
+		if isIdentifier(operatorToken) && operatorToken.val == ":" {
+			return p.parseTypeAnnotation(tokens[2:])
+		}
 		if isIdentifier(operatorToken) { // parse function call
 			funcName := operatorToken.val
 			leftOver := tokens[2:]
 
 			// parse arguments excluding right parenthesis
 			var funcArguments []Exp
-			if len(leftOver) > 1 {
-				for leftOver[0].tokType != TOK_RPAREN {
-					if !isOperand(leftOver[0]) {
-						var exp Exp
-						return []Token{}, exp, &ParseError{"invalid function arguments"}
-					}
-					var funcExpression Exp
-					leftOver, funcExpression, err = Parser(leftOver)
-					funcArguments = append(funcArguments, funcExpression)
+			for len(leftOver) > 0 && leftOver[0].tokType != TOK_RPAREN {
+				var funcExpression Exp
+				leftOver, funcExpression, err = p.parse(leftOver)
+				if err != nil {
+					var exp Exp
+					return []Token{}, exp, err
 				}
+				funcArguments = append(funcArguments, funcExpression)
 			}
 
 			if len(leftOver) == 0 || leftOver[0].tokType != TOK_RPAREN {
@@ -579,7 +729,7 @@ func Parser(tokens []Token) ([]Token, Exp, error) {
 				leftOver = leftOver[2:]
 
 				// add parameters
-				for leftOver[0].tokType != TOK_RPAREN {
+				for len(leftOver) > 0 && leftOver[0].tokType != TOK_RPAREN {
 					if !isIdentifier(leftOver[0]) {
 						var exp Exp
 						return []Token{}, exp, &ParseError{"invalid function parameters"}
@@ -596,19 +746,23 @@ func Parser(tokens []Token) ([]Token, Exp, error) {
 				// skip right parenthesis
 				leftOver = leftOver[1:]
 
-				if len(leftOver) == 0 || !isLeftParenthesis(leftOver[0]) {
+				if len(leftOver) == 0 || leftOver[0].tokType == TOK_RPAREN {
 					var exp Exp
 					return []Token{}, exp, &ParseError{"missing function expression"}
 				}
 
 				// parse function expression
-				leftOver, varExpression, err = Parser(leftOver)
+				leftOver, varExpression, err = p.parse(leftOver)
+				if err != nil {
+					var exp Exp
+					return []Token{}, exp, err
+				}
 
 				if len(leftOver) == 0 || leftOver[0].tokType != TOK_RPAREN {
 					var exp Exp
 					return []Token{}, exp, &ParseError{"missing closing )"}
 				} else {
-					return []Token{}, &expDefineFunc{varName, varExpression, varOperands}, nil
+					return leftOver[1:], &expDefineFunc{varName, varExpression, varOperands}, nil
 				}
 
 			} else { // parse variable definition
@@ -619,13 +773,17 @@ func Parser(tokens []Token) ([]Token, Exp, error) {
 
 				varName = leftOver[0].val
 				leftOver = leftOver[1:]
-				leftOver, varExpression, err = Parser(leftOver)
+				leftOver, varExpression, err = p.parse(leftOver)
+				if err != nil {
+					var exp Exp
+					return []Token{}, exp, err
+				}
 
 				if len(leftOver) == 0 || leftOver[0].tokType != TOK_RPAREN {
 					var exp Exp
 					return []Token{}, exp, &ParseError{"missing closing )"}
 				} else {
-					return []Token{}, &expDefineVar{varName, varExpression}, nil
+					return leftOver[1:], &expDefineVar{varName, varExpression}, nil
 				}
 			}
 		}
@@ -637,9 +795,13 @@ func Parser(tokens []Token) ([]Token, Exp, error) {
 			var operandList []Exp
 			leftOver := tokens[2:]
 
-			for len(leftOver) == 0 || leftOver[0].tokType != TOK_RPAREN {
+			for len(leftOver) > 0 && leftOver[0].tokType != TOK_RPAREN {
 				var subTree2 Exp
-				leftOver, subTree2, err = Parser(leftOver)
+				leftOver, subTree2, err = p.parse(leftOver)
+				if err != nil {
+					var exp Exp
+					return []Token{}, exp, err
+				}
 				operandList = append(operandList, subTree2)
 			}
 			root = &expOperator{operatorToken.tokType, operandList}
@@ -655,3 +817,72 @@ func Parser(tokens []Token) ([]Token, Exp, error) {
 		return []Token{}, exp, &ParseError{"missing ("}
 	}
 }
+
+// Program is a parsed source text: its top-level forms in order and the
+// position where each parsed expression starts
+type Program struct {
+	Forms     []Exp
+	Positions map[Exp]Pos
+}
+
+// parseTokens parses every top-level form in tokens
+func parseTokens(tokens []Token, positions []Pos) (*Program, error) {
+	p := &parser{tokens, positions, make(map[Exp]Pos)}
+	prog := &Program{Positions: p.exps}
+	for len(tokens) != 0 {
+		start, _ := p.posOf(tokens)
+		leftOver, exp, err := p.parse(tokens)
+		if err != nil {
+			return nil, &SyntaxError{start, err}
+		}
+		prog.Forms = append(prog.Forms, exp)
+		tokens = leftOver
+	}
+	return prog, nil
+}
+
+// balanced reports whether tokens close every parenthesis they open
+func balanced(tokens []Token) bool {
+	depth := 0
+	for _, tok := range tokens {
+		switch tok.tokType {
+		case TOK_LPAREN:
+			depth++
+		case TOK_RPAREN:
+			depth--
+		}
+	}
+	return depth == 0
+}
+
+// topLevelSpans splits tokens into the [start, end) ranges of their
+// top-level forms. A form ends where its parentheses balance, or, when
+// it is never closed, at the next ( in the first column of a line, which
+// is taken to start the next form.
+func topLevelSpans(tokens []Token, positions []Pos) [][2]int {
+	var spans [][2]int
+	start, depth := 0, 0
+	for i := range tokens {
+		if i > start && tokens[i].tokType == TOK_LPAREN && positions[i].Col == 1 && depth > 0 {
+			spans = append(spans, [2]int{start, i})
+			start, depth = i, 0
+		}
+		switch tokens[i].tokType {
+		case TOK_LPAREN:
+			depth++
+		case TOK_RPAREN:
+			depth--
+		case TOK_SYNTAX:
+			// #' belongs to the form after it
+			continue
+		}
+		if depth <= 0 {
+			spans = append(spans, [2]int{start, i + 1})
+			start, depth = i+1, 0
+		}
+	}
+	if start < len(tokens) {
+		spans = append(spans, [2]int{start, len(tokens)})
+	}
+	return spans
+}
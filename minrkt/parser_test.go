@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestParserNoErrors(t *testing.T) {
@@ -51,7 +52,7 @@ func TestParserNoErrors(t *testing.T) {
 	var expSub2 Exp
 	var tokListSub2 []Exp
 	var tokListOperandSub2A Exp
-	tokListOperandSub2A = &expNumConst{0.5}
+	tokListOperandSub2A = &expInexactConst{0.5}
 	tokListSub2 = append(tokListSub2, tokListOperandSub2A)
 	var tokListOperandSub2B Exp
 	tokListOperandSub2B = &expNumConst{50}
@@ -213,16 +214,85 @@ func TestParserExtraToken(t *testing.T) {
 	}
 }
 
+// inputs the fuzz targets found to hang or panic the parser
+func TestParserRegressions(t *testing.T) {
+	var tests = []struct {
+		a       string
+		wantErr string
+	}{
+		{"(+ 1", "1:1: with missing closing )"},
+		{"(-", "1:1: with missing closing )"},
+		{"(if", "1:1: with missing closing )"},
+		{"(if #t 1", "1:1: with missing closing )"},
+		{"(not", "1:1: with missing closing )"},
+		{"(and #t", "1:1: with missing closing )"},
+		{"(+ 1 (1 2))", "1:1: with missing operator"},
+		{"(define (f", "1:1: with missing closing )"},
+		{"(define (f x", "1:1: with missing closing )"},
+		{"(define (f x) (+ x", "1:1: with missing closing )"},
+		{"(define x (+ 1", "1:1: with missing closing )"},
+		{"(+ 1 (define (f", "1:1: with missing closing )"},
+		{"(f \"\\q\" 1)", "1:1: with invalid literal \"\\q\""},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			done := make(chan error, 1)
+			go func() {
+				_, err := ParseSource(tt.a)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if fmt.Sprint(err) != tt.wantErr {
+					t.Errorf("got error %v, want %s", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("parser did not return")
+			}
+		})
+	}
+}
+
+// TestParserCallsAndBodies covers the call and definition syntax beyond
+// the original language: any expression as an argument, and a body that
+// is a single value rather than a parenthesised expression
+func TestParserCallsAndBodies(t *testing.T) {
+	var tests = []struct {
+		a    []string
+		want interface{}
+	}{
+		{[]string{"(define (f x y) (- x y))", "(f (f 5 1) (+ 1 1))"}, 2.0},
+		{[]string{"(define (id x) x)", "(id (id #t))"}, "#t"},
+		{[]string{"(define (greeting) \"hi\")", "(greeting)"}, "hi"},
+		{[]string{"(define (one) 1)", "(+ (one) [one])"}, 2.0},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%v", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			got, err := evalLines(newTestEnv(), tt.a...)
+			if err != nil || got != tt.want {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
 func TestBuildOperandNode(t *testing.T) {
 	var tests = []struct {
 		a        Token
 		wantBool Exp
 	}{
-		{Token{TokenType(2), "5.1"}, &expNumConst{5.1}},
+		{Token{TokenType(2), "5.1"}, &expInexactConst{5.1}},
+		{Token{TOK_NUM, "51"}, &expNumConst{51}},
 		{Token{TokenType(16), "true"}, &expBoolConst{true}},
 		{Token{TokenType(16), "#t"}, &expBoolConst{true}},
 		{Token{TokenType(17), "false"}, &expBoolConst{false}},
 		{Token{TokenType(17), "#f"}, &expBoolConst{false}},
+		{Token{TOK_STRING, "\"a\\tb\""}, &expStrConst{"a\tb"}},
+		// strings may span lines
+		{Token{TOK_STRING, "\"a\nb\""}, &expStrConst{"a\nb"}},
 		// {Token{TokenType(19), "x"}, &expVarConst{"x"}},
 		// {Token{TokenType(19), "num_Const1"}, &expVarConst{"num_Const1"}},
 	}
@@ -264,11 +334,11 @@ func TestEvalVar(t *testing.T) {
 	env := &Environment{}
 	env.CallStack = make([]map[string]interface{}, 0)
 	env.CallStack = append(env.CallStack, map[string]interface{}{"a": 10})
-	env.Variables = make(map[string]interface{})
-	env.Variables["x"] = 1
-	env.Variables["five_5"] = 5.5
-	env.Variables["true"] = true
-	env.Variables["false"] = false
+	env.variables = make(map[string]interface{})
+	env.variables["x"] = 1
+	env.variables["five_5"] = 5.5
+	env.variables["true"] = true
+	env.variables["false"] = false
 	var tests = []struct {
 		a    *expVar
 		want interface{}
@@ -293,26 +363,26 @@ func TestEvalVar(t *testing.T) {
 
 func TestEvalFunc(t *testing.T) {
 	env := &Environment{}
-	env.Functions = make(map[string]FuncParamExpr)
+	env.functions = make(map[string]FuncParamExpr)
 	env.CallStack = make([]map[string]interface{}, 0)
 
 	var add5Exp Exp
 	operandList := []Exp{&expVar{"a"}, &expNumConst{5.5}}
 	add5Exp = &expOperator{TOK_ADD, operandList}
 	funcStr := FuncParamExpr{[]string{"a"}, add5Exp}
-	env.Functions["add5"] = funcStr
+	env.functions["add5"] = funcStr
 
 	var times_5_p_5 Exp
 	operandList2 := []Exp{&expVar{"b"}, &expVar{"five_5"}}
 	times_5_p_5 = &expOperator{TOK_MUL, operandList2}
 	funcStr2 := FuncParamExpr{[]string{"b"}, times_5_p_5}
-	env.Functions["times5_5"] = funcStr2
+	env.functions["times5_5"] = funcStr2
 
-	env.Variables = make(map[string]interface{})
-	env.Variables["x"] = 1
-	env.Variables["five_5"] = 5.5
-	env.Variables["true"] = true
-	env.Variables["false"] = false
+	env.variables = make(map[string]interface{})
+	env.variables["x"] = 1
+	env.variables["five_5"] = 5.5
+	env.variables["true"] = true
+	env.variables["false"] = false
 
 	var tests = []struct {
 		a    *expFunc
@@ -402,7 +472,7 @@ func TestDivideOperator(t *testing.T) {
 		a    *expOperator
 		want float64
 	}{
-		{&expOperator{TOK_DIV, []Exp{&expNumConst{5}}}, 0},
+		{&expOperator{TOK_DIV, []Exp{&expNumConst{5}}}, 0.2},
 		//{&expOperator{TOK_DIV, []Exp{&expNumConst{0}, &expNumConst{8.64}}}, 0},
 		{&expOperator{TOK_DIV, []Exp{&expNumConst{5}, &expNumConst{5}}}, 1},
 		{&expOperator{TOK_DIV, []Exp{&expNumConst{100}, &expNumConst{25}, &expNumConst{2}}}, 2},
@@ -562,6 +632,7 @@ func TestIsOperator(t *testing.T) {
 		{Token{TokenType(9), "<="}, true},
 		{Token{TokenType(10), ">"}, true},
 		{Token{TokenType(11), "<"}, true},
+		{Token{TokenType(14), "not"}, true},
 	}
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%v", tt.a)
@@ -585,3 +656,88 @@ func TestIsNotOperand(t *testing.T) {
 		t.Errorf("isOperand(): got: %v want: %v", got, want)
 	}
 }
+
+func TestParseSource(t *testing.T) {
+	prog, err := ParseSource("(define x 5)\n(define (f a)\n  (+ a x))\n(f 2) x")
+	if err != nil {
+		t.Fatalf("ParseSource(): %v", err)
+	}
+	var forms []string
+	var positions []Pos
+	for _, form := range prog.Forms {
+		forms = append(forms, unparse(form))
+		positions = append(positions, prog.Positions[form])
+	}
+	wantForms := []string{"(define x 5)", "(define (f a) (+ a x))", "(f 2)", "x"}
+	wantPos := []Pos{{1, 1}, {2, 1}, {4, 1}, {4, 7}}
+	if !reflect.DeepEqual(forms, wantForms) || !reflect.DeepEqual(positions, wantPos) {
+		t.Errorf("got %v %v, want %v %v", forms, positions, wantForms, wantPos)
+	}
+	body := prog.Forms[1].(*expDefineFunc).expression
+	if got, want := prog.Positions[body], (Pos{3, 3}); got != want {
+		t.Errorf("body at %v, want %v", got, want)
+	}
+}
+
+func TestParseSourceError(t *testing.T) {
+	_, err := ParseSource("(define x 5)\n  (1 2)")
+	want := "2:3: with missing operator"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	var tests = []struct {
+		a        string
+		want     []string
+		wantErrs []string
+	}{
+		{"(define x 1)\n(+ x 2)", []string{"(define x 1)", "(+ x 2)"}, nil},
+		// an unclosed form ends at the next ( in the first column
+		{"(define (f x) (+ x 1)\n(define y 2)\n(f y)", []string{"(define y 2)", "(f y)"}, []string{"1:1: with missing closing )"}},
+		{"(+ 1 (1 2))\n(define x 5)\n(define)\nx", []string{"(define x 5)", "x"}, []string{"1:1: with missing operator", "3:1: with define requires two inputs"}},
+		{"(define x 1) (check-true) (+ x 1)", []string{"(define x 1)", "(+ x 1)"}, []string{"1:14: with check-true requires 1 expressions and an optional message"}},
+		{")\n(+ 1 2)", []string{"(+ 1 2)"}, []string{"1:1: with missing ("}},
+		// an invalid character is reported once, with the form around it
+		{"(define x @)\n(define y #)\n(* 2 3) @", []string{"(* 2 3)"}, []string{"1:11: Invalid Character @", "2:11: Invalid Character #", "3:9: Invalid Character @"}},
+		{"(define x 1\n(+ x 2 @", []string{}, []string{"1:1: with missing closing )", "2:8: Invalid Character @"}},
+		{"(+ 1 2 @\n(define y 2) @", []string{"(define y 2)"}, []string{"1:8: Invalid Character @", "2:14: Invalid Character @"}},
+		{"(define (f\n  (g x)", nil, []string{"1:1: with invalid function parameters"}},
+		// forms after a macro definition still see the macro
+		{"(define-syntax twice (syntax-rules () [(_ e) (+ e e)]))\n(twice)\n(twice 2)", []string{"(+ 2 2)"}, []string{"2:1: twice: bad syntax"}},
+		{"#'(a b) (+", []string{"(syntax (a b))"}, []string{"1:9: with missing closing )"}},
+		// a mismatched bracket is reported once, and only its form is dropped
+		{"(define x [+ 1 2))\n(* 2 3)", []string{"(* 2 3)"}, []string{"1:17: expected ] to close [, found )"}},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			prog, err := ParseFile(tt.a)
+			var got []string
+			for _, form := range prog.Forms {
+				got = append(got, unparse(form))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got forms %q, want %q", got, tt.want)
+			}
+			var gotErrs []string
+			if errs, ok := err.(SyntaxErrors); ok {
+				for _, e := range errs {
+					gotErrs = append(gotErrs, e.Error())
+				}
+			} else if err != nil {
+				t.Fatalf("got error %v, want SyntaxErrors", err)
+			}
+			if fmt.Sprint(gotErrs) != fmt.Sprint(tt.wantErrs) {
+				t.Errorf("got errors %q, want %q", gotErrs, tt.wantErrs)
+			}
+			for _, form := range prog.Forms {
+				if _, ok := prog.Positions[form]; !ok {
+					t.Errorf("no position for %v", form)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package minrkt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CheckFailure is a check-equal?, check-true or check-exn that did not
+// hold
+type CheckFailure struct {
+	Check   string // the check as written
+	Message string // the check's optional message
+	Details string
+}
+
+func (e *CheckFailure) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s failed (%s): %s", e.Check, e.Message, e.Details)
+	}
+	return fmt.Sprintf("%s failed: %s", e.Check, e.Details)
+}
+
+// TestResult is the outcome of one check, or an error raised by a test
+// case or a top-level form outside of any check
+type TestResult struct {
+	// the names of the enclosing test suites and cases, outermost first
+	Case []string
+	Pos  Pos
+	// nil when the check held, a *CheckFailure when it did not, and any
+	// other error when evaluation failed
+	Err error
+}
+
+func (r TestResult) Passed() bool {
+	return r.Err == nil
+}
+
+func (r TestResult) String() string {
+	var b strings.Builder
+	if r.Pos != (Pos{}) {
+		fmt.Fprintf(&b, "%v: ", r.Pos)
+	}
+	if len(r.Case) > 0 {
+		fmt.Fprintf(&b, "%s: ", strings.Join(r.Case, " > "))
+	}
+	var failure *CheckFailure
+	switch {
+	case r.Err == nil:
+		b.WriteString("passed")
+	case errors.As(r.Err, &failure):
+		fmt.Fprintf(&b, "FAILURE %v", failure)
+	default:
+		fmt.Fprintf(&b, "ERROR %v", r.Err)
+	}
+	return b.String()
+}
+
+// testRun collects the results of RunTests
+type testRun struct {
+	results []TestResult
+	// the test suites and cases being evaluated
+	names []string
+}
+
+func (t *testRun) record(pos Pos, err error) {
+	t.results = append(t.results, TestResult{append([]string(nil), t.names...), pos, err})
+}
+
+// RunTests evaluates prog like EvaluateProgram, but records every check
+// and keeps going after one fails. A failing check ends the test case
+// it is in, and an error in a test case or a top-level form is recorded
+// as that form's result. Only the limits of opts stop the run early.
+func RunTests(prog *Program, env *Environment, opts ...EvalOptions) ([]TestResult, error) {
+	env = env.session(nil, opts)
+	outer := env.positions
+	env.positions = prog.Positions
+	defer func() { env.positions = outer }()
+	run := &testRun{}
+	env.tests = run
+	defer func() { env.tests = nil }()
+	for _, form := range prog.Forms {
+		depth, frameDepth := len(env.CallStack), len(env.frames)
+		if _, err := Evaluator(form, env); err != nil {
+			if isLimitError(err) {
+				return run.results, err
+			}
+			env.CallStack, env.frames = env.CallStack[:depth], env.frames[:frameDepth]
+			var failure *CheckFailure
+			if !errors.As(err, &failure) {
+				run.record(env.positions[form], err)
+			}
+		}
+	}
+	return run.results, nil
+}
+
+// expCheck is (check-equal? actual expected [message]),
+// (check-true expr [message]) or (check-exn predicate expr [message])
+type expCheck struct {
+	name string
+	// the predicate of check-exn
+	predicate string
+	args      []Exp
+	message   Exp
+}
+
+// how many expression arguments each check takes, before the message
+var checkArgs = map[string]int{
+	"check-equal?": 2,
+	"check-true":   1,
+	"check-exn":    1,
+}
+
+func (e *expCheck) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	details, err := e.check(env)
+	if err != nil {
+		return nil, inForm(err, e)
+	}
+	var failure error
+	if details != "" {
+		f := &CheckFailure{Check: e.String(), Details: details}
+		if e.message != nil {
+			msg, err := e.message.Eval(env)
+			if err != nil {
+				return nil, inForm(err, e)
+			}
+			f.Message = displayValue(msg)
+		}
+		failure = f
+	}
+	if env.tests != nil {
+		env.tests.record(env.positions[e], failure)
+	}
+	if failure != nil {
+		return nil, failure
+	}
+	return nil, nil
+}
+
+// check returns why e does not hold, or "" when it does
+func (e *expCheck) check(env *Environment) (string, error) {
+	if e.name == "check-exn" {
+		depth, frameDepth := len(env.CallStack), len(env.frames)
+		_, err := e.args[0].Eval(env)
+		if err == nil {
+			return "no exception raised", nil
+		}
+		val, ok := exnValue(err)
+		if !ok {
+			return "", err
+		}
+		env.CallStack, env.frames = env.CallStack[:depth], env.frames[:frameDepth]
+		matched, err := applyProc(env, e, e.predicate, []interface{}{val})
+		if err != nil {
+			return "", err
+		}
+		// any value but #f counts as true, as everywhere in Racket
+		if matched == false {
+			return "wrong exception raised: " + showValue(val), nil
+		}
+		return "", nil
+	}
+	vals := make([]interface{}, len(e.args))
+	for i, arg := range e.args {
+		val, err := arg.Eval(env)
+		if err != nil {
+			return "", err
+		}
+		vals[i] = val
+	}
+	if e.name == "check-true" {
+		if vals[0] != true {
+			return "actual " + showValue(vals[0]), nil
+		}
+		return "", nil
+	}
+	if !valuesEqual(vals[0], vals[1]) {
+		return "actual " + showValue(vals[0]) + ", expected " + showValue(vals[1]), nil
+	}
+	return "", nil
+}
+
+func (e *expCheck) String() string {
+	parts := []string{e.name}
+	if e.predicate != "" {
+		parts = append(parts, e.predicate)
+	}
+	for _, arg := range e.args {
+		parts = append(parts, unparse(arg))
+	}
+	if e.message != nil {
+		parts = append(parts, unparse(e.message))
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+// expTestCase is (test-case name body ...) or (test-suite name body ...).
+// Both evaluate their body in order; under RunTests, the name labels the
+// results of the checks inside.
+type expTestCase struct {
+	suite bool
+	name  Exp
+	body  []Exp
+}
+
+func (e *expTestCase) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	val, err := e.name.Eval(env)
+	if err != nil {
+		return nil, inForm(err, e)
+	}
+	name, ok := val.(string)
+	if !ok {
+		return nil, inForm(&EvalError{e.keyword() + ": contract violation; expected string?, given " + showValue(val)}, e)
+	}
+	run := env.tests
+	if run != nil {
+		run.names = append(run.names, name)
+		defer func() { run.names = run.names[:len(run.names)-1] }()
+	}
+	depth, frameDepth := len(env.CallStack), len(env.frames)
+	for _, form := range e.body {
+		if _, err := form.Eval(env); err != nil {
+			if run == nil || isLimitError(err) {
+				return nil, inForm(err, e)
+			}
+			// the test case ends here; a failed check is already recorded
+			env.CallStack, env.frames = env.CallStack[:depth], env.frames[:frameDepth]
+			var failure *CheckFailure
+			if !errors.As(err, &failure) {
+				run.record(env.positions[form], err)
+			}
+			break
+		}
+	}
+	return nil, nil
+}
+
+func (e *expTestCase) keyword() string {
+	if e.suite {
+		return "test-suite"
+	}
+	return "test-case"
+}
+
+func (e *expTestCase) String() string {
+	parts := []string{e.keyword(), unparse(e.name)}
+	for _, form := range e.body {
+		parts = append(parts, unparse(form))
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+// parses the remainder of a check after its name
+func (p *parser) parseCheck(name string, tokens []Token) ([]Token, Exp, error) {
+	var exp Exp
+	e := &expCheck{name: name}
+	leftOver := tokens
+	if name == "check-exn" {
+		if len(leftOver) == 0 || !isIdentifier(leftOver[0]) {
+			return []Token{}, exp, &ParseError{"check-exn requires a predicate name"}
+		}
+		e.predicate = leftOver[0].val
+		leftOver = leftOver[1:]
+	}
+	var args []Exp
+	for len(leftOver) > 0 && leftOver[0].tokType != TOK_RPAREN {
+		var arg Exp
+		var err error
+		if leftOver, arg, err = p.parse(leftOver); err != nil {
+			return []Token{}, exp, err
+		}
+		args = append(args, arg)
+	}
+	if len(leftOver) == 0 {
+		return []Token{}, exp, &ParseError{"missing closing )"}
+	}
+	n := checkArgs[name]
+	if len(args) != n && len(args) != n+1 {
+		return []Token{}, exp, &ParseError{fmt.Sprintf("%s requires %d expressions and an optional message", name, n)}
+	}
+	e.args = args[:n]
+	if len(args) > n {
+		e.message = args[n]
+	}
+	return leftOver[1:], e, nil
+}
+
+// parses the remainder of (test-case name body ...) or (test-suite name
+// body ...) after the keyword
+func (p *parser) parseTestCase(suite bool, tokens []Token) ([]Token, Exp, error) {
+	var exp Exp
+	e := &expTestCase{suite: suite}
+	leftOver, name, err := p.parse(tokens)
+	if err != nil {
+		return []Token{}, exp, err
+	}
+	e.name = name
+	for len(leftOver) > 0 && leftOver[0].tokType != TOK_RPAREN {
+		var form Exp
+		if leftOver, form, err = p.parse(leftOver); err != nil {
+			return []Token{}, exp, err
+		}
+		e.body = append(e.body, form)
+	}
+	if len(leftOver) == 0 {
+		return []Token{}, exp, &ParseError{"missing closing )"}
+	}
+	if len(e.body) == 0 {
+		return []Token{}, exp, &ParseError{"missing " + e.keyword() + " body"}
+	}
+	return leftOver[1:], e, nil
+}
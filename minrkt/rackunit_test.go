@@ -0,0 +1,120 @@
+package minrkt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestChecks(t *testing.T) {
+	var tests = []struct {
+		a       string
+		wantErr string
+	}{
+		{"(check-equal? (+ 1 1) 2)", ""},
+		{"(check-equal? (list 1 \"a\") (list 1 \"a\"))", ""},
+		{"(check-equal? (+ 1 1) 3)", "(check-equal? (+ 1 1) 3) failed: actual 2, expected 3"},
+		{"(check-equal? \"a\" \"b\" \"letters\")", "(check-equal? \"a\" \"b\" \"letters\") failed (letters): actual \"a\", expected \"b\""},
+		{"(check-true (< 1 2))", ""},
+		{"(check-true 1)", "(check-true 1) failed: actual 1"},
+		{"(check-exn exn:fail:contract:divide-by-zero? (/ 1 0))", ""},
+		{"(check-exn exn:fail? (raise 5))", "(check-exn exn:fail? (raise 5)) failed: wrong exception raised: 5"},
+		{"(check-exn exn:fail? 5)", "(check-exn exn:fail? 5) failed: no exception raised"},
+		{"(check-exn exn-message (error \"boom\"))", ""},
+		{"(check-equal? (car 1) 1)", "car undefined"},
+		{"(test-case \"t\" (check-true #t) (check-true #f) (car 1))", "(check-true #f) failed: actual #f"},
+		{"(test-case 5 (check-true #t))", "test-case: contract violation; expected string?, given 5"},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			_, err := evalLines(newTestEnv(), tt.a)
+			if fmt.Sprint(err) != fmt.Sprint(tt.wantErr) && !(err == nil && tt.wantErr == "") {
+				t.Fatalf("got error %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseChecks(t *testing.T) {
+	var tests = []struct {
+		a       string
+		wantErr string
+	}{
+		{"(check-equal? 1)", "1:1: with check-equal? requires 2 expressions and an optional message"},
+		{"(check-true 1 2 3)", "1:1: with check-true requires 1 expressions and an optional message"},
+		{"(check-exn (f) 1)", "1:1: with check-exn requires a predicate name"},
+		{"(test-case \"t\")", "1:1: with missing test-case body"},
+		{"(test-suite \"s\" (check-true #t)", "1:1: with missing closing )"},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			_, err := ParseSource(tt.a)
+			if fmt.Sprint(err) != tt.wantErr {
+				t.Errorf("got error %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunTests(t *testing.T) {
+	src := `(define (square x) (* x x))
+(check-equal? (square 2) 4)
+(test-suite "squares"
+  (test-case "small"
+    (check-equal? (square 3) 9)
+    (check-equal? (square 3) 10)
+    (check-true #f))
+  (test-case "errors"
+    (check-exn exn:fail? (square "a"))
+    (square nope)
+    (check-true #f)))
+(check-true (< 2 1))
+(square oops)
+(check-true #t)`
+	prog, err := ParseSource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := RunTests(prog, newTestEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, result := range results {
+		got = append(got, result.String())
+	}
+	want := []string{
+		"2:1: passed",
+		"5:5: squares > small: passed",
+		"6:5: squares > small: FAILURE (check-equal? (square 3) 10) failed: actual 9, expected 10",
+		"9:5: squares > errors: passed",
+		"10:5: squares > errors: ERROR nope undefined",
+		"12:1: FAILURE (check-true (< 2 1)) failed: actual #f",
+		"13:1: ERROR oops undefined",
+		"14:1: passed",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	var failure *CheckFailure
+	if !errors.As(results[2].Err, &failure) || failure.Details != "actual 9, expected 10" {
+		t.Errorf("got %v, want a CheckFailure", results[2].Err)
+	}
+}
+
+func TestRunTestsStopsAtLimits(t *testing.T) {
+	prog, err := ParseSource("(define (loop n) (loop n))\n(test-case \"forever\" (loop 1))\n(check-true #t)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := RunTests(prog, newTestEnv(), EvalOptions{Fuel: 1000})
+	var fuelErr *FuelExhaustedError
+	if !errors.As(err, &fuelErr) || len(results) != 0 {
+		t.Errorf("got %v and %d results, want a FuelExhaustedError", err, len(results))
+	}
+}
@@ -0,0 +1,294 @@
+package minrkt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// expLocal is a parameter reference resolved to its frame and slot:
+// depth counts frames outward from the innermost call and index is the
+// parameter's position. MiniRacket functions do not nest, so depth is
+// always 0 for now.
+type expLocal struct {
+	name         string
+	depth, index int
+}
+
+func (e *expLocal) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	frame := env.frames[len(env.frames)-1-e.depth]
+	return frame.Args[e.index], nil
+}
+
+func (e *expLocal) String() string {
+	return e.name
+}
+
+// expFrame marks a function body whose parameters were resolved to
+// slots. Calls to it skip building the name-keyed parameter map.
+type expFrame struct {
+	body Exp
+	size int
+}
+
+func (e *expFrame) Eval(env *Environment) (interface{}, error) {
+	return e.body.Eval(env)
+}
+
+func (e *expFrame) String() string {
+	return unparse(e.body)
+}
+
+// UnboundRef is an identifier Resolve found no definition for
+type UnboundRef struct {
+	Name     string
+	Pos      Pos  // zero when unknown
+	Function bool // whether it was used as a procedure
+}
+
+func (r UnboundRef) String() string {
+	what := "variable"
+	if r.Function {
+		what = "procedure"
+	}
+	if r.Pos == (Pos{}) {
+		return fmt.Sprintf("unbound %s %s", what, r.Name)
+	}
+	return fmt.Sprintf("%v: unbound %s %s", r.Pos, what, r.Name)
+}
+
+// UnboundError lists every unbound identifier in a program
+type UnboundError struct {
+	Refs []UnboundRef
+}
+
+func (e *UnboundError) Error() string {
+	refs := make([]string, len(e.Refs))
+	for i, ref := range e.Refs {
+		refs[i] = ref.String()
+	}
+	return strings.Join(refs, "; ")
+}
+
+type resolver struct {
+	env *Environment
+	// names the program itself defines, anywhere in it
+	vars, funcs map[string]bool
+	positions   map[Exp]Pos
+	resolved    map[Exp]Pos
+	unbound     []UnboundRef
+	// references to each global variable, leaving out the ones to a
+	// parameter or let-bound name that hides it
+	varUses map[string]int
+	// names bound by the enclosing lets of the current function body
+	lets []string
+}
+
+// Resolve is ResolveProgram for a single expression
+func Resolve(root Exp, env *Environment) (Exp, error) {
+	prog, err := ResolveProgram(&Program{Forms: []Exp{root}}, env)
+	if err != nil {
+		return nil, err
+	}
+	return prog.Forms[0], nil
+}
+
+// ResolveProgram returns prog with every parameter reference replaced by
+// a slot address, ready for EvaluateProgram. Before anything runs it
+// checks that every other identifier is defined by prog, by env or as a
+// builtin, and returns an UnboundError listing the ones that are not.
+func ResolveProgram(prog *Program, env *Environment) (*Program, error) {
+	r := newResolver(prog, env)
+	forms := r.resolveAll(prog.Forms, nil)
+	if len(r.unbound) > 0 {
+		return nil, &UnboundError{r.unbound}
+	}
+	return &Program{Forms: forms, Positions: r.resolved}, nil
+}
+
+func newResolver(prog *Program, env *Environment) *resolver {
+	r := &resolver{
+		env:       env,
+		vars:      make(map[string]bool),
+		funcs:     make(map[string]bool),
+		positions: prog.Positions,
+		resolved:  make(map[Exp]Pos),
+		varUses:   make(map[string]int),
+	}
+	for _, form := range prog.Forms {
+		r.collect(form)
+	}
+	return r
+}
+
+// collect records the names exp defines. A define inside a function body
+// still defines a global, so bodies are searched too.
+func (r *resolver) collect(exp Exp) {
+	switch e := exp.(type) {
+	case *expDefineVar:
+		r.vars[e.name] = true
+		r.collect(e.val)
+	case *expDefineFunc:
+		r.funcs[e.name] = true
+		r.collect(e.expression)
+	case *expFrame:
+		r.collect(e.body)
+	case *expFunc:
+		for _, arg := range e.arguments {
+			r.collect(arg)
+		}
+	case *expOperator:
+		for _, operand := range e.operands {
+			r.collect(operand)
+		}
+	case *expLet:
+		for _, val := range e.vals {
+			r.collect(val)
+		}
+		r.collect(e.body)
+	case *expWithHandlers:
+		r.collect(e.body)
+	case *expRequire:
+		vars, funcs := r.env.requiredNames(e)
+		for _, name := range vars {
+			r.vars[name] = true
+		}
+		for _, name := range funcs {
+			r.funcs[name] = true
+		}
+	case *expSyntaxCase:
+		r.collect(e.subject)
+		for _, clause := range e.clauses {
+			r.collect(clause.body)
+		}
+	case *expCheck:
+		for _, arg := range e.args {
+			r.collect(arg)
+		}
+	case *expTestCase:
+		for _, form := range e.body {
+			r.collect(form)
+		}
+	}
+}
+
+func (r *resolver) checkVar(name string, at Exp) {
+	for _, let := range r.lets {
+		if let == name {
+			return
+		}
+	}
+	r.varUses[name]++
+	if r.vars[name] {
+		return
+	}
+	if _, ok := r.env.lookupVariable(name); !ok {
+		r.unbound = append(r.unbound, UnboundRef{name, r.positions[at], false})
+	}
+}
+
+func (r *resolver) checkFunc(name string, at Exp) {
+	if r.funcs[name] {
+		return
+	}
+	if _, ok := r.env.lookupFunction(name); ok {
+		return
+	}
+	if _, ok := r.env.lookupBuiltin(name); !ok {
+		r.unbound = append(r.unbound, UnboundRef{name, r.positions[at], true})
+	}
+}
+
+func (r *resolver) resolveAll(exps []Exp, params []string) []Exp {
+	resolved := make([]Exp, len(exps))
+	for i, exp := range exps {
+		resolved[i] = r.resolve(exp, params)
+	}
+	return resolved
+}
+
+// resolve returns exp with its parameter references resolved against
+// params, the parameters of the enclosing function
+func (r *resolver) resolve(exp Exp, params []string) Exp {
+	resolved := exp
+	switch e := exp.(type) {
+	case *expVar:
+		index := -1
+		for i := len(params) - 1; i >= 0 && index < 0; i-- {
+			if params[i] == e.name {
+				index = i
+			}
+		}
+		if index >= 0 {
+			resolved = &expLocal{e.name, 0, index}
+		} else {
+			r.checkVar(e.name, e)
+		}
+	case *expFunc:
+		r.checkFunc(e.name, e)
+		resolved = &expFunc{e.name, r.resolveAll(e.arguments, params)}
+	case *expOperator:
+		resolved = &expOperator{e.opType, r.resolveAll(e.operands, params)}
+	case *expDefineVar:
+		resolved = &expDefineVar{e.name, r.resolve(e.val, params)}
+	case *expDefineFunc:
+		body := e.expression
+		if frame, ok := body.(*expFrame); ok {
+			body = frame.body
+		}
+		// a function body does not see the lets around its definition
+		lets := r.lets
+		r.lets = nil
+		frame := &expFrame{r.resolve(body, e.paramNames), len(e.paramNames)}
+		r.lets = lets
+		resolved = &expDefineFunc{e.name, frame, e.paramNames}
+	case *expFrame:
+		resolved = &expFrame{r.resolve(e.body, params), e.size}
+	case *expLet:
+		// let-bound names stay variables, read from the let's scope, and
+		// hide any parameter of the same name
+		inner := make([]string, len(params))
+		for i, param := range params {
+			inner[i] = param
+			for _, name := range e.names {
+				if name == param {
+					inner[i] = ""
+				}
+			}
+		}
+		vals := r.resolveAll(e.vals, params)
+		lets := r.lets
+		r.lets = append(append([]string(nil), lets...), e.names...)
+		resolved = &expLet{e.names, vals, r.resolve(e.body, inner)}
+		r.lets = lets
+	case *expWithHandlers:
+		for _, clause := range e.clauses {
+			r.checkFunc(clause.predicate, e)
+			r.checkFunc(clause.handler, e)
+		}
+		resolved = &expWithHandlers{e.clauses, r.resolve(e.body, params)}
+	case *expSyntaxCase:
+		clauses := make([]syntaxCaseClause, len(e.clauses))
+		for i, clause := range e.clauses {
+			clauses[i] = syntaxCaseClause{clause.pattern, r.resolve(clause.body, params)}
+		}
+		resolved = &expSyntaxCase{r.resolve(e.subject, params), e.literals, clauses}
+	case *expCheck:
+		if e.predicate != "" {
+			r.checkFunc(e.predicate, e)
+		}
+		check := &expCheck{e.name, e.predicate, r.resolveAll(e.args, params), nil}
+		if e.message != nil {
+			check.message = r.resolve(e.message, params)
+		}
+		resolved = check
+	case *expTestCase:
+		resolved = &expTestCase{e.suite, r.resolve(e.name, params), r.resolveAll(e.body, params)}
+	}
+	if pos, ok := r.positions[exp]; ok {
+		r.resolved[resolved] = pos
+	}
+	return resolved
+}
@@ -0,0 +1,140 @@
+package minrkt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// resolveLines is evalLines with each line resolved before it runs
+func resolveLines(env *Environment, lines ...string) (interface{}, error) {
+	var result interface{}
+	for _, line := range lines {
+		prog, err := ParseSource(line)
+		if err != nil {
+			return nil, err
+		}
+		if prog, err = ResolveProgram(prog, env); err != nil {
+			return nil, err
+		}
+		results, err := EvaluateProgram(prog, env)
+		if err != nil {
+			return nil, err
+		}
+		result = results[len(results)-1]
+	}
+	return result, nil
+}
+
+func TestResolvedMatchesEvaluator(t *testing.T) {
+	for _, program := range differentialPrograms {
+		testname := fmt.Sprintf("%s", strings.Join(program, " "))
+		t.Run(testname, func(t *testing.T) {
+			treeEnv, resolvedEnv := newTestEnv(), newTestEnv()
+			for _, line := range program {
+				want, wantErr := evalLines(treeEnv, line)
+				got, gotErr := resolveLines(resolvedEnv, line)
+				var unbound *UnboundError
+				if errors.As(gotErr, &unbound) {
+					// keep both environments in step
+					evalLines(resolvedEnv, line)
+					continue
+				}
+				if fmt.Sprint(wantErr) != fmt.Sprint(gotErr) {
+					t.Fatalf("%s: got error %v, want %v", line, gotErr, wantErr)
+				}
+				if wantErr == nil && fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", want) {
+					t.Errorf("%s: got %#v, want %#v", line, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveUnbound(t *testing.T) {
+	var tests = []struct {
+		a       string
+		wantErr string
+	}{
+		{"(+ x 1)", "1:4: unbound variable x"},
+		{"(define (f a) (+ a b))\n(f 1)", "1:20: unbound variable b"},
+		{"(g 1)", "1:1: unbound procedure g"},
+		{"(define (f) (if #t 1 (h y)))", "1:22: unbound procedure h; 1:25: unbound variable y"},
+		{"(with-handlers ([nope exn-message]) 1)", "1:1: unbound procedure nope"},
+		{"(define (f a) a)\n(+ a 1)", "2:4: unbound variable a"},
+		{"(f x)", "1:1: unbound procedure f; 1:4: unbound variable x"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			prog, err := ParseSource(tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ResolveProgram(prog, newTestEnv())
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveBound(t *testing.T) {
+	env := newTestEnv()
+	if _, err := evalLines(env, "(define g 1)", "(define (twice n) (* 2 n))"); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		a    string
+		want interface{}
+	}{
+		// defined later in the same program
+		{"(define (f) (h))\n(define (h) 7)\n(f)", 7.0},
+		{"(define (f a) (define y a))\n(f 3)\ny", 3.0},
+		{"(twice g)", 2.0},
+		{"(define (f x x) x)\n(f 1 2)", 2.0},
+		{"(define (f a b) (list b a))\n(f 1 2)", []Value{2.0, 1.0}},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			got, err := resolveLines(env.Fork(), tt.a)
+			if err != nil || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvedPositions(t *testing.T) {
+	prog, err := ParseSource("(define (f n) (/ 1 n))\n(+ 1 (f 0))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog, err = ResolveProgram(prog, newTestEnv()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = EvaluateProgram(prog, newTestEnv())
+	var formErr *FormError
+	if !errors.As(err, &formErr) || len(formErr.Context()) != 1 || formErr.Context()[0].Pos != (Pos{2, 6}) {
+		t.Errorf("got %+v, want a context of (f 0) at 2:6", err)
+	}
+}
+
+func BenchmarkResolvedFib(b *testing.B) {
+	env := newTestEnv()
+	if _, err := resolveLines(env, fibSource); err != nil {
+		b.Fatal(err)
+	}
+	exp, err := Resolve(mustParse(b, "(fib 20)"), env)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Evaluator(exp, env); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package minrkt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Symbol is the datum of an identifier, as syntax->datum returns it
+type Symbol string
+
+// Syntax is a syntax object: a form with its source position and its
+// lexical context, which is the mark of the macro expansion that
+// introduced it
+type Syntax struct {
+	stx *stx
+}
+
+func (s *Syntax) String() string {
+	return fmt.Sprintf("#<syntax:%v %v>", s.stx.pos, s.stx)
+}
+
+// String prints s as source text
+func (s *stx) String() string {
+	if !s.list {
+		return s.tok.val
+	}
+	parts := make([]string, len(s.elems))
+	for i, elem := range s.elems {
+		parts[i] = elem.String()
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+// freshMark marks the syntax a template creates while a transformer
+// runs. Once it returns, the expander replaces it with the expansion's
+// own mark.
+const freshMark = -1
+
+// syntaxToDatum strips the syntax from s, or with deep false only from
+// its outermost form
+func syntaxToDatum(s *stx, deep bool) Value {
+	if s.list {
+		lst := make([]Value, len(s.elems))
+		for i, elem := range s.elems {
+			if deep {
+				lst[i] = syntaxToDatum(elem, true)
+			} else {
+				lst[i] = &Syntax{elem}
+			}
+		}
+		return lst
+	}
+	if exp := buildOperandNode(s.tok); exp != nil {
+		return constantValue(exp)
+	}
+	return Symbol(s.tok.val)
+}
+
+// datumToSyntax converts datum to syntax with the position and lexical
+// context of ctx. Syntax objects inside datum are kept as they are.
+func datumToSyntax(ctx *stx, datum Value) (*stx, error) {
+	atom := func(tok Token) *stx {
+		return &stx{tok: tok, pos: ctx.pos, mark: ctx.mark}
+	}
+	switch d := datum.(type) {
+	case *Syntax:
+		return d.stx, nil
+	case []Value:
+		s := &stx{tok: Token{TOK_LPAREN, "("}, list: true, pos: ctx.pos, mark: ctx.mark}
+		for _, elem := range d {
+			e, err := datumToSyntax(ctx, elem)
+			if err != nil {
+				return nil, err
+			}
+			s.elems = append(s.elems, e)
+		}
+		return s, nil
+	case Symbol:
+		tok, rest, err := NextToken(string(d))
+		if err != nil || rest != "" || tok.val != string(d) {
+			tok = Token{TOK_VAR, string(d)}
+		}
+		return atom(tok), nil
+	case float64, inexact:
+		return atom(Token{TOK_NUM, writeValue(d)}), nil
+	case bool:
+		if d {
+			return atom(Token{TOK_TRUE, "#t"}), nil
+		}
+		return atom(Token{TOK_FALSE, "#f"}), nil
+	case string:
+		return atom(Token{TOK_STRING, strconv.Quote(d)}), nil
+	}
+	return nil, &EvalError{"datum->syntax: cannot convert " + showValue(datum) + " to syntax"}
+}
+
+// patternKey is the scope entry of a syntax-case pattern variable. It is
+// not an identifier, so only syntax templates can see it.
+func patternKey(name string) string {
+	return "#pattern:" + name
+}
+
+// expSyntax is (syntax template), also written #'template. It builds a
+// syntax object from template with the pattern variables of the
+// enclosing syntax-case clauses filled in.
+type expSyntax struct {
+	template *stx
+}
+
+func (e *expSyntax) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	b := make(map[string]*binding)
+	if len(env.CallStack) > 0 {
+		for key, val := range env.CallStack[len(env.CallStack)-1] {
+			if bv, ok := val.(*binding); ok {
+				b[strings.TrimPrefix(key, patternKey(""))] = bv
+			}
+		}
+	}
+	s, err := (&macro{name: "syntax"}).instantiate(e.template, b, freshMark, Pos{})
+	if err != nil {
+		return nil, inForm(err, e)
+	}
+	return &Syntax{s}, nil
+}
+
+func (e *expSyntax) String() string {
+	return "(syntax " + e.template.String() + ")"
+}
+
+type syntaxCaseClause struct {
+	pattern *stx
+	body    Exp
+}
+
+// expSyntaxCase is (syntax-case subject (literal ...) [pattern body] ...).
+// The body of the first clause whose pattern matches the syntax object
+// subject is evaluated with the clause's pattern variables in scope.
+type expSyntaxCase struct {
+	subject  Exp
+	literals []string
+	clauses  []syntaxCaseClause
+}
+
+func (e *expSyntaxCase) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	val, err := e.subject.Eval(env)
+	if err != nil {
+		return nil, inForm(err, e)
+	}
+	subject, ok := val.(*Syntax)
+	if !ok {
+		return nil, inForm(&EvalError{"syntax-case: contract violation; expected syntax?, given " + showValue(val)}, e)
+	}
+	m := &macro{name: "syntax-case", literals: make(map[string]bool)}
+	for _, literal := range e.literals {
+		m.literals[literal] = true
+	}
+	for _, clause := range e.clauses {
+		b := make(map[string]*binding)
+		if !m.match(clause.pattern, subject.stx, b) {
+			continue
+		}
+		scope := make(map[string]interface{})
+		if len(env.CallStack) > 0 {
+			for name, val := range env.CallStack[len(env.CallStack)-1] {
+				scope[name] = val
+			}
+		}
+		for name, bv := range b {
+			scope[patternKey(name)] = bv
+		}
+		env.CallStack = append(env.CallStack, scope)
+		result, err := clause.body.Eval(env)
+		env.CallStack = env.CallStack[:len(env.CallStack)-1]
+		if err != nil {
+			return nil, inForm(err, e)
+		}
+		return result, nil
+	}
+	name := subject.stx.head()
+	if name == "" {
+		name = "syntax-case"
+	}
+	return nil, inForm(&MacroError{name, "bad syntax"}, e)
+}
+
+func (e *expSyntaxCase) String() string {
+	clauses := make([]string, len(e.clauses))
+	for i, clause := range e.clauses {
+		clauses[i] = "[" + clause.pattern.String() + " " + unparse(clause.body) + "]"
+	}
+	return "(syntax-case " + unparse(e.subject) + " (" + strings.Join(e.literals, " ") + ") " + strings.Join(clauses, " ") + ")"
+}
+
+// readDatum reads the form tokens start with as syntax
+func (p *parser) readDatum(tokens []Token) (*stx, []Token, error) {
+	depth := 0
+	for i, tok := range tokens {
+		switch tok.tokType {
+		case TOK_LPAREN:
+			depth++
+		case TOK_RPAREN:
+			depth--
+		case TOK_SYNTAX:
+			continue
+		}
+		if depth < 0 {
+			break
+		}
+		if depth == 0 {
+			positions := make([]Pos, i+1)
+			for j := range positions {
+				positions[j], _ = p.posOf(tokens[j:])
+			}
+			forms, ok := readSyntax(tokens[:i+1], positions)
+			if !ok || len(forms) != 1 {
+				break
+			}
+			return forms[0], tokens[i+1:], nil
+		}
+	}
+	return nil, []Token{}, &ParseError{"missing template"}
+}
+
+// parses the remainder of (syntax template) after the syntax keyword
+func (p *parser) parseSyntax(tokens []Token) ([]Token, Exp, error) {
+	var exp Exp
+	template, leftOver, err := p.readDatum(tokens)
+	if err != nil {
+		return []Token{}, exp, err
+	}
+	if len(leftOver) == 0 || leftOver[0].tokType != TOK_RPAREN {
+		return []Token{}, exp, &ParseError{"missing closing )"}
+	}
+	return leftOver[1:], &expSyntax{template}, nil
+}
+
+// parses the remainder of (syntax-case subject (literal ...) [pattern
+// body] ...) after the syntax-case keyword
+func (p *parser) parseSyntaxCase(tokens []Token) ([]Token, Exp, error) {
+	var exp Exp
+	leftOver, subject, err := p.parse(tokens)
+	if err != nil {
+		return []Token{}, exp, err
+	}
+	e := &expSyntaxCase{subject: subject}
+	literals, leftOver, err := p.readDatum(leftOver)
+	if err != nil || !literals.list {
+		return []Token{}, exp, &ParseError{"syntax-case requires a list of literals"}
+	}
+	for _, literal := range literals.elems {
+		name, ok := literal.ident()
+		if !ok {
+			return []Token{}, exp, &ParseError{"syntax-case requires a list of literals"}
+		}
+		e.literals = append(e.literals, name)
+	}
+	for len(leftOver) > 0 && leftOver[0].tokType != TOK_RPAREN {
+		if !isLeftParenthesis(leftOver[0]) {
+			return []Token{}, exp, &ParseError{"invalid syntax-case clause"}
+		}
+		var clause syntaxCaseClause
+		if clause.pattern, leftOver, err = p.readDatum(leftOver[1:]); err != nil {
+			return []Token{}, exp, &ParseError{"invalid syntax-case clause"}
+		}
+		if leftOver, clause.body, err = p.parse(leftOver); err != nil {
+			return []Token{}, exp, err
+		}
+		if len(leftOver) == 0 || leftOver[0].tokType != TOK_RPAREN {
+			return []Token{}, exp, &ParseError{"invalid syntax-case clause"}
+		}
+		e.clauses = append(e.clauses, clause)
+		leftOver = leftOver[1:]
+	}
+	if len(leftOver) == 0 {
+		return []Token{}, exp, &ParseError{"missing closing )"}
+	}
+	return leftOver[1:], e, nil
+}
+
+func syntaxArg(name string, arg Value) (*stx, error) {
+	s, ok := arg.(*Syntax)
+	if !ok {
+		return nil, &EvalError{name + ": contract violation; expected syntax?"}
+	}
+	return s.stx, nil
+}
+
+func init() {
+	defineStandard("syntax?", funcType(tBoolean, tAny), func(args []Value) (Value, error) {
+		_, ok := args[0].(*Syntax)
+		return ok, nil
+	})
+	defineStandard("identifier?", funcType(tBoolean, tAny), func(args []Value) (Value, error) {
+		s, ok := args[0].(*Syntax)
+		if !ok {
+			return false, nil
+		}
+		_, ok = s.stx.ident()
+		return ok, nil
+	})
+	defineStandard("syntax-e", funcType(tAny, tAny), func(args []Value) (Value, error) {
+		s, err := syntaxArg("syntax-e", args[0])
+		if err != nil {
+			return nil, err
+		}
+		return syntaxToDatum(s, false), nil
+	})
+	defineStandard("syntax->datum", funcType(tAny, tAny), func(args []Value) (Value, error) {
+		s, err := syntaxArg("syntax->datum", args[0])
+		if err != nil {
+			return nil, err
+		}
+		return syntaxToDatum(s, true), nil
+	})
+	defineStandard("datum->syntax", funcType(tAny, tAny, tAny), func(args []Value) (Value, error) {
+		ctx := &stx{}
+		if args[0] != false {
+			var err error
+			if ctx, err = syntaxArg("datum->syntax", args[0]); err != nil {
+				return nil, err
+			}
+		}
+		s, err := datumToSyntax(ctx, args[1])
+		if err != nil {
+			return nil, err
+		}
+		return &Syntax{s}, nil
+	})
+	// like Racket's, lines count from 1 and columns from 0, and both are
+	// #f for syntax made without a source position
+	defineStandard("syntax-line", funcType(tAny, tAny), func(args []Value) (Value, error) {
+		s, err := syntaxArg("syntax-line", args[0])
+		if err != nil {
+			return nil, err
+		}
+		if s.pos == (Pos{}) {
+			return false, nil
+		}
+		return float64(s.pos.Line), nil
+	})
+	defineStandard("syntax-column", funcType(tAny, tAny), func(args []Value) (Value, error) {
+		s, err := syntaxArg("syntax-column", args[0])
+		if err != nil {
+			return nil, err
+		}
+		if s.pos == (Pos{}) {
+			return false, nil
+		}
+		return float64(s.pos.Col - 1), nil
+	})
+	defineStandard("symbol?", funcType(tBoolean, tAny), func(args []Value) (Value, error) {
+		_, ok := args[0].(Symbol)
+		return ok, nil
+	})
+	defineStandard("symbol->string", funcType(tString, tAny), func(args []Value) (Value, error) {
+		sym, ok := args[0].(Symbol)
+		if !ok {
+			return nil, &EvalError{"symbol->string: contract violation; expected symbol?"}
+		}
+		return string(sym), nil
+	})
+	defineStandard("string->symbol", funcType(tAny, tString), func(args []Value) (Value, error) {
+		str, ok := args[0].(string)
+		if !ok {
+			return nil, &EvalError{"string->symbol: contract violation; expected string?"}
+		}
+		return Symbol(str), nil
+	})
+}
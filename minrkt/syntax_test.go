@@ -0,0 +1,98 @@
+package minrkt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestProceduralMacros(t *testing.T) {
+	aif := `(define-syntax (aif stx) (syntax-case stx () [(_ c t e) (datum->syntax stx (list (string->symbol "let") (list (list (string->symbol "it") #'c)) (list (string->symbol "if") (string->symbol "it") #'t #'e)))]))`
+	var tests = []struct {
+		a       []string
+		want    interface{}
+		wantErr string
+	}{
+		{[]string{"(define-syntax (swap stx) (syntax-case stx () [(_ a b) #'(list b a)]))", "(swap 1 2)"}, []Value{2.0, 1.0}, ""},
+		{[]string{"(define-syntax (my-list stx) (syntax-case stx () [(_ x ...) (syntax (list x ...))]))", "(my-list 1 2 3)"}, []Value{1.0, 2.0, 3.0}, ""},
+		// clauses are tried in order, and literals match themselves
+		{[]string{"(define-syntax (arrow stx) (syntax-case stx (=>) [(_ a => b) #'(- b a)] [(_ a b) #'(+ a b)]))", "(list (arrow 1 => 5) (arrow 1 5))"}, []Value{4.0, 6.0}, ""},
+		// transformers can compute on the datum of their input
+		{[]string{"(define-syntax (count-args stx) (datum->syntax stx (- (length (syntax->datum stx)) 1)))", "(count-args a b c)"}, 3.0, ""},
+		{[]string{"(define-for-syntax (twice s) (list s s))", "(define-syntax (dup stx) (syntax-case stx () [(_ e) (datum->syntax stx (cons (string->symbol \"list\") (twice #'e)))]))", "(dup 7)"}, []Value{7.0, 7.0}, ""},
+		// syntax from a template is hygienic...
+		{[]string{"(define-syntax (my-or stx) (syntax-case stx () [(_ a b) #'(let ([t a]) (if t t b))]))", "(define t 5)", "(my-or #f t)"}, 5.0, ""},
+		// ...while datum->syntax takes the context of the use, so aif's it
+		// binds the it the user wrote
+		{[]string{aif, "(aif (< 1 2) (if it 30 0) 0)"}, 30.0, ""},
+		{[]string{"(define-syntax (bad stx) 5)", "(bad)"}, nil, "1:1: bad: received value from syntax expander was not syntax: 5"},
+		{[]string{"(define-syntax (one stx) (syntax-case stx () [(_) #'1]))", "(one 2)"}, nil, "1:1: one: bad syntax"},
+		{[]string{"(define-syntax (oops stx) (string->symbol 1))", "(oops)"}, nil, "1:1: string->symbol: contract violation"},
+		{[]string{"(+ 1 (define-for-syntax x 1))"}, nil, "1:6: define-for-syntax: only allowed at the top level"},
+		// syntax objects at run time
+		{[]string{"(syntax->datum #'(a \"s\" 1 #t (b)))"}, []Value{Symbol("a"), "s", 1.0, true, []Value{Symbol("b")}}, ""},
+		{[]string{"(list (syntax? (first (syntax-e #'(a b)))) (syntax? 5))"}, []Value{true, false}, ""},
+		{[]string{"(list (identifier? #'a) (identifier? #'1) (identifier? 5))"}, []Value{true, false, false}, ""},
+		{[]string{"(symbol->string (syntax-e #'abc))"}, "abc", ""},
+		{[]string{"(syntax->datum (datum->syntax #f (list (string->symbol \"f\") 1)))"}, []Value{Symbol("f"), 1.0}, ""},
+		{[]string{"(syntax-case #'(1 2) () [(a b) (syntax->datum #'(b a))])"}, []Value{2.0, 1.0}, ""},
+		{[]string{"(syntax-case 5 () [x 1])"}, nil, "syntax-case: contract violation; expected syntax?, given 5"},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", strings.Join(tt.a, " "))
+		t.Run(testname, func(t *testing.T) {
+			got, err := expandLines(NewStandardExpander(), newTestEnv(), tt.a...)
+			if err != nil && tt.wantErr != "" && strings.Contains(err.Error(), tt.wantErr) {
+				return
+			}
+			if err != nil || tt.wantErr != "" {
+				t.Fatalf("got error %v, want %s", err, tt.wantErr)
+			}
+			if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyntaxPositions(t *testing.T) {
+	var tests = []struct {
+		a    string
+		want interface{}
+	}{
+		{"(list (syntax-line #'x) (syntax-column #'x))", []Value{1.0, 41.0}},
+		{"(syntax-column (first (rest (syntax-e #'(ab c)))))", 44.0},
+		{"(syntax-line\n  #'\n  x)", 3.0},
+		// columns count from 0
+		{"(syntax-column (first (syntax-e #'(\nab c))))", 0.0},
+		{"(list (syntax-line (datum->syntax #f 1)) (syntax-column (datum->syntax #f 1)))", []Value{false, false}},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			got, err := expandLines(NewExpander(), newTestEnv(), tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpanderTrace(t *testing.T) {
+	var trace strings.Builder
+	x := NewStandardExpander()
+	x.Trace = &trace
+	if _, err := x.ParseSource("(define-syntax (swap stx) (syntax-case stx () [(_ a b) #'(list b a)]))\n(swap 1 (unless #f 2))"); err != nil {
+		t.Fatal(err)
+	}
+	want := "2:1: (swap 1 (unless #f 2))\n  => (list (unless #f 2) 1)\n" +
+		"2:9: (unless #f 2)\n  => (if #f (void) 2)\n"
+	if got := trace.String(); got != want {
+		t.Errorf("got trace\n%s\nwant\n%s", got, want)
+	}
+}
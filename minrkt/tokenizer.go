@@ -3,7 +3,9 @@ package minrkt
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
 type Token struct {
@@ -35,12 +37,14 @@ const (
 	TOK_FALSE
 	TOK_DEFINE
 	TOK_VAR
+	TOK_STRING
+	TOK_SYNTAX
 )
 
 var tokenRegexList = []string{
-	`^(\()`,
-	`^(\))`,
-	`^([1-9][0-9]*(?:\.[0-9]*)?)`,
+	`^(\(|\[)`,
+	`^(\)|\])`,
+	`^([0-9]+(?:\.[0-9]*)?|[+-]inf\.0|[+-]nan\.0)`,
 	`^(\+)`,
 	`^(\-)`,
 	`^(\*)`,
@@ -57,9 +61,25 @@ var tokenRegexList = []string{
 	`^(true|#t)`,
 	`^(false|#f)`,
 	`^(define)`,
-	`^([a-zA-Z][a-zA-z0-9_]*)`,
+	`^(` + identPattern + `)`,
+	`^("(?:[^"\\]|\\.)*")`,
+	`^(#')`,
 }
 
+// identifiers may contain the punctuation Racket allows, e.g. exn:fail?
+// and with-handlers. A leading operator character only starts an
+// identifier when it is not followed by a digit, so "+12" is still + 12.
+// The ellipsis ... of syntax-rules is an identifier too.
+const identPattern = `[a-zA-Z!$%&:?^_~][a-zA-Z0-9!$%&*/:<=>?^_~+\-.]*` +
+	`|[-+*/<=>][a-zA-Z!$%&*/:<=>?^_~+\-.][a-zA-Z0-9!$%&*/:<=>?^_~+\-.]*` +
+	`|\.\.\.`
+
+var (
+	tokenRe = regexp.MustCompile(strings.Join(tokenRegexList, "|"))
+	identRe = regexp.MustCompile(`^(?:` + identPattern + `)`)
+	wsRe    = regexp.MustCompile(`^\s+`)
+)
+
 type InvalidCharError struct {
 	c string
 }
@@ -68,6 +88,65 @@ func (e *InvalidCharError) Error() string {
 	return fmt.Sprintf("Invalid Character %s", e.c)
 }
 
+// BracketError is a list closed by a different kind of bracket than the
+// one that opened it, e.g. (+ 1 2]
+type BracketError struct {
+	open, close string
+}
+
+func (e *BracketError) Error() string {
+	return fmt.Sprintf("expected %s to close %s, found %s", closers[e.open], e.open, e.close)
+}
+
+// the bracket that closes each opening bracket
+var closers = map[string]string{"(": ")", "[": "]"}
+
+// Pos is a 1-based line and column in source text. Columns count
+// characters, not bytes.
+type Pos struct {
+	Line int `json:"line"`
+	Col  int `json:"column"`
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+func (p Pos) before(q Pos) bool {
+	return p.Line < q.Line || (p.Line == q.Line && p.Col < q.Col)
+}
+
+// SyntaxError is a tokenizer or parser error at a known position
+type SyntaxError struct {
+	Pos Pos
+	Err error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Pos, e.Err)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// SyntaxErrors lists every syntax error ParseFile found, in source order
+type SyntaxErrors []*SyntaxError
+
+func (e SyntaxErrors) Error() string {
+	errs := make([]string, len(e))
+	for i, err := range e {
+		errs[i] = err.Error()
+	}
+	return strings.Join(errs, "\n")
+}
+
+func (e SyntaxErrors) sort() {
+	sort.SliceStable(e, func(i, j int) bool {
+		return e[i].Pos.before(e[j].Pos)
+	})
+}
+
 // returns -1 if no matching token
 func getTokenIndx(tokenList []string) int {
 	indx := -1
@@ -79,12 +158,12 @@ func getTokenIndx(tokenList []string) int {
 	return indx
 }
 
-// Maps first character of input to a Token
+// Maps the start of input to a Token
 // currently also responsible for validating characters
-// does not accept leading zeroes
+// numbers are integers, decimals such as 0.5 and 2., or +inf.0, -inf.0
+// and +nan.0; leading zeroes are allowed, so 05 is 5
 func NextToken(remainder string) (Token, string, error) {
-	re := regexp.MustCompile(strings.Join(tokenRegexList, "|"))
-	wsRe := regexp.MustCompile(`^\s+`)
+	re := tokenRe
 	var token Token
 	var newRemainder string
 	var err error
@@ -98,12 +177,18 @@ func NextToken(remainder string) (Token, string, error) {
 		indx := getTokenIndx(tokenList)
 
 		if indx < 0 {
-			err = &InvalidCharError{remainder[0:1]}
+			_, size := utf8.DecodeRuneInString(remainder)
+			err = &InvalidCharError{remainder[:size]}
 			newRemainder = ""
 		} else {
 			token.tokType, token.val = TokenType(indx), tokenList[0]
+			// keywords and operators that prefix a longer identifier
+			// (andy, if-zero, ->) belong to that identifier
+			if ident := identRe.FindString(remainder); len(ident) > len(token.val) {
+				token.tokType, token.val = TOK_VAR, ident
+			}
 
-			tokenSize := len(tokenList[0])
+			tokenSize := len(token.val)
 			newRemainder = remainder[tokenSize:]
 		}
 	}
@@ -112,20 +197,84 @@ func NextToken(remainder string) (Token, string, error) {
 }
 
 // returns a list of tokens
-// assumes no empty input will be passed
 func Tokenizer(line string) ([]Token, error) {
+	tokens, _, err := TokenizeSource(line)
+	return tokens, err
+}
+
+// TokenizeSource tokenizes text that may span several lines and contain
+// ; comments, returning the position of each token alongside it. A #lang
+// line before the first token is skipped like a comment.
+func TokenizeSource(src string) ([]Token, []Pos, error) {
+	return tokenize(src, nil)
+}
 
-	remainder := line
+// tokenize is TokenizeSource. With errs, it records every invalid
+// character and mismatched bracket there and carries on instead of
+// stopping at the first.
+func tokenize(src string, errs *SyntaxErrors) ([]Token, []Pos, error) {
 	var tokens []Token
-	for {
+	var positions []Pos
+	// the brackets of the lists still open
+	var open []string
+	pos := Pos{1, 1}
+	remainder := src
+	for len(remainder) != 0 {
+		switch c := remainder[0]; {
+		case c == '\n':
+			pos.Line, pos.Col = pos.Line+1, 1
+			remainder = remainder[1:]
+			continue
+		case c == ';', len(tokens) == 0 && strings.HasPrefix(remainder, "#lang"):
+			end := strings.IndexByte(remainder, '\n')
+			if end < 0 {
+				end = len(remainder)
+			}
+			pos.Col += utf8.RuneCountInString(remainder[:end])
+			remainder = remainder[end:]
+			continue
+		case wsRe.MatchString(remainder[:1]):
+			pos.Col++
+			remainder = remainder[1:]
+			continue
+		}
 		token, newRemainder, err := NextToken(remainder)
-		if err != nil {
-			return nil, err
+		if err != nil && errs != nil {
+			*errs = append(*errs, &SyntaxError{pos, err})
+			_, size := utf8.DecodeRuneInString(remainder)
+			pos.Col++
+			remainder = remainder[size:]
+			continue
+		} else if err != nil {
+			return nil, nil, &SyntaxError{pos, err}
+		}
+		switch token.tokType {
+		case TOK_LPAREN:
+			open = append(open, token.val)
+		case TOK_RPAREN:
+			// an unmatched close is left to the parser
+			if len(open) == 0 {
+				break
+			}
+			opener := open[len(open)-1]
+			open = open[:len(open)-1]
+			if closers[opener] == token.val {
+				break
+			}
+			err := &SyntaxError{pos, &BracketError{opener, token.val}}
+			if errs == nil {
+				return nil, nil, err
+			}
+			*errs = append(*errs, err)
 		}
 		tokens = append(tokens, token)
-		if len(newRemainder) == 0 {
-			return tokens, nil
+		positions = append(positions, pos)
+		pos.Col += utf8.RuneCountInString(remainder[:len(remainder)-len(newRemainder)])
+		if lines := strings.Count(token.val, "\n"); lines > 0 {
+			pos.Line += lines
+			pos.Col = utf8.RuneCountInString(token.val[strings.LastIndexByte(token.val, '\n')+1:]) + 1
 		}
 		remainder = newRemainder
 	}
+	return tokens, positions, nil
 }
@@ -30,6 +30,11 @@ func TestTokenizer(t *testing.T) {
 			{TokenType(2), "9"},
 			{TokenType(1), ")"},
 		}, nil},
+		{"0", []Token{{TokenType(2), "0"}}, nil},
+		{"0.25", []Token{{TokenType(2), "0.25"}}, nil},
+		{"+inf.0", []Token{{TokenType(2), "+inf.0"}}, nil},
+		{"-inf.0", []Token{{TokenType(2), "-inf.0"}}, nil},
+		{"+nan.0", []Token{{TokenType(2), "+nan.0"}}, nil},
 		{"-", []Token{{TokenType(4), "-"}}, nil},
 		{"*", []Token{{TokenType(5), "*"}}, nil},
 		{"/", []Token{{TokenType(6), "/"}}, nil},
@@ -62,6 +67,58 @@ func TestTokenizer(t *testing.T) {
 	}
 }
 
+// TestTokenizerRacketSyntax covers the lexical syntax beyond the original
+// language: strings, square brackets and identifiers with Racket's
+// punctuation
+func TestTokenizerRacketSyntax(t *testing.T) {
+	var tests = []struct {
+		a       string
+		wantTok []Token
+		wantE   error
+	}{
+		{"exn:fail?", []Token{{TokenType(19), "exn:fail?"}}, nil},
+		{"with-handlers", []Token{{TokenType(19), "with-handlers"}}, nil},
+		{"android", []Token{{TokenType(19), "android"}}, nil},
+		{"->", []Token{{TokenType(19), "->"}}, nil},
+		{`"a \"b\""`, []Token{{TokenType(20), `"a \"b\""`}}, nil},
+		{"[]", []Token{
+			{TokenType(0), "["},
+			{TokenType(1), "]"},
+		}, nil},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			tok, e := Tokenizer(tt.a)
+			if !(reflect.DeepEqual(tok, tt.wantTok)) || e != tt.wantE {
+				t.Errorf("got %v %v, want %v %v", tok, e, tt.wantTok, tt.wantE)
+			}
+		})
+	}
+}
+
+func TestTokenizerLeadingZeros(t *testing.T) {
+	var tests = []struct {
+		a       string
+		wantTok []Token
+	}{
+		{"05", []Token{{TOK_NUM, "05"}}},
+		{"007", []Token{{TOK_NUM, "007"}}},
+		{"00.5", []Token{{TOK_NUM, "00.5"}}},
+		{"0", []Token{{TOK_NUM, "0"}}},
+		{"(* 05 2)", []Token{{TOK_LPAREN, "("}, {TOK_MUL, "*"}, {TOK_NUM, "05"}, {TOK_NUM, "2"}, {TOK_RPAREN, ")"}}},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			tok, e := Tokenizer(tt.a)
+			if !reflect.DeepEqual(tok, tt.wantTok) || e != nil {
+				t.Errorf("got %v %v, want %v", tok, e, tt.wantTok)
+			}
+		})
+	}
+}
+
 func TestNextToken(t *testing.T) {
 	var tests = []struct {
 		a       string
@@ -122,3 +179,78 @@ func TestGetTokenIndx(t *testing.T) {
 		})
 	}
 }
+
+func TestTokenizeSource(t *testing.T) {
+	src := "; comment\n(+  1\n\t 22) ; trailing\n\"a\nb\" x"
+	wantTok := []Token{
+		{TOK_LPAREN, "("},
+		{TOK_ADD, "+"},
+		{TOK_NUM, "1"},
+		{TOK_NUM, "22"},
+		{TOK_RPAREN, ")"},
+		{TOK_STRING, "\"a\nb\""},
+		{TOK_VAR, "x"},
+	}
+	wantPos := []Pos{{2, 1}, {2, 2}, {2, 5}, {3, 3}, {3, 5}, {4, 1}, {5, 4}}
+	tok, pos, err := TokenizeSource(src)
+	if !reflect.DeepEqual(tok, wantTok) || !reflect.DeepEqual(pos, wantPos) || err != nil {
+		t.Errorf("got %v %v %v, want %v %v", tok, pos, err, wantTok, wantPos)
+	}
+}
+
+func TestTokenizeSourceCountsCharacters(t *testing.T) {
+	src := "; naïve\n(\"héllo\" x) ; ü\n\"ü\nÿ\" y"
+	wantPos := []Pos{{2, 1}, {2, 2}, {2, 10}, {2, 11}, {3, 1}, {4, 4}}
+	_, pos, err := TokenizeSource(src)
+	if !reflect.DeepEqual(pos, wantPos) || err != nil {
+		t.Errorf("got %v %v, want %v", pos, err, wantPos)
+	}
+	var errs SyntaxErrors
+	_, pos, _ = tokenize(src+" ü z", &errs)
+	wantPos = append(wantPos, Pos{4, 8})
+	if !reflect.DeepEqual(pos, wantPos) || fmt.Sprint(errs) != "4:6: Invalid Character ü" {
+		t.Errorf("got %v %v, want %v and an error at 4:6", pos, errs, wantPos)
+	}
+}
+
+func TestTokenizeSourceInvalidChar(t *testing.T) {
+	_, _, err := TokenizeSource("(+ 1\n  {)")
+	want := "2:3: Invalid Character {"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
+
+func TestTokenizeSourceMismatchedBrackets(t *testing.T) {
+	tests := []struct {
+		a    string
+		want string
+	}{
+		{"(+ 1 2]", "1:7: expected ) to close (, found ]"},
+		{"[+ 1 2)", "1:7: expected ] to close [, found )"},
+		{"(let ([x 1)) x)", "1:11: expected ] to close [, found )"},
+		{"(let ([x 1])\n  x]", "2:4: expected ) to close (, found ]"},
+		{"(let ([x 1]) x)", ""},
+		{"[+ 1 2]", ""},
+		// unbalanced brackets are the parser's to report
+		{"(+ 1 2))", ""},
+		{"(+ 1 2", ""},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			_, _, err := TokenizeSource(tt.a)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if _, ok := err.(*SyntaxError); err != nil && !ok {
+				t.Errorf("got %T, want *SyntaxError", err)
+			}
+		})
+	}
+}
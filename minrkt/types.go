@@ -0,0 +1,500 @@
+package minrkt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// typ is a type in a (: name type) annotation: Number, Boolean, String,
+// Void, Any, (Listof elem) or (-> params... result)
+type typ struct {
+	name   string
+	elem   *typ
+	params []*typ
+	rest   *typ // type of any further arguments; builtins only
+	result *typ
+}
+
+var (
+	tNumber  = &typ{name: "Number"}
+	tBoolean = &typ{name: "Boolean"}
+	tString  = &typ{name: "String"}
+	tVoid    = &typ{name: "Void"}
+	tAny     = &typ{name: "Any"}
+	tList    = &typ{name: "Listof", elem: tAny}
+)
+
+var baseTypes = map[string]*typ{
+	"Number":  tNumber,
+	"Boolean": tBoolean,
+	"String":  tString,
+	"Void":    tVoid,
+	"Any":     tAny,
+}
+
+func funcType(result *typ, params ...*typ) *typ {
+	return &typ{name: "->", params: params, result: result}
+}
+
+// restType is funcType for a builtin that also takes any number of
+// further arguments of type rest
+func restType(result, rest *typ, params ...*typ) *typ {
+	return &typ{name: "->", params: params, rest: rest, result: result}
+}
+
+// arity is the Builtin arity of a function type
+func (t *typ) arity() int {
+	if t.rest != nil {
+		return AtLeast(len(t.params))
+	}
+	return len(t.params)
+}
+
+func (t *typ) String() string {
+	switch t.name {
+	case "Listof":
+		return "(Listof " + t.elem.String() + ")"
+	case "->":
+		parts := []string{"->"}
+		for _, param := range t.params {
+			parts = append(parts, param.String())
+		}
+		if t.rest != nil {
+			parts = append(parts, t.rest.String(), "*")
+		}
+		return "(" + strings.Join(append(parts, t.result.String()), " ") + ")"
+	}
+	return t.name
+}
+
+// compatible reports whether a value of type given may be used where
+// want is expected. Any is compatible with every type in both
+// directions, so unannotated code checks without complaint.
+func compatible(given, want *typ) bool {
+	if given == tAny || want == tAny {
+		return true
+	}
+	if given.name != want.name {
+		return false
+	}
+	switch given.name {
+	case "Listof":
+		return compatible(given.elem, want.elem)
+	case "->":
+		if len(given.params) != len(want.params) || !compatible(given.result, want.result) {
+			return false
+		}
+		for i := range given.params {
+			if !compatible(want.params[i], given.params[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// join is the type of a value that has type a or type b
+func join(a, b *typ) *typ {
+	if a.String() == b.String() {
+		return a
+	}
+	return tAny
+}
+
+// expTypeAnn is a (: name type) annotation. It only informs the
+// TypeChecker and does nothing when evaluated.
+type expTypeAnn struct {
+	name string
+	typ  *typ
+}
+
+func (e *expTypeAnn) Eval(env *Environment) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (e *expTypeAnn) String() string {
+	return "(: " + e.name + " " + e.typ.String() + ")"
+}
+
+// parses the remainder of (: name type) after the colon
+func (p *parser) parseTypeAnnotation(tokens []Token) ([]Token, Exp, error) {
+	var exp Exp
+	if len(tokens) == 0 || !isIdentifier(tokens[0]) {
+		return []Token{}, exp, &ParseError{"missing name in type annotation"}
+	}
+	name := tokens[0].val
+	leftOver, t, err := parseType(tokens[1:])
+	if err != nil {
+		return []Token{}, exp, err
+	}
+	if len(leftOver) == 0 || leftOver[0].tokType != TOK_RPAREN {
+		return []Token{}, exp, &ParseError{"missing closing )"}
+	}
+	return leftOver[1:], &expTypeAnn{name, t}, nil
+}
+
+func parseType(tokens []Token) ([]Token, *typ, error) {
+	if len(tokens) == 0 {
+		return []Token{}, nil, &ParseError{"missing type"}
+	}
+	if isIdentifier(tokens[0]) {
+		t, ok := baseTypes[tokens[0].val]
+		if !ok {
+			return []Token{}, nil, &ParseError{"unknown type " + tokens[0].val}
+		}
+		return tokens[1:], t, nil
+	}
+	if len(tokens) < 2 || !isLeftParenthesis(tokens[0]) || !isIdentifier(tokens[1]) {
+		return []Token{}, nil, &ParseError{"invalid type"}
+	}
+	constructor := tokens[1].val
+	if constructor != "->" && constructor != "Listof" {
+		return []Token{}, nil, &ParseError{"unknown type constructor " + constructor}
+	}
+	var args []*typ
+	leftOver := tokens[2:]
+	for len(leftOver) > 0 && leftOver[0].tokType != TOK_RPAREN {
+		var arg *typ
+		var err error
+		if leftOver, arg, err = parseType(leftOver); err != nil {
+			return []Token{}, nil, err
+		}
+		args = append(args, arg)
+	}
+	if len(leftOver) == 0 {
+		return []Token{}, nil, &ParseError{"missing closing )"}
+	}
+	if constructor == "Listof" {
+		if len(args) != 1 {
+			return []Token{}, nil, &ParseError{"Listof requires 1 type"}
+		}
+		return leftOver[1:], &typ{name: "Listof", elem: args[0]}, nil
+	}
+	if len(args) == 0 {
+		return []Token{}, nil, &ParseError{"-> requires a result type"}
+	}
+	return leftOver[1:], funcType(args[len(args)-1], args[:len(args)-1]...), nil
+}
+
+// TypeError is a misuse of a value found by the TypeChecker
+type TypeError struct {
+	Pos Pos // zero when unknown
+	Msg string
+}
+
+func (e *TypeError) Error() string {
+	if e.Pos == (Pos{}) {
+		return e.Msg
+	}
+	return fmt.Sprintf("%v: %s", e.Pos, e.Msg)
+}
+
+// TypeCheckError lists every TypeError in a program
+type TypeCheckError struct {
+	Errors []*TypeError
+}
+
+func (e *TypeCheckError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// TypeChecker checks programs against their (: name type) annotations
+// before they run. It remembers the types of the definitions in each
+// program it accepts, for use by the programs checked after it.
+// Unannotated parameters and globals have type Any, which is never an
+// error, so checking is opt-in one annotation at a time.
+type TypeChecker struct {
+	funcs, vars map[string]*typ
+	annotations map[string]*typ
+	// the environment the checked programs run in, nil for the standard
+	// builtins only
+	env *Environment
+}
+
+// NewTypeChecker returns a TypeChecker that knows the types of the
+// standard builtins
+func NewTypeChecker() *TypeChecker {
+	return NewTypeCheckerFor(nil)
+}
+
+// NewTypeCheckerFor returns a TypeChecker for programs run in env. It
+// also knows the types of env's I/O builtins and prelude functions, and
+// treats the builtins env overrides with DefineBuiltin as untyped.
+func NewTypeCheckerFor(env *Environment) *TypeChecker {
+	return &TypeChecker{make(map[string]*typ), make(map[string]*typ), make(map[string]*typ), env}
+}
+
+type typeCheck struct {
+	funcs, vars map[string]*typ
+	annotations map[string]*typ
+	env         *Environment
+	positions   map[Exp]Pos
+	errors      []*TypeError
+}
+
+// builtinType returns the signature of the builtin c's programs call
+// name, or nil if it has none
+func (c *typeCheck) builtinType(name string) *typ {
+	builtin, ok := standardBuiltins[name]
+	if c.env != nil {
+		builtin, ok = c.env.lookupBuiltin(name)
+	}
+	if !ok {
+		return nil
+	}
+	return builtin.typ
+}
+
+// globalType returns the type of the function or builtin c's programs
+// call name that they do not define themselves
+func (c *typeCheck) globalType(name string) *typ {
+	if c.env != nil {
+		if fn, ok := c.env.lookupFunction(name); ok {
+			if t := c.env.globals().types[fn.expression]; t != nil {
+				return t
+			}
+			return funcType(tAny, anyTypes(len(fn.params))...)
+		}
+	}
+	return c.builtinType(name)
+}
+
+func anyTypes(n int) []*typ {
+	types := make([]*typ, n)
+	for i := range types {
+		types[i] = tAny
+	}
+	return types
+}
+
+// Check type checks prog and returns a TypeCheckError if it finds any
+// misuse, in which case the definitions in prog are not remembered
+func (tc *TypeChecker) Check(prog *Program) error {
+	c := &typeCheck{
+		funcs:       make(map[string]*typ),
+		vars:        make(map[string]*typ),
+		annotations: make(map[string]*typ),
+		env:         tc.env,
+		positions:   prog.Positions,
+	}
+	for name, t := range tc.funcs {
+		c.funcs[name] = t
+	}
+	for name, t := range tc.vars {
+		c.vars[name] = t
+	}
+	for name, t := range tc.annotations {
+		c.annotations[name] = t
+	}
+	for _, form := range prog.Forms {
+		walkExp(form, func(e Exp) {
+			switch e := e.(type) {
+			case *expTypeAnn:
+				c.annotations[e.name] = e.typ
+				if e.typ.name == "->" {
+					c.funcs[e.name] = e.typ
+				} else {
+					c.vars[e.name] = e.typ
+				}
+			case *expDefineFunc:
+				// calls before the definition still get an arity check
+				if _, ok := c.funcs[e.name]; !ok {
+					c.funcs[e.name] = funcType(tAny, anyTypes(len(e.paramNames))...)
+				}
+			}
+		})
+	}
+	for _, form := range prog.Forms {
+		c.infer(form, nil)
+	}
+	if len(c.errors) > 0 {
+		return &TypeCheckError{c.errors}
+	}
+	tc.funcs, tc.vars, tc.annotations = c.funcs, c.vars, c.annotations
+	return nil
+}
+
+func (c *typeCheck) errorf(at Exp, format string, args ...interface{}) {
+	c.errors = append(c.errors, &TypeError{c.positions[at], fmt.Sprintf(format, args...)})
+}
+
+// expect checks that exp has a type compatible with want
+func (c *typeCheck) expect(exp Exp, locals map[string]*typ, want *typ, what string) {
+	if given := c.infer(exp, locals); !compatible(given, want) {
+		c.errorf(exp, "%s: expected %v, given %v", what, want, given)
+	}
+}
+
+// infer returns the type of exp, recording an error for every misuse in
+// it. locals holds the types of the enclosing function's parameters.
+func (c *typeCheck) infer(exp Exp, locals map[string]*typ) *typ {
+	switch e := exp.(type) {
+	case *expNumConst, *expInexactConst:
+		return tNumber
+	case *expBoolConst:
+		return tBoolean
+	case *expStrConst:
+		return tString
+	case *expVar:
+		if t, ok := locals[e.name]; ok {
+			return t
+		}
+		if t, ok := c.vars[e.name]; ok {
+			return t
+		}
+		return tAny
+	case *expLocal:
+		if t, ok := locals[e.name]; ok {
+			return t
+		}
+		return tAny
+	case *expFrame:
+		return c.infer(e.body, locals)
+	case *expOperator:
+		return c.inferOperator(e, locals)
+	case *expFunc:
+		ft, ok := c.funcs[e.name]
+		if !ok {
+			ft = c.globalType(e.name)
+		}
+		if ft == nil {
+			for _, arg := range e.arguments {
+				c.infer(arg, locals)
+			}
+			return tAny
+		}
+		if len(e.arguments) < len(ft.params) || (ft.rest == nil && len(e.arguments) > len(ft.params)) {
+			expected := fmt.Sprint(len(ft.params))
+			if ft.rest != nil {
+				expected = "at least " + expected
+			}
+			c.errorf(e, "%s: arity mismatch; expected %s, given %d", e.name, expected, len(e.arguments))
+		}
+		for i, arg := range e.arguments {
+			want := ft.rest
+			if i < len(ft.params) {
+				want = ft.params[i]
+			}
+			if want == nil {
+				c.infer(arg, locals)
+				continue
+			}
+			c.expect(arg, locals, want, fmt.Sprintf("%s argument %d", e.name, i+1))
+		}
+		return ft.result
+	case *expDefineVar:
+		t := c.infer(e.val, locals)
+		if ann, ok := c.annotations[e.name]; ok {
+			if !compatible(t, ann) {
+				c.errorf(e.val, "%s: expected %v, given %v", e.name, ann, t)
+			}
+			t = ann
+		}
+		c.vars[e.name] = t
+		return tVoid
+	case *expDefineFunc:
+		c.inferDefineFunc(e)
+		return tVoid
+	case *expLet:
+		inner := make(map[string]*typ)
+		for name, t := range locals {
+			inner[name] = t
+		}
+		for i, val := range e.vals {
+			inner[e.names[i]] = c.infer(val, locals)
+		}
+		return c.infer(e.body, inner)
+	case *expWithHandlers:
+		c.infer(e.body, locals)
+		return tAny
+	case *expTypeAnn:
+		return tVoid
+	}
+	return tAny
+}
+
+func (c *typeCheck) inferDefineFunc(e *expDefineFunc) {
+	locals := make(map[string]*typ)
+	ann, annotated := c.annotations[e.name]
+	if annotated && (ann.name != "->" || len(ann.params) != len(e.paramNames)) {
+		c.errorf(e, "%s: definition does not match its annotation %v", e.name, ann)
+		annotated = false
+	}
+	params := make([]*typ, len(e.paramNames))
+	for i, param := range e.paramNames {
+		params[i] = tAny
+		if annotated {
+			params[i] = ann.params[i]
+		}
+		locals[param] = params[i]
+	}
+	if annotated {
+		c.expect(e.expression, locals, ann.result, e.name+" result")
+		c.funcs[e.name] = ann
+		return
+	}
+	// recursive calls see the result as Any while the body is inferred
+	c.funcs[e.name] = funcType(tAny, params...)
+	c.funcs[e.name] = funcType(c.infer(e.expression, locals), params...)
+}
+
+// operators that require an exact number of operands
+var operandCounts = map[TokenType]int{TOK_AND: 2, TOK_OR: 2, TOK_NOT: 1, TOK_IF: 3}
+
+func (c *typeCheck) inferOperator(e *expOperator, locals map[string]*typ) *typ {
+	op := operatorNames[e.opType]
+	if n, ok := operandCounts[e.opType]; ok && len(e.operands) != n {
+		c.errorf(e, "'%s' requires %d operands", op, n)
+		return tAny
+	}
+	switch e.opType {
+	case TOK_ADD, TOK_SUB, TOK_MUL, TOK_DIV, TOK_GTEQ, TOK_LTEQ, TOK_GT, TOK_LT:
+		// an operator is typed like its builtin, which may be overridden
+		ft := c.builtinType(op)
+		if ft == nil {
+			ft = restType(tAny, tAny)
+		}
+		for i, operand := range e.operands {
+			want := ft.rest
+			if i < len(ft.params) {
+				want = ft.params[i]
+			}
+			if want == nil {
+				c.infer(operand, locals)
+				continue
+			}
+			c.expect(operand, locals, want, op)
+		}
+		return ft.result
+	case TOK_EQ:
+		if c.builtinType(op) == nil {
+			for _, operand := range e.operands {
+				c.infer(operand, locals)
+			}
+			return tAny
+		}
+		if len(e.operands) == 2 {
+			t1, t2 := c.infer(e.operands[0], locals), c.infer(e.operands[1], locals)
+			if !compatible(t1, t2) {
+				c.errorf(e, "=: cannot compare %v with %v", t1, t2)
+			}
+		}
+		return tBoolean
+	case TOK_AND, TOK_OR, TOK_NOT:
+		for _, operand := range e.operands {
+			c.expect(operand, locals, tBoolean, op)
+		}
+		return tBoolean
+	case TOK_IF:
+		c.expect(e.operands[0], locals, tBoolean, "if test")
+		return join(c.infer(e.operands[1], locals), c.infer(e.operands[2], locals))
+	}
+	return tAny
+}
@@ -0,0 +1,177 @@
+package minrkt
+
+import (
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestTypeCheck(t *testing.T) {
+	var tests = []struct {
+		a       string
+		wantErr string
+	}{
+		{"(+ 1 2)", ""},
+		{"(+ 1 #t)", "1:6: +: expected Number, given Boolean"},
+		{"(if 1 2 3)", "1:5: if test: expected Boolean, given Number"},
+		{"(if (< 1 2) 2 3)", ""},
+		{`(and #t "s")`, `1:9: and: expected Boolean, given String`},
+		{"(not 1 2)", "1:1: 'not' requires 1 operands"},
+		{`(= 1 "one")`, "1:1: =: cannot compare Number with String"},
+		{"(: f (-> Number Number Boolean))\n(define (f a b) (< a b))\n(f 1 2)", ""},
+		{"(: f (-> Number Number Boolean))\n(define (f a b) (< a b))\n(f 1 #f)", "3:6: f argument 2: expected Number, given Boolean"},
+		{"(: f (-> Number Number Boolean))\n(define (f a b) (< a b))\n(f 1)", "3:1: f: arity mismatch; expected 2, given 1"},
+		{"(: f (-> Number Number Boolean))\n(define (f a b) (< a b))\n(+ 1 (f 1 2))", "3:6: +: expected Number, given Boolean"},
+		{"(: f (-> Number Number))\n(define (f a) (if a 1 2))", "2:19: if test: expected Boolean, given Number"},
+		{"(: f (-> Number String))\n(define (f a) (+ a 1))", "2:15: f result: expected String, given Number"},
+		{"(: f (-> Number Number))\n(define (f a b) a)", "2:1: f: definition does not match its annotation (-> Number Number)"},
+		{"(: x Number)\n(define x #t)", "2:11: x: expected Number, given Boolean"},
+		{"(: x Number)\n(define x 2)\n(not x)", "3:6: not: expected Boolean, given Number"},
+		// inferred from the definitions
+		{"(define x 2)\n(and x #t)", "2:6: and: expected Boolean, given Number"},
+		{"(define (inc n) (+ n 1))\n(if (inc 1) 1 2)", "2:5: if test: expected Boolean, given Number"},
+		{"(define (id n) n)\n(if (id 1) 1 2)", ""},
+		{"(define (fact n) (if (< n 1) 1 (* n (fact (- n 1)))))\n(fact 1 2)", "2:1: fact: arity mismatch; expected 1, given 2"},
+		{"(g 1)\n(define (g) 1)", "1:1: g: arity mismatch; expected 0, given 1"},
+		{`(length 5)`, "1:9: length argument 1: expected (Listof Any), given Number"},
+		{`(error 5)`, "1:8: error argument 1: expected String, given Number"},
+		{`(list 1 #t "s")`, ""},
+		{"(let ([x 1] [y #t]) (if y x 0))", ""},
+		{"(let ([x 1]) (not x))", "1:19: not: expected Boolean, given Number"},
+		{"(: f (-> (Listof Number) Number))\n(define (f l) (length l))\n(f (list 1 2))", ""},
+		{"(unknown #t)", ""},
+		{"(+ #t #f)", "1:4: +: expected Number, given Boolean; 1:7: +: expected Number, given Boolean"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			prog, err := ParseSource(tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = NewTypeChecker().Check(prog)
+			if fmt.Sprint(err) != fmt.Sprint(tt.wantErr) && !(err == nil && tt.wantErr == "") {
+				t.Errorf("got %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTypeCheckerRemembers(t *testing.T) {
+	tc := NewTypeChecker()
+	check := func(src string) error {
+		prog, err := ParseSource(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tc.Check(prog)
+	}
+	if err := check("(: f (-> Number Boolean))"); err != nil {
+		t.Fatal(err)
+	}
+	if err := check("(define (f n) (> n 0)) (define y (+ 1 (f 2)))"); err == nil {
+		t.Errorf("expected an error adding a Boolean")
+	}
+	// the rejected program's y is forgotten
+	if err := check("(and y #t)"); err != nil {
+		t.Errorf("got %v, want y to be Any", err)
+	}
+	if err := check("(define (f n) (> n 0))"); err != nil {
+		t.Fatal(err)
+	}
+	if err := check("(f #t)"); err == nil || err.Error() != "1:4: f argument 1: expected Number, given Boolean" {
+		t.Errorf("got %v, want an error for the argument", err)
+	}
+}
+
+func TestTypeCheckerFor(t *testing.T) {
+	env, err := NewEnvironment(WithStandardPrelude(), WithOutput(io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.DefineBuiltin("+", Variadic, func(args []Value) (Value, error) {
+		return nil, nil
+	})
+	env.DefineBuiltin("max", Variadic, func(args []Value) (Value, error) {
+		return nil, nil
+	})
+	if _, err := evalLines(env, "(define (sub1 s) s)"); err != nil {
+		t.Fatal(err)
+	}
+	sandbox, err := NewSandboxEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		env     *Environment
+		a       string
+		wantErr string
+	}{
+		{env, "(add1 #t)", "1:7: add1 argument 1: expected Number, given Boolean"},
+		{env, "(if (square 2) 1 2)", "1:5: if test: expected Boolean, given Number"},
+		{env, "(if (second (list 1 2)) 1 2)", ""},
+		{env, "(third (list 1) 2)", "1:1: third: arity mismatch; expected 1, given 2"},
+		{env, "(display 1 2)", "1:1: display: arity mismatch; expected 1, given 2"},
+		{env, "(printf 1)", "1:9: printf argument 1: expected String, given Number"},
+		{env, `(- "a" 1)`, `1:4: -: expected Number, given String`},
+		// overridden builtins and redefined prelude functions are untyped
+		{env, `(+ "a" "b")`, ""},
+		{env, `(max "a")`, ""},
+		{env, "(sub1 #t)", ""},
+		{env, "(sub1 1 2)", "1:1: sub1: arity mismatch; expected 1, given 2"},
+		{sandbox, "(display 1 2)", ""},
+		{sandbox, "(add1 #t)", ""},
+		{sandbox, `(+ "a" "b")`, "1:4: +: expected Number, given String; 1:8: +: expected Number, given String"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			prog, err := ParseSource(tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = NewTypeCheckerFor(tt.env).Check(prog)
+			if fmt.Sprint(err) != fmt.Sprint(tt.wantErr) && !(err == nil && tt.wantErr == "") {
+				t.Errorf("got %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseTypeAnnotation(t *testing.T) {
+	var tests = []struct {
+		a       string
+		want    string
+		wantErr string
+	}{
+		{"(: f (-> Number Number Boolean))", "(: f (-> Number Number Boolean))", ""},
+		{"(: xs (Listof String))", "(: xs (Listof String))", ""},
+		{"(: thunk (-> Any))", "(: thunk (-> Any))", ""},
+		{"(: x Integer)", "", "1:1: with unknown type Integer"},
+		{"(: x (Vector Number))", "", "1:1: with unknown type constructor Vector"},
+		{"(: f (->))", "", "1:1: with -> requires a result type"},
+		{"(: (f) Number)", "", "1:1: with missing name in type annotation"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			prog, err := ParseSource(tt.a)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("got %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || unparse(prog.Forms[0]) != tt.want {
+				t.Errorf("got %v %v, want %s", prog, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTypeAnnotationEvaluates(t *testing.T) {
+	got, err := evalLines(newTestEnv(), "(: f (-> Number Number))", "(define (f n) (* n 2))", "(f 4)")
+	if err != nil || got != 8.0 {
+		t.Errorf("got %v %v, want 8", got, err)
+	}
+}
@@ -0,0 +1,95 @@
+package minrkt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// source spelling of each operator, used when printing forms
+var operatorNames = map[TokenType]string{
+	TOK_ADD:  "+",
+	TOK_SUB:  "-",
+	TOK_MUL:  "*",
+	TOK_DIV:  "/",
+	TOK_EQ:   "=",
+	TOK_GTEQ: ">=",
+	TOK_LTEQ: "<=",
+	TOK_GT:   ">",
+	TOK_LT:   "<",
+	TOK_AND:  "and",
+	TOK_OR:   "or",
+	TOK_NOT:  "not",
+	TOK_IF:   "if",
+}
+
+// unparse prints exp as MiniRacket source. An Exp implemented outside
+// this package need not be a fmt.Stringer; it prints as its type.
+func unparse(exp Exp) string {
+	if s, ok := exp.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("#<%T>", exp)
+}
+
+// list prints a parenthesised form from its head and sub-expressions
+func list(head string, exps []Exp) string {
+	parts := []string{head}
+	for _, exp := range exps {
+		parts = append(parts, unparse(exp))
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+func (e *expVar) String() string {
+	return e.name
+}
+
+func (e *expFunc) String() string {
+	return list(e.name, e.arguments)
+}
+
+func (e *expBoolConst) String() string {
+	return FormatValue(e.val)
+}
+
+func (e *expNumConst) String() string {
+	return FormatValue(e.val)
+}
+
+func (e *expInexactConst) String() string {
+	return writeValue(inexact(e.val))
+}
+
+func (e *expStrConst) String() string {
+	return strconv.Quote(e.val)
+}
+
+func (e *expOperator) String() string {
+	return list(operatorNames[e.opType], e.operands)
+}
+
+func (e *expDefineVar) String() string {
+	return list("define "+e.name, []Exp{e.val})
+}
+
+func (e *expDefineFunc) String() string {
+	signature := "(" + strings.Join(append([]string{e.name}, e.paramNames...), " ") + ")"
+	return list("define "+signature, []Exp{e.expression})
+}
+
+func (e *expLet) String() string {
+	bindings := make([]string, len(e.names))
+	for i, name := range e.names {
+		bindings[i] = "[" + name + " " + unparse(e.vals[i]) + "]"
+	}
+	return list("let ("+strings.Join(bindings, " ")+")", []Exp{e.body})
+}
+
+func (e *expWithHandlers) String() string {
+	var clauses []string
+	for _, clause := range e.clauses {
+		clauses = append(clauses, "["+clause.predicate+" "+clause.handler+"]")
+	}
+	return list("with-handlers ("+strings.Join(clauses, " ")+")", []Exp{e.body})
+}
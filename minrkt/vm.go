@@ -0,0 +1,366 @@
+package minrkt
+
+import "strconv"
+
+// vm runs bytecode for one Execute call
+type vm struct {
+	env *Environment // the evaluation's session
+	// compiled function bodies, keyed by the body expression
+	bodies map[Exp]*Code
+	depth  int
+	// frames of the active calls, with the call site and the callee's
+	// body of each; positions are only looked up when an error needs them
+	frames []Frame
+	sites  []Exp
+	callee []Exp
+}
+
+// callFrame is a suspended caller within one run of the VM
+type callFrame struct {
+	code   *Code
+	pc     int
+	locals []Value
+	base   int // stack height below the call's arguments
+}
+
+// activeHandler is a with-handlers form whose body is running
+type activeHandler struct {
+	e      *expWithHandlers
+	form   Exp // the breadcrumb of errors raised by the handlers
+	end    int // the instruction after the body
+	height int
+	calls  int // len(calls) when it was installed
+	frames int
+	depth  int
+	code   *Code
+	locals []Value
+}
+
+// Execute runs code compiled by Compile in env. It has the same semantics
+// and results as Evaluator on the expression that was compiled, except
+// that EvalOptions.Fuel counts instructions rather than expressions.
+func Execute(code *Code, env *Environment, opts ...EvalOptions) (interface{}, error) {
+	v := &vm{env: env.session(nil, opts), bodies: make(map[Exp]*Code)}
+	result, err := v.run(code, nil)
+	return topLevelValue(result), err
+}
+
+// body compiles a user-defined function the first time it is called
+func (v *vm) body(fn FuncParamExpr) (*Code, error) {
+	if code, ok := v.bodies[fn.expression]; ok {
+		return code, nil
+	}
+	code, err := compileBody(fn.expression, fn.params)
+	if err != nil {
+		return nil, err
+	}
+	v.bodies[fn.expression] = code
+	return code, nil
+}
+
+// enterCall is Environment.enterCall for the VM's own call depth
+func (v *vm) enterCall() error {
+	return v.env.limits.enter(v.depth)
+}
+
+// wrapForms adds form and the forms enclosing it in code to the
+// breadcrumb of err, as the tree-walking evaluator does while returning
+func wrapForms(err error, code *Code, form Exp) error {
+	for ; form != nil; form = code.parents[form] {
+		err = inForm(err, form)
+	}
+	return err
+}
+
+func (v *vm) pushFrame(name string, site, body Exp, args []Value) {
+	v.depth++
+	v.frames = append(v.frames, Frame{Name: name, Args: args})
+	v.sites = append(v.sites, site)
+	v.callee = append(v.callee, body)
+}
+
+func (v *vm) popFrame() {
+	v.depth--
+	v.frames = v.frames[:len(v.frames)-1]
+	v.sites = v.sites[:len(v.sites)-1]
+	v.callee = v.callee[:len(v.callee)-1]
+}
+
+// withContext attaches the active calls to err unless a deeper call
+// already did
+func (v *vm) withContext(err error) error {
+	if formErr, ok := err.(*FormError); ok && formErr.context != nil {
+		return err
+	}
+	return withContext(err, v.context())
+}
+
+// context is the active calls, with the position of each call site
+func (v *vm) context() []Frame {
+	frames := make([]Frame, len(v.frames))
+	// each call site is in the body of the call before it
+	positions := v.env.positions
+	for i, frame := range v.frames {
+		frame.Pos = positions[v.sites[i]]
+		frames[i] = frame
+		positions = v.env.sourceOf(v.callee[i])
+	}
+	return frames
+}
+
+// callImport calls a function imported from a module. Its body runs in
+// the module through the tree-walking evaluator, which finds the
+// arguments and the active calls in the session.
+func (v *vm) callImport(name string, site Exp, fn FuncParamExpr, args []Value) (Value, error) {
+	env := v.env
+	v.pushFrame(name, site, fn.expression, args)
+	params := make(map[string]interface{}, len(fn.params))
+	for i, param := range fn.params {
+		params[param] = args[i]
+	}
+	callStack, frames := env.CallStack, env.frames
+	env.CallStack, env.frames = append(env.CallStack, params), v.context()
+	result, err := fn.expression.Eval(env)
+	env.CallStack, env.frames = callStack, frames
+	if err != nil {
+		err = v.withContext(err)
+	}
+	v.popFrame()
+	return result, err
+}
+
+// callBuiltin calls the builtin name with the top n values of stack as
+// its arguments and replaces them with the result. The standard builtins
+// never keep their argument slice, so they are given the stack itself.
+func (v *vm) callBuiltin(stack []Value, name string, n int) ([]Value, error) {
+	builtin, ok := v.env.lookupBuiltin(name)
+	if !ok {
+		stack = stack[:len(stack)-n]
+		return stack, &UndefinedError{name}
+	}
+	args := stack[len(stack)-n:]
+	if builtin != standardBuiltins[name] {
+		args = append([]Value(nil), args...)
+	}
+	result, err := builtin.call(args)
+	stack = stack[:len(stack)-n]
+	if err != nil {
+		return stack, err
+	}
+	return append(stack, result), nil
+}
+
+// apply calls a procedure from outside the run loop, for with-handlers
+func (v *vm) apply(site Exp, name string, args []Value) (Value, error) {
+	fn, ok := v.env.lookupFunction(name)
+	if !ok {
+		if builtin, ok := v.env.lookupBuiltin(name); ok {
+			return builtin.call(args)
+		}
+		return name, &UndefinedError{name}
+	}
+	if len(args) != len(fn.params) {
+		return nil, arityError(name, strconv.Itoa(len(fn.params)), len(args))
+	}
+	if err := v.enterCall(); err != nil {
+		return nil, err
+	}
+	if _, imported := fn.expression.(*expImport); imported {
+		return v.callImport(name, site, fn, args)
+	}
+	code, err := v.body(fn)
+	if err != nil {
+		return nil, err
+	}
+	v.pushFrame(name, site, fn.expression, args)
+	result, err := v.run(code, args)
+	if err != nil {
+		err = v.withContext(err)
+	}
+	v.popFrame()
+	return result, err
+}
+
+// run executes code with the given parameter values until it returns.
+// Calls between user-defined functions stay inside the loop; only the
+// procedures with-handlers applies run in a nested loop.
+func (v *vm) run(code *Code, locals []Value) (Value, error) {
+	env := v.env
+	var stack []Value
+	var calls []callFrame
+	var handlers []activeHandler
+	pc := 0
+	for {
+		in := code.instrs[pc]
+		form := code.forms[pc]
+		pc++
+		err := env.step()
+		if err == nil {
+			switch in.op {
+			case opConst:
+				stack = append(stack, code.consts[in.a])
+			case opLocal:
+				stack = append(stack, locals[in.a])
+			case opGlobal:
+				name := code.names[in.a]
+				val, ok := env.lookupVariable(name)
+				if !ok {
+					err = &UndefinedError{name}
+					break
+				}
+				stack = append(stack, val)
+			case opDefine:
+				env.setVariable(code.names[in.a], stack[len(stack)-1])
+				stack[len(stack)-1] = nil
+			case opDefineFunc:
+				def := code.funcs[in.a]
+				env.setFunction(def.name, FuncParamExpr{def.paramNames, def.expression})
+				stack = append(stack, nil)
+			case opCall:
+				name := code.names[in.a]
+				fn, ok := env.lookupFunction(name)
+				if !ok {
+					stack, err = v.callBuiltin(stack, name, in.b)
+					break
+				}
+				args := make([]Value, in.b)
+				copy(args, stack[len(stack)-in.b:])
+				stack = stack[:len(stack)-in.b]
+				if len(args) != len(fn.params) {
+					err = arityError(name, strconv.Itoa(len(fn.params)), len(args))
+					break
+				}
+				if err = v.enterCall(); err != nil {
+					break
+				}
+				if _, imported := fn.expression.(*expImport); imported {
+					var result Value
+					if result, err = v.callImport(name, form, fn, args); err == nil {
+						stack = append(stack, result)
+					}
+					break
+				}
+				var body *Code
+				if body, err = v.body(fn); err != nil {
+					break
+				}
+				calls = append(calls, callFrame{code, pc, locals, len(stack)})
+				v.pushFrame(name, form, fn.expression, args)
+				code, pc, locals = body, 0, args
+			case opOperand:
+				name := code.names[in.a]
+				if builtin, _ := env.lookupBuiltin(name); builtin == standardBuiltins[name] {
+					err = checkOperand(name, stack[len(stack)-1], in.b == 1)
+				}
+			case opOperator:
+				stack, err = v.callBuiltin(stack, code.names[in.a], in.b)
+			case opBool:
+				if _, ok := stack[len(stack)-1].(bool); !ok {
+					err = &EvalError{code.consts[in.a].(string) + " must be boolean"}
+				}
+			case opJumpIfFalse:
+				test := stack[len(stack)-1].(bool)
+				stack = stack[:len(stack)-1]
+				if !test {
+					pc = in.a
+				}
+			case opShortCircuit:
+				if stack[len(stack)-1].(bool) == (in.b == 1) {
+					pc = in.a
+				} else {
+					stack = stack[:len(stack)-1]
+				}
+			case opJump:
+				pc = in.a
+			case opFail:
+				err = &EvalError{code.consts[in.a].(string)}
+			case opPushHandler:
+				handlers = append(handlers, activeHandler{
+					e: code.handlers[in.a], form: form, end: in.b, height: len(stack),
+					calls: len(calls), frames: len(v.frames), depth: v.depth,
+					code: code, locals: locals,
+				})
+			case opPopHandler:
+				handlers = handlers[:len(handlers)-1]
+			case opModule:
+				if _, err = code.modules[in.a].Eval(env); err == nil {
+					stack = append(stack, nil)
+				}
+			case opBind:
+				if in.a >= len(locals) {
+					// never grow the caller's argument slice in place
+					locals = append(locals[:len(locals):len(locals)], make([]Value, in.a+1-len(locals))...)
+				}
+				locals[in.a] = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			case opReturn:
+				result := stack[len(stack)-1]
+				if len(calls) == 0 {
+					return result, nil
+				}
+				caller := calls[len(calls)-1]
+				calls = calls[:len(calls)-1]
+				v.popFrame()
+				code, pc, locals = caller.code, caller.pc, caller.locals
+				stack = append(stack[:caller.base], result)
+			}
+		}
+		if err == nil {
+			continue
+		}
+		err = wrapForms(err, code, form)
+		// unwind to the innermost with-handlers that handles err, or out
+		// of this run
+		for err != nil {
+			if n := len(handlers); n > 0 && handlers[n-1].calls == len(calls) {
+				h := handlers[n-1]
+				handlers = handlers[:n-1]
+				val, ok := exnValue(err)
+				if !ok {
+					continue
+				}
+				v.frames, v.sites, v.callee, v.depth = v.frames[:h.frames], v.sites[:h.frames], v.callee[:h.frames], h.depth
+				code, locals = h.code, h.locals
+				stack = stack[:h.height]
+				result, matched, handlerErr := v.handle(h.e, val)
+				if handlerErr != nil {
+					err = wrapForms(handlerErr, code, h.form)
+					continue
+				}
+				if !matched {
+					continue
+				}
+				stack = append(stack, result)
+				pc, err = h.end, nil
+				continue
+			}
+			if len(calls) == 0 {
+				return nil, err
+			}
+			err = v.withContext(err)
+			caller := calls[len(calls)-1]
+			calls = calls[:len(calls)-1]
+			v.popFrame()
+			code, pc, locals = caller.code, caller.pc, caller.locals
+			stack = stack[:caller.base]
+			// the call instruction is the one before the return address
+			err = wrapForms(err, code, code.forms[pc-1])
+		}
+	}
+}
+
+// handle runs the clauses of e for the raised value val and reports
+// whether one of them matched
+func (v *vm) handle(e *expWithHandlers, val Value) (Value, bool, error) {
+	for _, clause := range e.clauses {
+		matched, predErr := v.apply(e, clause.predicate, []Value{val})
+		if predErr != nil {
+			return nil, false, predErr
+		}
+		if matched != false {
+			result, handlerErr := v.apply(e, clause.handler, []Value{val})
+			return result, true, handlerErr
+		}
+	}
+	return nil, false, nil
+}
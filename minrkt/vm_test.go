@@ -0,0 +1,193 @@
+package minrkt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// execLines is evalLines for the bytecode VM
+func execLines(env *Environment, lines ...string) (interface{}, error) {
+	var result interface{}
+	for _, line := range lines {
+		tokens, err := Tokenizer(line)
+		if err != nil {
+			return nil, err
+		}
+		_, exp, err := Parser(tokens)
+		if err != nil {
+			return nil, err
+		}
+		code, err := Compile(exp)
+		if err != nil {
+			return nil, err
+		}
+		result, err = Execute(code, env)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// programs run by both backends in TestExecuteMatchesEvaluator
+var differentialPrograms = [][]string{
+	{"(+ 1 (* 2 3))"},
+	{"(- 10 4 3)", "(/ 1 4)", "(/ 5)", "(- 5)"},
+	{"(/ 1 0)"},
+	{"(= 1 1)", "(= 1 #t)", "(< 1 2)", "(>= 1 2)"},
+	{"(and #t #f)", "(or #f #t)", "(and #f 1)", "(or #t 1)", "(and 1 #t)", "(and #t 1)", "(and #t)"},
+	{"(if (< 1 2) 10 20)", "(if #f 1 2)", "(if 1 2 3)", "(if #t 1)"},
+	{"(not #t)", "(not 1)", "(not #t #f)"},
+	{"+inf.0", "(- +inf.0)", "(* 0 +nan.0)"},
+	{`"a string"`, `(list 1 "two" (list #t))`, `(hash-ref (hash "k" 5) "k")`},
+	{"(define x 5)", "x", "(define x (+ x 1))", "x"},
+	{"y"},
+	{"(nope 1 2)"},
+	{"(+ 1 #t (nope 1))", "(/ 1 0 (nope))", "(/ (nope) 0)", "(/ 0 2)", "(- #f (nope))"},
+	{"(define (f x) (+ x 1))", "(f 2)", "(f 1 2)", "(f)"},
+	{"(define (f x x) x)", "(f 1 2)"},
+	{"(define (fact n) (if (< n 1) 1 (* n (fact (- n 1)))))", "(fact 10)", "(fact #t)"},
+	{"(define (fib n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))", "(fib 15)"},
+	{"(define (even n) (if (= n 0) #t (odd (- n 1))))", "(define (odd n) (if (= n 0) #f (even (- n 1))))", "(even 40)", "(odd 41)"},
+	{"(define (loop n) (loop n))", "(loop 1)"},
+	{"(define z 3)", "(define (g x) (+ x z))", "(g 1)", "(define z 10)", "(g 1)"},
+	{"(define (f x) (define y (* x 2)))", "(f 4)", "y"},
+	{"(define (f x) (define (g) x))", "(f 4)", "(g)"},
+	{"(define (f) (h))", "(define (h) 7)", "(f)"},
+	{`(with-handlers ([exn:fail? exn-message]) (error "boom"))`},
+	{`(with-handlers ([exn:fail? exn-message]) (+ 1 2))`},
+	{`(with-handlers ([exn:fail:contract? exn-message]) (error "not contract"))`},
+	{`(define (always v) #t)`, `(with-handlers ([always exn-message]) (raise 42))`},
+	{`(define (id v) v)`, `(with-handlers ([exn? id]) (raise 42))`},
+	{`(define (safe a b) (with-handlers ([exn:fail:contract:divide-by-zero? exn-message]) (/ a b)))`, "(+ 1 (safe 1 0))", "(safe 4 2)"},
+	{`(define (deep n) (if (= n 0) (error "bottom" n) (deep (- n 1))))`, `(with-handlers ([exn:fail? exn-message]) (+ 1 (deep 20)))`, "(deep 3)"},
+	{`(define (m e) (exn-message e))`, `(define (bad e) (error "in handler"))`,
+		`(with-handlers ([exn? m]) (with-handlers ([exn:fail? bad]) (raise 1)))`,
+		`(with-handlers ([exn? m]) (with-handlers ([exn:fail? bad]) (error "x")))`},
+	{`(define (f x) (with-handlers ([exn:fail? exn-message]) (if x (g x) 0)))`, `(define (g x) (+ x 1))`, "(f 1)", "(f #t)", "(f #f)"},
+	{`(with-handlers ([nope exn-message]) (error "x"))`},
+	{`(with-handlers ([exn:fail:contract:arity? exn-message]) (exn-message))`},
+	{"(let ([x 1] [y 2]) (+ x y))", "(let ([x 1]) (let ([x 2] [y x]) (+ x y)))", "(let () 5)", "(void)"},
+	{"(define (f x) (let ([y (* x 2)]) (let ([x 1]) (+ x y))))", "(f 5)", "(let ([x 3]) (f x))"},
+	{"(define x 10)", "(define (g) x)", "(define (h x) (let ([y x]) (+ y (g))))", "(h 1)", "(let ([x 5]) (g))"},
+	{"(define (f n) (let ([m (- n 1)]) (if (< n 1) 0 (+ n (f m)))))", "(f 10)", "(let ([z (/ 1 0)]) z)", "(let ([z 1]) (+ z #t))"},
+}
+
+func TestExecuteMatchesEvaluator(t *testing.T) {
+	for _, program := range differentialPrograms {
+		testname := fmt.Sprintf("%s", strings.Join(program, " "))
+		t.Run(testname, func(t *testing.T) {
+			treeEnv, vmEnv := newTestEnv(), newTestEnv()
+			for _, line := range program {
+				want, wantErr := evalLines(treeEnv, line)
+				got, gotErr := execLines(vmEnv, line)
+				if fmt.Sprint(wantErr) != fmt.Sprint(gotErr) {
+					t.Fatalf("%s: got error %v, want %v", line, gotErr, wantErr)
+				}
+				if wantErr == nil && fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", want) {
+					t.Errorf("%s: got %#v, want %#v", line, got, want)
+				}
+				if wantErr != nil && fmt.Sprintf("%+v", gotErr) != fmt.Sprintf("%+v", wantErr) {
+					t.Errorf("%s: got detail\n%+v\nwant\n%+v", line, gotErr, wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestExecuteLimits(t *testing.T) {
+	env := newTestEnv()
+	if _, err := execLines(env, "(define (loop n) (loop n))", "(define (down n) (if (= n 0) 0 (+ 1 (down (- n 1)))))", "(define (misuse n) (loop))"); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		a       string
+		opts    EvalOptions
+		wantErr string
+	}{
+		{"(loop 1)", EvalOptions{Fuel: 1000}, "evaluation fuel of 1000 steps exhausted"},
+		{"(down 100)", EvalOptions{MaxDepth: 50}, "recursion depth limit of 50 exceeded"},
+		{"(with-handlers ([exn? exn-message]) (down 100))", EvalOptions{MaxDepth: 50}, "recursion depth limit of 50 exceeded"},
+		{"(down 100)", EvalOptions{MaxDepth: 101}, ""},
+		{"(misuse 1)", EvalOptions{MaxDepth: 1}, "loop: arity mismatch; expected 1, given 0"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s %+v", tt.a, tt.opts)
+		t.Run(testname, func(t *testing.T) {
+			code, err := Compile(mustParse(t, tt.a))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Execute(code, env, tt.opts)
+			if fmt.Sprint(err) != fmt.Sprint(tt.wantErr) && !(err == nil && tt.wantErr == "") {
+				t.Errorf("got %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompileUnsupported(t *testing.T) {
+	var tests = []struct {
+		a       []string
+		wantErr string
+	}{
+		{[]string{"(syntax (a b))"}, "compile: syntax and syntax-case are not supported; use Evaluator"},
+		// function bodies are compiled when they are first called
+		{[]string{"(define (f x) (syntax-case x () [(a b) (syntax b)]))", "(f 1)"}, "compile: syntax and syntax-case are not supported; use Evaluator"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s", tt.a)
+		t.Run(testname, func(t *testing.T) {
+			_, err := execLines(newTestEnv(), tt.a...)
+			if fmt.Sprint(err) != tt.wantErr {
+				t.Errorf("got %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func mustParse(t testing.TB, line string) Exp {
+	tokens, err := Tokenizer(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, exp, err := Parser(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exp
+}
+
+const fibSource = "(define (fib n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))"
+
+func BenchmarkEvaluatorFib(b *testing.B) {
+	env := newTestEnv()
+	if _, err := evalLines(env, fibSource); err != nil {
+		b.Fatal(err)
+	}
+	exp := mustParse(b, "(fib 20)")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Evaluator(exp, env); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExecuteFib(b *testing.B) {
+	env := newTestEnv()
+	if _, err := execLines(env, fibSource); err != nil {
+		b.Fatal(err)
+	}
+	code, err := Compile(mustParse(b, "(fib 20)"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Execute(code, env); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -2,17 +2,42 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"my.com/cs5400/minrkt"
 )
 
+var (
+	optimize = flag.Bool("O", false, "optimize each input before evaluating it")
+	typed    = flag.Bool("typed", false, "type check each input against its (: name type) annotations before evaluating it")
+)
+
 func main() {
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "check":
+		os.Exit(runCheck(flag.Args()[1:]))
+	case "test":
+		os.Exit(runTests(flag.Args()[1:]))
+	case "lsp":
+		os.Exit(runLSP())
+	}
 	fmt.Println("Welcome to minimalistic racket!")
-	env := &minrkt.Environment{}
-	env.Variables = make(map[string]interface{})
-	env.Functions = make(map[string]minrkt.FuncParamExpr)
+	env, err := minrkt.NewEnvironment(minrkt.WithStandardPrelude())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	types := minrkt.NewTypeCheckerFor(env)
+	macros := minrkt.NewStandardExpander()
 	scanner := bufio.NewScanner(os.Stdin)
 	for {
 		fmt.Print("> ")
@@ -20,27 +45,235 @@ func main() {
 			break
 		}
 		line := scanner.Text()
-		if len(line) != 0 {
-			tokens, err := minrkt.Tokenizer(line)
-			if err != nil {
+		if strings.HasPrefix(line, ",") {
+			runCommand(env, macros, line)
+		} else if len(line) != 0 {
+			prog, err := macros.ParseSource(line)
+			var charErr *minrkt.InvalidCharError
+			if errors.As(err, &charErr) {
 				fmt.Printf("Input Error: %v\n", err)
 				continue
-			}
-			remaingToks, exp, err := minrkt.Parser(tokens)
-			// if []Tokens is not empty throw error
-			if len(remaingToks) != 0 {
-				fmt.Println("Parse Error: missing )")
-			}
-			if err != nil {
+			} else if err != nil {
 				fmt.Printf("Parse Error: %v\n", err)
 				continue
 			}
-			result, err := minrkt.Evaluator(exp, env)
+			if *typed {
+				if err := types.Check(prog); err != nil {
+					fmt.Printf("Type Error: %v\n", err)
+					continue
+				}
+			}
+			if *optimize {
+				prog = minrkt.Optimize(prog, env)
+			}
+			results, err := minrkt.EvaluateProgram(prog, env)
+			for _, result := range results {
+				if result != nil {
+					fmt.Println(minrkt.FormatValue(result))
+				}
+			}
 			if err != nil {
-				fmt.Println(err)
-			} else if result != nil {
-				fmt.Println(result)
+				fmt.Printf("%+v\n", err)
+			}
+		}
+	}
+}
+
+// runCommand handles the REPL's own ,command lines
+func runCommand(env *minrkt.Environment, macros *minrkt.Expander, line string) {
+	fields := strings.Fields(line)
+	switch {
+	case fields[0] == ",expand" && len(fields) > 1:
+		// show each macro use rewritten, then the forms that result
+		macros.Trace = os.Stdout
+		prog, err := macros.ParseSource(strings.TrimSpace(strings.TrimPrefix(line, ",expand")))
+		macros.Trace = nil
+		if err != nil {
+			fmt.Printf("Parse Error: %v\n", err)
+			break
+		}
+		for _, form := range prog.Forms {
+			fmt.Println(form)
+		}
+	case fields[0] == ",save-image" && len(fields) == 2:
+		f, err := os.Create(fields[1])
+		if err == nil {
+			err = env.SaveImage(f)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
 			}
 		}
+		if err != nil {
+			fmt.Printf("Image Error: %v\n", err)
+		}
+	case fields[0] == ",load-image" && len(fields) == 2:
+		f, err := os.Open(fields[1])
+		if err == nil {
+			err = env.LoadImage(f)
+			f.Close()
+		}
+		if err != nil {
+			fmt.Printf("Image Error: %v\n", err)
+		}
+	default:
+		fmt.Println("Commands: ,save-image FILE  ,load-image FILE  ,expand FORM")
+	}
+}
+
+// runLSP implements `minrkt1 lsp`: a language server on stdin and
+// stdout. Its exit status is 1 if the client exits without shutting it
+// down first.
+func runLSP() int {
+	// stdout carries the protocol, so nothing else may print there
+	env, err := minrkt.NewEnvironment(minrkt.WithStandardPrelude(), minrkt.WithOutput(io.Discard))
+	if err == nil {
+		err = minrkt.ServeLSP(os.Stdin, os.Stdout, env)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// fileDiagnostic is a Diagnostic as `minrkt1 check -json` prints it
+type fileDiagnostic struct {
+	File string `json:"file"`
+	minrkt.Diagnostic
+}
+
+// runCheck lints the files in args without running them and returns the
+// exit status: 1 if any file has errors, 2 for bad usage
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the diagnostics as a JSON array")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: minrkt1 check [-json] file.rkt ...")
+		return 2
+	}
+	diags := []fileDiagnostic{}
+	failed := false
+	for _, file := range flags.Args() {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		// each file requires modules relative to its own directory
+		env, err := minrkt.NewEnvironment(minrkt.WithStandardPrelude(), minrkt.WithDirectory(filepath.Dir(file)))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		prog, err := minrkt.NewStandardExpander().ParseFile(string(src))
+		var syntaxErrs minrkt.SyntaxErrors
+		var fileDiags []minrkt.Diagnostic
+		if errors.As(err, &syntaxErrs) {
+			for _, syntaxErr := range syntaxErrs {
+				fileDiags = append(fileDiags, minrkt.Diagnostic{
+					Pos: syntaxErr.Pos, Severity: minrkt.SeverityError, Code: "syntax", Message: syntaxErr.Err.Error(),
+				})
+			}
+		} else if err != nil {
+			diags = append(diags, fileDiagnostic{file, minrkt.Diagnostic{
+				Severity: minrkt.SeverityError, Code: "syntax", Message: err.Error(),
+			}})
+			failed = true
+			continue
+		}
+		// the forms around a syntax error are still linted
+		fileDiags = append(fileDiags, minrkt.Lint(prog, env)...)
+		minrkt.SortDiagnostics(fileDiags)
+		failed = failed || minrkt.HasErrors(fileDiags)
+		for _, diag := range fileDiags {
+			diags = append(diags, fileDiagnostic{file, diag})
+		}
+	}
+	if *asJSON {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		out.Encode(diags)
+	} else {
+		for _, diag := range diags {
+			fmt.Printf("%s:%v\n", diag.File, diag.Diagnostic)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// runTests implements `minrkt1 test`: it runs the checks in every file
+// given, and in every file ending in test.rkt under the directories
+// given, then prints the failures and a summary. Its exit status is 1 if
+// anything failed and 2 for bad usage.
+func runTests(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: minrkt1 test file.rkt|dir ...")
+		return 2
+	}
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() && strings.HasSuffix(d.Name(), "test.rkt") {
+				files = append(files, path)
+			}
+			return err
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	passed, failed := 0, 0
+	for _, file := range files {
+		results, err := testFile(file)
+		for _, result := range results {
+			if result.Passed() {
+				passed++
+			} else {
+				failed++
+				fmt.Printf("%s:%v\n", file, result)
+			}
+		}
+		if err != nil {
+			failed++
+			fmt.Printf("%s: ERROR %v\n", file, err)
+		}
+	}
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// testFile runs the checks in one file
+func testFile(file string) ([]minrkt.TestResult, error) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	env, err := minrkt.NewEnvironment(minrkt.WithStandardPrelude(), minrkt.WithDirectory(filepath.Dir(file)))
+	if err != nil {
+		return nil, err
+	}
+	prog, err := minrkt.NewStandardExpander().ParseSource(string(src))
+	if err != nil {
+		return nil, err
 	}
+	return minrkt.RunTests(prog, env)
 }